@@ -0,0 +1,153 @@
+package coap
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// blockLifetime is how long a partial request body is kept after its
+// last block (EXCHANGE_LIFETIME, RFC 7252 section 4.8.2).
+const blockLifetime = 247 * time.Second
+
+// BlockSize returns the size in bytes of blocks with size exponent szx.
+func BlockSize(szx uint32) int {
+	return 16 << szx
+}
+
+// blockBodyKey returns the key of the request body that block m, sent
+// from a with block option opt, belongs to.  Blocks belong to the same
+// body only if they come from the same endpoint with the same request
+// options, including Request-Tag, so that concurrent or abandoned
+// transfers of one resource are kept apart (RFC 9175 section 3).
+func blockBodyKey(a net.Addr, m *Message, opt OptionID) string {
+	return a.String() + "\x00" + CacheKey(Message{Code: m.Code, opts: m.opts.Minus(opt).Minus(Size1)})
+}
+
+// partialBody is a request body being assembled from Block1 blocks.
+type partialBody struct {
+	body    []byte
+	expires time.Time
+}
+
+// AssembleBlock1 returns middleware reassembling request bodies sent
+// block-wise with the Block1 option (RFC 7959 section 2.5).  Blocks
+// before the last are answered with 2.31 Continue; the wrapped handler
+// sees the whole body once the last block arrives, and its response
+// carries the last Block1 option.  Blocks out of sequence get 4.08
+// Request Entity Incomplete, and bodies over maxSize 4.13 Request
+// Entity Too Large.
+//
+// Blocks with different Request-Tags belong to different bodies, so
+// clients can keep concurrent or abandoned transfers of one resource
+// apart (RFC 9175 section 3).
+func AssembleBlock1(maxSize int) Middleware {
+	var (
+		mu     sync.Mutex
+		bodies = map[string]*partialBody{}
+	)
+	return func(h Handler) Handler {
+		return funcHandler(func(l Transport, a net.Addr, m *Message) *Message {
+			opt, ok := m.Option(Block1).(uint32)
+			if !ok || m.Code == Empty || m.Code >= Created {
+				return h.ServeCOAP(l, a, m)
+			}
+			num, more, szx := DecodeBlock(opt)
+			if szx == 7 || (more == 1 && len(m.Payload) != BlockSize(szx)) {
+				return replyTo(m, BadRequest)
+			}
+			if size, ok := m.Option(Size1).(uint32); ok && int64(size) > int64(maxSize) {
+				return tooLarge(m, maxSize)
+			}
+
+			key := blockBodyKey(a, m, Block1)
+			now := time.Now()
+			mu.Lock()
+			for k, p := range bodies {
+				if now.After(p.expires) {
+					delete(bodies, k)
+				}
+			}
+			p := bodies[key]
+			if num == 0 {
+				p = &partialBody{}
+			}
+			switch {
+			case p == nil || len(p.body) != int(num)*BlockSize(szx):
+				delete(bodies, key)
+				mu.Unlock()
+				return replyTo(m, RequestEntityIncomplete)
+			case len(p.body)+len(m.Payload) > maxSize:
+				delete(bodies, key)
+				mu.Unlock()
+				return tooLarge(m, maxSize)
+			}
+			p.body = append(p.body, m.Payload...)
+			p.expires = now.Add(blockLifetime)
+			if more == 1 {
+				bodies[key] = p
+				mu.Unlock()
+				rv := replyTo(m, Continue)
+				rv.SetOption(Block1, opt)
+				return rv
+			}
+			delete(bodies, key)
+			mu.Unlock()
+
+			req := *m
+			req.opts = m.opts.Minus(Block1)
+			req.Payload = p.body
+			rv := h.ServeCOAP(l, a, &req)
+			if rv != nil {
+				rv.SetOption(Block1, opt)
+			}
+			return rv
+		})
+	}
+}
+
+// SendBlock1 sends req confirmable, with its payload in Block1 blocks
+// of size exponent szx (RFC 7959 section 2.5), and returns the response
+// to the last block, or the first response other than 2.31 Continue.
+// Blocks have consecutive message IDs starting at req.MessageID, and
+// are sent in smaller blocks if the server asks for them.
+//
+// Unless req has one, a new random Request-Tag is added, so that the
+// server keeps the body apart from other transfers of the resource from
+// this endpoint, such as earlier ones given up on (RFC 9175 section 3).
+func (c *Conn) SendBlock1(req Message, szx uint32) (*Message, error) {
+	body := req.Payload
+	req.Type = Confirmable
+	req.opts = req.opts.Minus(Block1)
+	if req.Option(RequestTag) == nil {
+		req.SetOption(RequestTag, newToken())
+	}
+	req.SetOption(Size1, uint32(len(body)))
+	for off := 0; ; {
+		size := BlockSize(szx)
+		end, more := off+size, uint32(1)
+		if end >= len(body) {
+			end, more = len(body), 0
+		}
+		m := req
+		m.Payload = body[off:end]
+		m.SetOption(Block1, EncodeBlock(uint32(off/size), more, szx))
+		rv, err := c.send(m)
+		if err != nil || rv == nil || more == 0 || rv.Code != Continue {
+			return rv, err
+		}
+		if v, ok := rv.Option(Block1).(uint32); ok {
+			if _, _, s := DecodeBlock(v); s < szx {
+				szx = s
+			}
+		}
+		off = end
+		req.MessageID++
+	}
+}
+
+func tooLarge(m *Message, maxSize int) *Message {
+	rv := replyTo(m, RequestEntityTooLarge)
+	rv.SetOption(Size1, uint32(maxSize))
+	return rv
+}
@@ -0,0 +1,175 @@
+package coap
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestBlockBodyKey(t *testing.T) {
+	block := func(num uint32, tag string) *Message {
+		m := &Message{Type: Confirmable, Code: PUT, MessageID: uint16(num)}
+		m.SetPathString("fw")
+		m.SetOption(Block1, EncodeBlock(num, 1, 0))
+		m.SetOption(Size1, uint32(100+num))
+		if tag != "" {
+			m.SetOption(RequestTag, []byte(tag))
+		}
+		return m
+	}
+	a := testAddr("a")
+	key := blockBodyKey(a, block(0, ""), Block1)
+	if k := blockBodyKey(a, block(3, ""), Block1); k != key {
+		t.Errorf("blocks of one body have keys %q and %q", key, k)
+	}
+	tagged := blockBodyKey(a, block(0, "A"), Block1)
+	if k := blockBodyKey(a, block(1, "A"), Block1); k != tagged {
+		t.Errorf("blocks of one tagged body have keys %q and %q", tagged, k)
+	}
+	others := []struct {
+		a net.Addr
+		m *Message
+	}{
+		{a, block(1, "A")},
+		{a, block(1, "B")},
+		{testAddr("b"), block(1, "")},
+	}
+	others[0].m.SetPathString("other")
+	for _, o := range others {
+		if k := blockBodyKey(o.a, o.m, Block1); k == key || k == tagged {
+			t.Errorf("%v %v: joins another body", o.a, o.m.opts)
+		}
+	}
+	if k := blockBodyKey(a, block(1, "B"), Block1); k == blockBodyKey(a, block(1, "A"), Block1) {
+		t.Errorf("Request-Tag ignored")
+	}
+}
+
+func TestAssembleBlock1(t *testing.T) {
+	var got []byte
+	h := AssembleBlock1(64)(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		if m.Option(Block1) != nil {
+			t.Error("handler saw Block1")
+		}
+		got = m.Payload
+		return &Message{Type: Acknowledgement, Code: Changed, MessageID: m.MessageID}
+	}))
+	a := testAddr("a")
+	block := func(num, more uint32, tag string, payload string) *Message {
+		m := &Message{Type: Confirmable, Code: PUT, MessageID: uint16(num)}
+		m.SetPathString("fw")
+		m.SetOption(Block1, EncodeBlock(num, more, 0))
+		if tag != "" {
+			m.SetOption(RequestTag, []byte(tag))
+		}
+		m.Payload = []byte(payload)
+		return m
+	}
+	const p0, p1 = "0123456789abcdef", "ghijklmnopqrstuv"
+
+	rv := h.ServeCOAP(nil, a, block(0, 1, "", p0))
+	if rv.Code != Continue || rv.Option(Block1) != EncodeBlock(0, 1, 0) {
+		t.Fatalf("first block: got %v", rv)
+	}
+	rv = h.ServeCOAP(nil, a, block(1, 0, "", p1[:3]))
+	if rv.Code != Changed || rv.Option(Block1) != EncodeBlock(1, 0, 0) || string(got) != p0+p1[:3] {
+		t.Fatalf("last block: got %v, body %q", rv, got)
+	}
+
+	// A missing block leaves the body incomplete.
+	got = nil
+	h.ServeCOAP(nil, a, block(0, 1, "", p0))
+	if rv := h.ServeCOAP(nil, a, block(2, 0, "", "x")); rv.Code != RequestEntityIncomplete || got != nil {
+		t.Errorf("missing block: got %v", rv)
+	}
+
+	// Blocks with different Request-Tags are separate bodies.
+	h.ServeCOAP(nil, a, block(0, 1, "A", p0))
+	h.ServeCOAP(nil, a, block(0, 1, "B", p1))
+	if rv := h.ServeCOAP(nil, a, block(1, 0, "A", "!")); rv.Code != Changed || string(got) != p0+"!" {
+		t.Errorf("tag A: got %v, body %q", rv, got)
+	}
+	if rv := h.ServeCOAP(nil, a, block(1, 0, "", "!")); rv.Code != RequestEntityIncomplete {
+		t.Errorf("untagged block joined a tagged body: got %v", rv)
+	}
+	if rv := h.ServeCOAP(nil, testAddr("b"), block(1, 0, "B", "!")); rv.Code != RequestEntityIncomplete {
+		t.Errorf("block from another endpoint: got %v", rv)
+	}
+	if rv := h.ServeCOAP(nil, a, block(1, 0, "B", "!")); rv.Code != Changed || !bytes.Equal(got, []byte(p1+"!")) {
+		t.Errorf("tag B: got %v, body %q", rv, got)
+	}
+
+	// Short intermediate blocks and oversized bodies are rejected.
+	if rv := h.ServeCOAP(nil, a, block(0, 1, "", "short")); rv.Code != BadRequest {
+		t.Errorf("short block: got %v", rv)
+	}
+	for i := uint32(0); i < 4; i++ {
+		h.ServeCOAP(nil, a, block(i, 1, "", p0))
+	}
+	if rv := h.ServeCOAP(nil, a, block(4, 0, "", "x")); rv.Code != RequestEntityTooLarge || rv.Option(Size1) != uint32(64) {
+		t.Errorf("oversized body: got %v", rv)
+	}
+
+	// Requests without Block1 pass through.
+	m := &Message{Type: Confirmable, Code: PUT, Payload: []byte("whole")}
+	if rv := h.ServeCOAP(nil, a, m); rv.Code != Changed || string(got) != "whole" {
+		t.Errorf("plain request: got %v", rv)
+	}
+}
+
+func TestSendBlock1(t *testing.T) {
+	srv, cli := Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	var mu sync.Mutex
+	var bodies, tags [][]byte
+	// shrink asks for blocks of 32 bytes after the first.
+	shrink := func(h Handler) Handler {
+		return funcHandler(func(l Transport, a net.Addr, m *Message) *Message {
+			rv := h.ServeCOAP(l, a, m)
+			if rv != nil && rv.Code == Continue {
+				num, more, _ := DecodeBlock(rv.Option(Block1).(uint32))
+				rv.SetOption(Block1, EncodeBlock(num, more, 1))
+			}
+			return rv
+		})
+	}
+	go Serve(srv, shrink(AssembleBlock1(1024)(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		mu.Lock()
+		bodies = append(bodies, m.Payload)
+		tags = append(tags, optionBytes(*m, RequestTag))
+		mu.Unlock()
+		return &Message{Type: Acknowledgement, Code: Changed, MessageID: m.MessageID, Token: m.Token}
+	}))))
+	c := NewConn(cli, srv.LocalAddr())
+
+	body := testBody(200)
+	req := Message{Code: PUT, MessageID: 10, Token: []byte("b1"), Payload: body}
+	req.SetPathString("fw")
+	for i := 0; i < 2; i++ {
+		rv, err := c.SendBlock1(req, 2)
+		// 64 bytes, then 32-byte blocks 2 to 5, and 8 bytes in block 6.
+		if err != nil || rv.Code != Changed || rv.Option(Block1) != EncodeBlock(6, 0, 1) {
+			t.Fatalf("upload %d: got %v, %v", i, rv, err)
+		}
+		req.MessageID += 10
+	}
+	mu.Lock()
+	if len(bodies) != 2 || !bytes.Equal(bodies[0], body) || !bytes.Equal(bodies[1], body) {
+		t.Errorf("got bodies %x", bodies)
+	}
+	if len(tags[0]) == 0 || bytes.Equal(tags[0], tags[1]) {
+		t.Errorf("uploads tagged %x", tags)
+	}
+	mu.Unlock()
+
+	req.SetOption(RequestTag, []byte("mine"))
+	if rv, err := c.SendBlock1(req, 2); err != nil || rv.Code != Changed || string(tags[2]) != "mine" {
+		t.Errorf("tagged upload: got %v, %v, tag %q", rv, err, tags[2])
+	}
+	req.Payload = testBody(2000)
+	if rv, err := c.SendBlock1(req, 2); err != nil || rv.Code != RequestEntityTooLarge {
+		t.Errorf("oversized upload: got %v, %v", rv, err)
+	}
+}
@@ -0,0 +1,241 @@
+package coap
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultMaxAge is the freshness lifetime, in seconds, of responses
+// without a Max-Age option.
+const DefaultMaxAge = 60
+
+// CacheEntry is a response held by a CacheStore.
+type CacheEntry struct {
+	// Response is the binary form of the response.
+	Response []byte
+	// Expires is when the response stops being fresh.  Stale
+	// entries are kept for revalidation if they carry an ETag.
+	Expires time.Time
+}
+
+// CacheStore is the storage backend of a Cache.  Implementations must
+// be safe for concurrent use, and may drop entries at any time.
+type CacheStore interface {
+	Get(key string) (CacheEntry, bool)
+	Set(key string, e CacheEntry)
+	Delete(key string)
+}
+
+// Cache is a client-side response cache (RFC 7252 section 5.6).  Fresh
+// responses to GET and FETCH requests are served from the cache, and
+// stale ones with an ETag are revalidated.  A Cache may be shared by
+// several connections.
+type Cache struct {
+	store CacheStore
+	now   func() time.Time
+}
+
+// NewCache returns a cache keeping responses in store.
+func NewCache(store CacheStore) *Cache {
+	return &Cache{store: store, now: time.Now}
+}
+
+// CacheKey returns the cache key of a request: its method, payload for
+// FETCH, and options other than Observe and those marked NoCacheKey.
+func CacheKey(m Message) string {
+	opts := append(options{}, m.opts...)
+	sort.Stable(opts)
+
+	b := []byte{byte(m.Code)}
+	for _, o := range opts {
+		if isNoCacheKey(o.ID) || o.ID == Observe {
+			continue
+		}
+		v := o.toBytes()
+		b = binary.AppendUvarint(b, uint64(o.ID))
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+	if m.Code == FETCH {
+		b = append(b, m.Payload...)
+	}
+	return string(b)
+}
+
+// isNoCacheKey reports whether an option is excluded from the cache key
+// (RFC 7252 section 5.4.6).
+func isNoCacheKey(id OptionID) bool {
+	return id&0x1e == 0x1c
+}
+
+// cacheable reports whether the response to req may come from the
+// cache.  Requests carrying their own ETags are validating a copy the
+// caller holds.
+func cacheable(req Message) bool {
+	return req.IsConfirmable() && (req.Code == GET || req.Code == FETCH) &&
+		req.Option(ETag) == nil && req.Option(Observe) == nil
+}
+
+// maxAge returns the freshness lifetime of a response.
+func maxAge(m Message) time.Duration {
+	if v, ok := m.Option(MaxAge).(uint32); ok {
+		return time.Duration(v) * time.Second
+	}
+	return DefaultMaxAge * time.Second
+}
+
+// send serves req from the cache, or through exchange, updating the
+// cache with the response.  peer distinguishes the origin servers
+// sharing the cache.
+func (c *Cache) send(peer string, req Message, exchange func(Message) (*Message, error)) (*Message, error) {
+	key := peer + "\x00" + CacheKey(req)
+	now := c.now()
+
+	var stored *Message
+	if e, ok := c.store.Get(key); ok {
+		if m, err := ParseMessage(e.Response); err == nil {
+			if now.Before(e.Expires) {
+				m.SetOption(MaxAge, uint32((e.Expires.Sub(now)+time.Second-1)/time.Second))
+				return reply(req, m), nil
+			}
+			if m.Option(ETag) != nil {
+				stored = &m
+				req.SetOption(ETag, m.Option(ETag))
+			}
+		}
+	}
+
+	res, err := exchange(req)
+	if err != nil || res == nil {
+		return res, err
+	}
+	if etag, ok := res.Option(ETag).([]byte); ok && res.Code == Valid && stored != nil &&
+		!bytes.Equal(etag, stored.Option(ETag).([]byte)) {
+		// The server validated a representation the caller does
+		// not have; ask for the current one.
+		c.store.Delete(key)
+		stored = nil
+		req.RemoveOption(ETag)
+		req.MessageID++
+		if res, err = exchange(req); err != nil || res == nil {
+			return res, err
+		}
+		res.MessageID = req.MessageID - 1
+	}
+
+	switch {
+	case res.Code == Valid && stored != nil:
+		// The response updates the Max-Age of the stored one,
+		// which is reset to the default if it has none (RFC 7252
+		// section 5.6.2).
+		stored.RemoveOption(MaxAge)
+		for _, id := range []OptionID{MaxAge, ETag} {
+			if v := res.Option(id); v != nil {
+				stored.SetOption(id, v)
+			}
+		}
+		c.put(key, *stored, now)
+		m := reply(req, *stored)
+		m.Type = res.Type
+		return m, nil
+	case res.Code == Content || res.Code >= BadRequest:
+		c.put(key, *res, now)
+	default:
+		c.store.Delete(key)
+	}
+	return res, nil
+}
+
+// put stores res, unless it is already stale and cannot be
+// revalidated.
+func (c *Cache) put(key string, res Message, now time.Time) {
+	age := maxAge(res)
+	if age == 0 && res.Option(ETag) == nil {
+		c.store.Delete(key)
+		return
+	}
+	b, err := res.MarshalBinary()
+	if err != nil {
+		return
+	}
+	c.store.Set(key, CacheEntry{Response: b, Expires: now.Add(age)})
+}
+
+// reply returns a stored response m as the response to req.
+func reply(req, m Message) *Message {
+	m.Type = Acknowledgement
+	m.MessageID = req.MessageID
+	m.Token = req.Token
+	return &m
+}
+
+// memoryStore is a CacheStore evicting the least recently used entries
+// beyond a size limit.
+type memoryStore struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	lru      *list.List // of *memoryItem, most recently used first
+	items    map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry CacheEntry
+}
+
+// NewMemoryCacheStore returns an in-memory CacheStore holding at most
+// maxBytes of keys and responses.
+func NewMemoryCacheStore(maxBytes int) CacheStore {
+	return &memoryStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func (s *memoryStore) Get(key string) (CacheEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return CacheEntry{}, false
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*memoryItem).entry, true
+}
+
+func (s *memoryStore) Set(key string, e CacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteLocked(key)
+	n := len(key) + len(e.Response)
+	if n > s.maxBytes {
+		return
+	}
+	s.items[key] = s.lru.PushFront(&memoryItem{key, e})
+	s.size += n
+	for s.size > s.maxBytes {
+		s.deleteLocked(s.lru.Back().Value.(*memoryItem).key)
+	}
+}
+
+func (s *memoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteLocked(key)
+}
+
+func (s *memoryStore) deleteLocked(key string) {
+	el, ok := s.items[key]
+	if !ok {
+		return
+	}
+	it := s.lru.Remove(el).(*memoryItem)
+	delete(s.items, key)
+	s.size -= len(it.key) + len(it.entry.Response)
+}
@@ -0,0 +1,227 @@
+package coap
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// cacheTestServer serves a resource whose ETag and payload come from
+// the current version, answering requests carrying that ETag with 2.03.
+type cacheTestServer struct {
+	requests []Message
+	version  string
+	maxAge   uint32
+	noMaxAge bool   // omit Max-Age from 2.03 responses
+	validTag string // if set, answer any ETag with 2.03 and this ETag
+}
+
+func (s *cacheTestServer) ServeCOAP(l Transport, a net.Addr, m *Message) *Message {
+	s.requests = append(s.requests, *m)
+	rv := &Message{
+		Type:      Acknowledgement,
+		Code:      Content,
+		MessageID: m.MessageID,
+		Token:     m.Token,
+		Payload:   []byte("value " + s.version),
+	}
+	if s.version != "" {
+		rv.SetOption(ETag, []byte(s.version))
+		if etag, ok := m.Option(ETag).([]byte); ok && string(etag) == s.version {
+			rv.Code = Valid
+			rv.Payload = nil
+		}
+	}
+	if m.Option(ETag) != nil && s.validTag != "" {
+		rv.Code = Valid
+		rv.Payload = nil
+		rv.SetOption(ETag, []byte(s.validTag))
+	}
+	if rv.Code != Valid || !s.noMaxAge {
+		rv.SetOption(MaxAge, s.maxAge)
+	}
+	return rv
+}
+
+func newCacheTest(t *testing.T, s *cacheTestServer) (*Conn, *time.Time) {
+	srv, cli := Pipe()
+	t.Cleanup(func() { srv.Close(); cli.Close() })
+	go Serve(srv, s)
+
+	now := time.Unix(1000, 0)
+	cache := NewCache(NewMemoryCacheStore(1 << 16))
+	cache.now = func() time.Time { return now }
+	c := NewConn(cli, srv.LocalAddr())
+	c.SetCache(cache)
+	return c, &now
+}
+
+func cacheGet(t *testing.T, c *Conn, id uint16, path string) *Message {
+	req := Message{Type: Confirmable, Code: GET, MessageID: id, Token: []byte{byte(id)}}
+	req.SetPathString(path)
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv.MessageID != id || string(rv.Token) != string([]byte{byte(id)}) {
+		t.Fatalf("response %v does not match request %d", rv, id)
+	}
+	return rv
+}
+
+func TestCacheFresh(t *testing.T) {
+	s := &cacheTestServer{version: "1", maxAge: 10}
+	c, now := newCacheTest(t, s)
+
+	cacheGet(t, c, 1, "/a")
+	*now = now.Add(4 * time.Second)
+	rv := cacheGet(t, c, 2, "/a")
+	if len(s.requests) != 1 {
+		t.Fatalf("server saw %d requests, want 1", len(s.requests))
+	}
+	if string(rv.Payload) != "value 1" || rv.Option(MaxAge) != uint32(6) {
+		t.Errorf("cached response %q, Max-Age %v", rv.Payload, rv.Option(MaxAge))
+	}
+
+	cacheGet(t, c, 3, "/b")
+	if len(s.requests) != 2 {
+		t.Errorf("different path served from cache")
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	s := &cacheTestServer{version: "1", maxAge: 10}
+	c, now := newCacheTest(t, s)
+
+	cacheGet(t, c, 1, "/a")
+	*now = now.Add(11 * time.Second)
+	s.maxAge = 20
+	rv := cacheGet(t, c, 2, "/a")
+	if len(s.requests) != 2 || string(s.requests[1].Option(ETag).([]byte)) != "1" {
+		t.Fatalf("stale entry not revalidated: %v", s.requests)
+	}
+	if rv.Code != Content || string(rv.Payload) != "value 1" || rv.Option(MaxAge) != uint32(20) {
+		t.Errorf("revalidated response %v %q, Max-Age %v", rv.Code, rv.Payload, rv.Option(MaxAge))
+	}
+
+	*now = now.Add(15 * time.Second)
+	cacheGet(t, c, 3, "/a")
+	if len(s.requests) != 2 {
+		t.Errorf("2.03 did not refresh the entry")
+	}
+
+	*now = now.Add(10 * time.Second)
+	s.version = "2"
+	rv = cacheGet(t, c, 4, "/a")
+	if rv.Code != Content || string(rv.Payload) != "value 2" {
+		t.Errorf("changed resource: %v %q", rv.Code, rv.Payload)
+	}
+	cacheGet(t, c, 5, "/a")
+	if len(s.requests) != 3 {
+		t.Errorf("server saw %d requests, want 3", len(s.requests))
+	}
+}
+
+func TestCacheRevalidateDefaultMaxAge(t *testing.T) {
+	s := &cacheTestServer{version: "1", maxAge: 10, noMaxAge: true}
+	c, now := newCacheTest(t, s)
+
+	cacheGet(t, c, 1, "/a")
+	*now = now.Add(11 * time.Second)
+	cacheGet(t, c, 2, "/a")
+	if len(s.requests) != 2 || s.requests[1].Option(ETag) == nil {
+		t.Fatalf("stale entry not revalidated: %v", s.requests)
+	}
+
+	// Without Max-Age the 2.03 makes the entry fresh for 60s.
+	*now = now.Add(50 * time.Second)
+	rv := cacheGet(t, c, 3, "/a")
+	if len(s.requests) != 2 || rv.Option(MaxAge) != uint32(10) {
+		t.Errorf("entry not fresh for the default Max-Age: %d requests, Max-Age %v",
+			len(s.requests), rv.Option(MaxAge))
+	}
+	*now = now.Add(11 * time.Second)
+	cacheGet(t, c, 4, "/a")
+	if len(s.requests) != 3 {
+		t.Errorf("entry fresh beyond the default Max-Age")
+	}
+}
+
+func TestCacheRevalidateOtherETag(t *testing.T) {
+	s := &cacheTestServer{version: "1", maxAge: 10}
+	c, now := newCacheTest(t, s)
+
+	cacheGet(t, c, 1, "/a")
+	*now = now.Add(11 * time.Second)
+	s.version = "2"
+	s.validTag = "other"
+	rv := cacheGet(t, c, 2, "/a")
+	if rv.Code != Content || string(rv.Payload) != "value 2" {
+		t.Fatalf("got %v %q, want the current representation", rv.Code, rv.Payload)
+	}
+	if len(s.requests) != 3 || s.requests[2].Option(ETag) != nil {
+		t.Errorf("refetch %v carries an ETag", s.requests)
+	}
+}
+
+func TestCacheBypass(t *testing.T) {
+	s := &cacheTestServer{maxAge: 0}
+	c, _ := newCacheTest(t, s)
+
+	// Max-Age 0 without an ETag cannot be reused.
+	cacheGet(t, c, 1, "/a")
+	cacheGet(t, c, 2, "/a")
+
+	s.maxAge = 60
+	post := Message{Type: Confirmable, Code: POST, MessageID: 3}
+	c.Send(post)
+	c.Send(post)
+	if len(s.requests) != 4 {
+		t.Errorf("server saw %d requests, want 4", len(s.requests))
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	m := Message{Code: GET}
+	m.SetPathString("/a/b")
+	m.SetOption(Accept, AppJSON)
+
+	n := m
+	n.SetOption(Size1, uint32(10))
+	n.SetOption(Observe, uint32(0))
+	if CacheKey(m) != CacheKey(n) {
+		t.Error("NoCacheKey and Observe options changed the key")
+	}
+	n.SetOption(Accept, AppCBOR)
+	if CacheKey(m) == CacheKey(n) {
+		t.Error("Accept ignored")
+	}
+
+	f := Message{Code: FETCH, Payload: []byte("x")}
+	g := Message{Code: FETCH, Payload: []byte("y")}
+	if CacheKey(f) == CacheKey(g) {
+		t.Error("FETCH payload ignored")
+	}
+}
+
+func TestMemoryCacheStore(t *testing.T) {
+	s := NewMemoryCacheStore(10)
+	s.Set("a", CacheEntry{Response: []byte("1234")})
+	s.Set("b", CacheEntry{Response: []byte("1234")})
+	s.Get("a")
+	s.Set("c", CacheEntry{Response: []byte("1234")})
+	if _, ok := s.Get("b"); ok {
+		t.Error("least recently used entry kept")
+	}
+	if _, ok := s.Get("a"); !ok {
+		t.Error("recently used entry evicted")
+	}
+	s.Set("d", CacheEntry{Response: make([]byte, 20)})
+	if _, ok := s.Get("d"); ok {
+		t.Error("oversized entry stored")
+	}
+	s.Delete("a")
+	if _, ok := s.Get("a"); ok {
+		t.Error("deleted entry kept")
+	}
+}
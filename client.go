@@ -1,6 +1,7 @@
 package coap
 
 import (
+	"bytes"
 	"net"
 	"time"
 )
@@ -18,49 +19,107 @@ const (
 
 // Conn is a CoAP client connection.
 type Conn struct {
-	conn *net.UDPConn
-	buf  []byte
+	conn  Transport
+	addr  net.Addr
+	buf   []byte
+	cache *Cache
 }
 
-// Dial connects a CoAP client.
+// Dial connects a CoAP client.  Supported networks are "udp", "udp4",
+// "udp6" and "unixgram".
 func Dial(n, addr string) (*Conn, error) {
-	uaddr, err := net.ResolveUDPAddr(n, addr)
+	raddr, err := resolveAddr(n, addr)
 	if err != nil {
 		return nil, err
 	}
 
-	s, err := net.DialUDP("udp", nil, uaddr)
+	var s Transport
+	switch n {
+	case "unixgram":
+		// An unnamed address is autobound so the server can
+		// reply.
+		s, err = net.ListenUnixgram(n, &net.UnixAddr{Net: n})
+	default:
+		s, err = net.ListenUDP(n, nil)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &Conn{s, make([]byte, maxPktLen)}, nil
+	return NewConn(s, raddr), nil
+}
+
+// NewConn creates a CoAP client connection exchanging messages with
+// the endpoint at addr over the given transport.
+func NewConn(t Transport, addr net.Addr) *Conn {
+	return &Conn{conn: t, addr: addr, buf: make([]byte, maxPktLen)}
+}
+
+// SetCache makes the connection serve responses from cache where
+// possible.  A nil cache disables caching.
+func (c *Conn) SetCache(cache *Cache) {
+	c.cache = cache
 }
 
 // Send a message.  Get a response if there is one.
 func (c *Conn) Send(req Message) (*Message, error) {
-	err := Transmit(c.conn, nil, req)
-	if err != nil {
-		return nil, err
+	if c.cache != nil && cacheable(req) {
+		return c.cache.send(c.addr.String(), req, c.send)
 	}
+	return c.send(req)
+}
 
-	if !req.IsConfirmable() {
-		return nil, nil
+// send sends req, retrying once with the Echo value of a 4.01
+// Unauthorized response (RFC 9175 section 2.3).  The retry uses the
+// next message ID.
+func (c *Conn) send(req Message) (*Message, error) {
+	rv, err := c.exchange(req)
+	if err != nil || rv == nil || rv.Code != Unauthorized {
+		return rv, err
+	}
+	echo, ok := rv.Option(Echo).([]byte)
+	if !ok || bytes.Equal(echo, optionBytes(req, Echo)) {
+		return rv, nil
 	}
+	req.MessageID++
+	req.SetOption(Echo, echo)
+	return c.exchange(req)
+}
+
+func optionBytes(m Message, id OptionID) []byte {
+	b, _ := m.Option(id).([]byte)
+	return b
+}
 
-	rv, err := Receive(c.conn, c.buf)
+func (c *Conn) exchange(req Message) (*Message, error) {
+	err := Transmit(c.conn, c.addr, req)
 	if err != nil {
 		return nil, err
 	}
 
-	return &rv, nil
+	if !req.IsConfirmable() {
+		return nil, nil
+	}
+
+	return c.Receive()
 }
 
-// Receive a message.
+// Receive a message.  Messages from endpoints other than the one
+// this connection was created for are discarded.
 func (c *Conn) Receive() (*Message, error) {
-	rv, err := Receive(c.conn, c.buf)
-	if err != nil {
-		return nil, err
+	for {
+		rv, from, err := receiveFrom(c.conn, c.buf)
+		if err != nil {
+			return nil, err
+		}
+		if from != nil && from.String() != c.addr.String() {
+			continue
+		}
+		return &rv, nil
 	}
-	return &rv, nil
+}
+
+// Close closes the underlying transport.
+func (c *Conn) Close() error {
+	return c.conn.Close()
 }
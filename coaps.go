@@ -0,0 +1,32 @@
+package coap
+
+import (
+	"github.com/zltl/go-coap/dtls"
+)
+
+var (
+	_ = Transport(&dtls.Conn{})
+	_ = Transport(&dtls.Listener{})
+)
+
+// DialDTLS connects a CoAP client over DTLS ("coaps").  The network
+// must be "udp", "udp4" or "udp6".
+func DialDTLS(n, addr string, config *dtls.Config) (*Conn, error) {
+	c, err := dtls.Dial(n, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(c, c.RemoteAddr()), nil
+}
+
+// ListenAndServeDTLS binds to the given address and serves requests
+// over DTLS forever.  Handlers receive the client's address as a
+// *dtls.Addr carrying the PSK identity or raw public key it
+// authenticated with.
+func ListenAndServeDTLS(n, addr string, config *dtls.Config, rh Handler) error {
+	l, err := dtls.Listen(n, addr, config)
+	if err != nil {
+		return err
+	}
+	return Serve(l, rh)
+}
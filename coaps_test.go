@@ -0,0 +1,54 @@
+package coap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/zltl/go-coap/dtls"
+)
+
+func TestServeOverDTLS(t *testing.T) {
+	psk := func(identity []byte) ([]byte, error) {
+		return []byte("secret for " + string(identity)), nil
+	}
+
+	l, err := dtls.Listen("udp", "127.0.0.1:0", &dtls.Config{PSK: psk})
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+
+	go Serve(l, FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		return &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   dtls.PeerIdentity(a),
+		}
+	}))
+
+	c, err := DialDTLS("udp", l.LocalAddr().String(), &dtls.Config{
+		PSK:         psk,
+		PSKIdentity: []byte("sensor-17"),
+	})
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	req := Message{
+		Type:      Confirmable,
+		Code:      GET,
+		MessageID: 5684,
+	}
+	req.SetPathString("/whoami")
+
+	rv, err := c.Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv == nil || string(rv.Payload) != "sensor-17" {
+		t.Fatalf("Expected identity sensor-17, got %v", rv)
+	}
+}
@@ -0,0 +1,135 @@
+// Package coaptest provides utilities for CoAP testing.
+package coaptest
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock is a fake clock whose time only moves when Advance is
+// called.  The zero value is not usable; create one with NewClock.
+type Clock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	seq    uint64
+	timers timerHeap
+}
+
+// NewClock creates a Clock set to an arbitrary fixed instant.
+func NewClock() *Clock {
+	c := &Clock{now: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current fake time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc arranges for f to be called once the clock has been
+// advanced by at least d.  f runs on the goroutine calling Advance.
+func (c *Clock) AfterFunc(d time.Duration, f func()) *Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &Timer{c: c, at: c.now.Add(d), seq: c.seq, f: f}
+	heap.Push(&c.timers, t)
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer that
+// becomes due in the order of its deadline.  Timers due at the same
+// instant fire in the order they were created.  Advance returns after
+// all fired timer functions have returned.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].at.After(end) {
+		t := heap.Pop(&c.timers).(*Timer)
+		c.now = t.at
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// BlockUntil blocks until at least n timers are pending.  Tests use
+// it to wait for the code under test to start waiting on the clock
+// before calling Advance.
+func (c *Clock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// Pending returns the number of timers that have not yet fired.
+func (c *Clock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Timer is a pending call scheduled with Clock.AfterFunc.
+type Timer struct {
+	c     *Clock
+	at    time.Time
+	seq   uint64
+	f     func()
+	index int
+}
+
+// Stop prevents the timer from firing.  It returns false if the
+// timer has already fired or been stopped.
+func (t *Timer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.c.timers, t.index)
+	t.c.cond.Broadcast()
+	return true
+}
+
+type timerHeap []*Timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*Timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,41 @@
+package coaptest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClockFiresInOrder(t *testing.T) {
+	c := NewClock()
+	start := c.Now()
+
+	var fired []string
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, "b") })
+	c.AfterFunc(time.Second, func() { fired = append(fired, "a") })
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, "c") })
+	stopped := c.AfterFunc(time.Second, func() { fired = append(fired, "x") })
+
+	if !stopped.Stop() {
+		t.Errorf("Expected Stop to report a pending timer")
+	}
+	if stopped.Stop() {
+		t.Errorf("Expected second Stop to report no pending timer")
+	}
+
+	c.Advance(time.Second)
+	if !reflect.DeepEqual(fired, []string{"a"}) {
+		t.Errorf("Expected [a] after 1s, got %v", fired)
+	}
+	c.Advance(time.Hour)
+	if !reflect.DeepEqual(fired, []string{"a", "b", "c"}) {
+		t.Errorf("Expected [a b c], got %v", fired)
+	}
+	if got := c.Now().Sub(start); got != time.Hour+time.Second {
+		t.Errorf("Expected clock to advance by %v, got %v",
+			time.Hour+time.Second, got)
+	}
+	if c.Pending() != 0 {
+		t.Errorf("Expected no pending timers, got %v", c.Pending())
+	}
+}
@@ -0,0 +1,310 @@
+package coaptest
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zltl/go-coap"
+)
+
+// Addr is the address of an Endpoint on a simulated Network.
+type Addr string
+
+// Network returns "sim".
+func (a Addr) Network() string { return "sim" }
+
+func (a Addr) String() string { return string(a) }
+
+// LinkConfig describes the behavior of a virtual link between two
+// endpoints.  Each datagram sent over the link is subject to the
+// configured impairments independently.
+type LinkConfig struct {
+	// Loss is the probability that a datagram is dropped.
+	Loss float64
+	// Duplicate is the probability that a datagram is delivered
+	// twice.
+	Duplicate float64
+	// Reorder is the probability that a datagram is held back by
+	// ReorderDelay, letting datagrams sent after it overtake it.
+	Reorder float64
+	// ReorderDelay is the extra delay of reordered datagrams.  If
+	// zero, one millisecond is used.
+	ReorderDelay time.Duration
+	// Latency is the one-way delay of every datagram.
+	Latency time.Duration
+	// MTU is the largest datagram the link carries.  Larger
+	// datagrams are dropped.  Zero means unlimited.
+	MTU int
+}
+
+// Stats counts the datagrams handled by a Network.
+type Stats struct {
+	Sent       int
+	Delivered  int
+	Dropped    int
+	Duplicated int
+}
+
+// ErrAddrInUse is returned by Listen when the requested name is
+// already bound on the network.
+var ErrAddrInUse = errors.New("address already in use")
+
+// Network is a simulated datagram network.  Endpoints exchange
+// datagrams over virtual links whose loss, duplication, reordering,
+// latency and MTU are configurable.  All delays are measured on a
+// fake Clock, and all random decisions come from a seeded source, so
+// a test run is deterministic.
+type Network struct {
+	clock *Clock
+
+	mu        sync.Mutex
+	rand      *rand.Rand
+	link      LinkConfig
+	links     map[[2]Addr]LinkConfig
+	endpoints map[Addr]*Endpoint
+	stats     Stats
+}
+
+// NewNetwork creates a simulated network timed by clock.  Links use
+// cfg unless overridden with SetLink.  seed initializes the source of
+// the random impairment decisions.
+func NewNetwork(clock *Clock, seed int64, cfg LinkConfig) *Network {
+	return &Network{
+		clock:     clock,
+		rand:      rand.New(rand.NewSource(seed)),
+		link:      cfg,
+		links:     make(map[[2]Addr]LinkConfig),
+		endpoints: make(map[Addr]*Endpoint),
+	}
+}
+
+// Clock returns the clock timing this network.
+func (n *Network) Clock() *Clock { return n.clock }
+
+// SetLink configures the link carrying datagrams from one endpoint
+// to another.  The reverse direction is not affected.
+func (n *Network) SetLink(from, to Addr, cfg LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[[2]Addr{from, to}] = cfg
+}
+
+// Stats returns the datagram counters of the network.
+func (n *Network) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.stats
+}
+
+// Listen creates an endpoint bound to the given name.
+func (n *Network) Listen(name string) (*Endpoint, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addr := Addr(name)
+	if _, ok := n.endpoints[addr]; ok {
+		return nil, ErrAddrInUse
+	}
+	e := &Endpoint{
+		net:    n,
+		addr:   addr,
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	n.endpoints[addr] = e
+	return e, nil
+}
+
+func (n *Network) send(from Addr, to net.Addr, b []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.stats.Sent++
+	dst, ok := n.endpoints[Addr(to.String())]
+	if !ok {
+		n.stats.Dropped++
+		return
+	}
+	cfg, ok := n.links[[2]Addr{from, dst.addr}]
+	if !ok {
+		cfg = n.link
+	}
+
+	if cfg.MTU > 0 && len(b) > cfg.MTU {
+		n.stats.Dropped++
+		return
+	}
+	if n.rand.Float64() < cfg.Loss {
+		n.stats.Dropped++
+		return
+	}
+	copies := 1
+	if n.rand.Float64() < cfg.Duplicate {
+		n.stats.Duplicated++
+		copies++
+	}
+
+	for i := 0; i < copies; i++ {
+		p := packet{from: from, data: append([]byte(nil), b...)}
+		delay := cfg.Latency
+		if n.rand.Float64() < cfg.Reorder {
+			if cfg.ReorderDelay > 0 {
+				delay += cfg.ReorderDelay
+			} else {
+				delay += time.Millisecond
+			}
+		}
+		if delay == 0 {
+			n.deliverLocked(dst, p)
+			continue
+		}
+		n.clock.AfterFunc(delay, func() {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			n.deliverLocked(dst, p)
+		})
+	}
+}
+
+func (n *Network) deliverLocked(dst *Endpoint, p packet) {
+	if dst.enqueue(p) {
+		n.stats.Delivered++
+	} else {
+		n.stats.Dropped++
+	}
+}
+
+func (n *Network) remove(e *Endpoint) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.endpoints[e.addr] == e {
+		delete(n.endpoints, e.addr)
+	}
+}
+
+type packet struct {
+	from Addr
+	data []byte
+}
+
+// Endpoint is a coap.Transport attached to a simulated Network.
+//
+// Read deadlines are measured on the network's clock: a deadline t
+// passed to SetReadDeadline expires once the clock has advanced by
+// time.Until(t).  This lets code that computes deadlines from
+// time.Now, such as coap.Receive, time out as soon as the test
+// advances the clock.
+type Endpoint struct {
+	net  *Network
+	addr Addr
+
+	mu       sync.Mutex
+	queue    []packet
+	deadline time.Time
+	ready    chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ = coap.Transport(&Endpoint{})
+
+func (e *Endpoint) enqueue(p packet) bool {
+	select {
+	case <-e.closed:
+		return false
+	default:
+	}
+	e.mu.Lock()
+	e.queue = append(e.queue, p)
+	e.mu.Unlock()
+	e.signal()
+	return true
+}
+
+func (e *Endpoint) signal() {
+	select {
+	case e.ready <- struct{}{}:
+	default:
+	}
+}
+
+// ReadFrom reads the next datagram delivered to the endpoint.
+func (e *Endpoint) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case <-e.closed:
+			return 0, nil, net.ErrClosed
+		default:
+		}
+
+		e.mu.Lock()
+		if len(e.queue) > 0 {
+			p := e.queue[0]
+			e.queue = e.queue[1:]
+			e.mu.Unlock()
+			return copy(b, p.data), p.from, nil
+		}
+		deadline := e.deadline
+		e.mu.Unlock()
+
+		var t *Timer
+		if !deadline.IsZero() {
+			d := deadline.Sub(e.net.clock.Now())
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			t = e.net.clock.AfterFunc(d, e.signal)
+		}
+
+		select {
+		case <-e.ready:
+		case <-e.closed:
+		}
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
+
+// WriteTo sends a datagram to the endpoint at addr.  Datagrams to
+// unknown endpoints are silently dropped.
+func (e *Endpoint) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-e.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	e.net.send(e.addr, addr, b)
+	return len(b), nil
+}
+
+// LocalAddr returns the endpoint's address.
+func (e *Endpoint) LocalAddr() net.Addr { return e.addr }
+
+// SetReadDeadline sets the read deadline relative to the network's
+// clock.  A zero t disables the deadline.
+func (e *Endpoint) SetReadDeadline(t time.Time) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if t.IsZero() {
+		e.deadline = time.Time{}
+	} else {
+		e.deadline = e.net.clock.Now().Add(time.Until(t))
+	}
+	e.signal()
+	return nil
+}
+
+// Close detaches the endpoint from the network.  Blocked reads
+// return net.ErrClosed.
+func (e *Endpoint) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.closed)
+		e.net.remove(e)
+	})
+	return nil
+}
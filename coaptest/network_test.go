@@ -0,0 +1,201 @@
+package coaptest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zltl/go-coap"
+)
+
+func listen(t *testing.T, n *Network, name string) *Endpoint {
+	e, err := n.Listen(name)
+	if err != nil {
+		t.Fatalf("Error listening on %v: %v", name, err)
+	}
+	return e
+}
+
+func read(t *testing.T, e *Endpoint) string {
+	buf := make([]byte, 1500)
+	e.SetReadDeadline(time.Now().Add(time.Second))
+	nr, _, err := e.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Error reading from %v: %v", e.LocalAddr(), err)
+	}
+	return string(buf[:nr])
+}
+
+func TestNetworkListenInUse(t *testing.T) {
+	n := NewNetwork(NewClock(), 1, LinkConfig{})
+	listen(t, n, "a")
+	if _, err := n.Listen("a"); err != ErrAddrInUse {
+		t.Errorf("Expected %v, got %v", ErrAddrInUse, err)
+	}
+}
+
+func TestNetworkLatency(t *testing.T) {
+	c := NewClock()
+	n := NewNetwork(c, 1, LinkConfig{Latency: 50 * time.Millisecond})
+	a, b := listen(t, n, "a"), listen(t, n, "b")
+
+	a.WriteTo([]byte("hello"), b.LocalAddr())
+	c.Advance(49 * time.Millisecond)
+	if st := n.Stats(); st.Delivered != 0 {
+		t.Fatalf("Expected nothing delivered before latency, got %+v", st)
+	}
+	c.Advance(time.Millisecond)
+	if got := read(t, b); got != "hello" {
+		t.Errorf("Expected hello, got %q", got)
+	}
+}
+
+func TestNetworkImpairments(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  LinkConfig
+		size int
+		exp  Stats
+	}{
+		{"loss", LinkConfig{Loss: 1}, 10,
+			Stats{Sent: 1, Dropped: 1}},
+		{"duplicate", LinkConfig{Duplicate: 1}, 10,
+			Stats{Sent: 1, Delivered: 2, Duplicated: 1}},
+		{"mtu", LinkConfig{MTU: 100}, 101,
+			Stats{Sent: 1, Dropped: 1}},
+		{"within mtu", LinkConfig{MTU: 100}, 100,
+			Stats{Sent: 1, Delivered: 1}},
+	}
+
+	for _, test := range tests {
+		n := NewNetwork(NewClock(), 1, test.cfg)
+		a, b := listen(t, n, "a"), listen(t, n, "b")
+		a.WriteTo(make([]byte, test.size), b.LocalAddr())
+		if st := n.Stats(); st != test.exp {
+			t.Errorf("%v: expected %+v, got %+v", test.name, test.exp, st)
+		}
+	}
+}
+
+func TestNetworkLossRate(t *testing.T) {
+	n := NewNetwork(NewClock(), 42, LinkConfig{Loss: 0.25})
+	a := listen(t, n, "a")
+	for i := 0; i < 1000; i++ {
+		a.WriteTo([]byte("x"), Addr("b"))
+	}
+	b := listen(t, n, "b")
+	defer b.Close()
+	for i := 0; i < 1000; i++ {
+		a.WriteTo([]byte("x"), Addr("b"))
+	}
+	st := n.Stats()
+	// The first 1000 datagrams had no receiver.
+	if st.Sent != 2000 || st.Dropped-1000 < 200 || st.Dropped-1000 > 300 {
+		t.Errorf("Expected roughly 25%% loss, got %+v", st)
+	}
+}
+
+func TestNetworkReorder(t *testing.T) {
+	c := NewClock()
+	n := NewNetwork(c, 1, LinkConfig{})
+	a, b := listen(t, n, "a"), listen(t, n, "b")
+
+	n.SetLink(a.addr, b.addr, LinkConfig{Reorder: 1})
+	a.WriteTo([]byte("first"), b.LocalAddr())
+	n.SetLink(a.addr, b.addr, LinkConfig{})
+	a.WriteTo([]byte("second"), b.LocalAddr())
+	c.Advance(time.Millisecond)
+
+	if got := read(t, b); got != "second" {
+		t.Errorf("Expected second datagram first, got %q", got)
+	}
+	if got := read(t, b); got != "first" {
+		t.Errorf("Expected first datagram last, got %q", got)
+	}
+}
+
+func TestNetworkResponseTimeout(t *testing.T) {
+	c := NewClock()
+	n := NewNetwork(c, 1, LinkConfig{Loss: 1})
+	srv, cli := listen(t, n, "server"), listen(t, n, "client")
+	defer srv.Close()
+
+	req := coap.Message{
+		Type:      coap.Confirmable,
+		Code:      coap.GET,
+		MessageID: 1,
+	}
+
+	// Retransmit the request until MaxRetransmit is reached; every
+	// datagram is lost, so each attempt waits for the full timeout.
+	errc := make(chan error)
+	go func() {
+		conn := coap.NewConn(cli, srv.LocalAddr())
+		var err error
+		for i := 0; i <= coap.MaxRetransmit; i++ {
+			if _, err = conn.Send(req); err == nil {
+				break
+			}
+		}
+		errc <- err
+	}()
+
+	start := c.Now()
+	for i := 0; i <= coap.MaxRetransmit; i++ {
+		c.BlockUntil(1)
+		c.Advance(coap.ResponseTimeout)
+	}
+
+	err := <-errc
+	if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+	if st := n.Stats(); st.Sent != coap.MaxRetransmit+1 {
+		t.Errorf("Expected %v transmissions, got %+v", coap.MaxRetransmit+1, st)
+	}
+	exp := (coap.MaxRetransmit + 1) * coap.ResponseTimeout
+	if got := c.Now().Sub(start); got != exp {
+		t.Errorf("Expected %v of simulated time, got %v", exp, got)
+	}
+}
+
+func TestNetworkServe(t *testing.T) {
+	c := NewClock()
+	n := NewNetwork(c, 1, LinkConfig{Latency: 10 * time.Millisecond})
+	srv, cli := listen(t, n, "server"), listen(t, n, "client")
+	defer srv.Close()
+
+	go coap.Serve(srv, coap.FuncHandler(func(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
+		return &coap.Message{
+			Type:      coap.Acknowledgement,
+			Code:      coap.Content,
+			MessageID: m.MessageID,
+			Payload:   []byte("simulated"),
+		}
+	}))
+
+	resc := make(chan *coap.Message)
+	go func() {
+		rv, err := coap.NewConn(cli, srv.LocalAddr()).Send(coap.Message{
+			Type:      coap.Confirmable,
+			Code:      coap.GET,
+			MessageID: 7,
+		})
+		if err != nil {
+			t.Errorf("Error sending request: %v", err)
+		}
+		resc <- rv
+	}()
+
+	// Request in flight plus the client's read deadline.
+	c.BlockUntil(2)
+	c.Advance(10 * time.Millisecond)
+	// Response in flight plus the client's read deadline.
+	c.BlockUntil(2)
+	c.Advance(10 * time.Millisecond)
+
+	rv := <-resc
+	if rv == nil || string(rv.Payload) != "simulated" {
+		t.Fatalf("Expected simulated response, got %v", rv)
+	}
+}
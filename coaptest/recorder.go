@@ -0,0 +1,100 @@
+package coaptest
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zltl/go-coap"
+)
+
+// Addresses a ResponseRecorder presents to the handler by default.
+var (
+	RemoteAddr net.Addr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 49152}
+	LocalAddr  net.Addr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 5683}
+)
+
+// NewRequest returns a new confirmable request for the given method
+// and path, suitable for passing to a ResponseRecorder.
+func NewRequest(code coap.COAPCode, path string, payload []byte) *coap.Message {
+	m := &coap.Message{
+		Type:      coap.Confirmable,
+		Code:      code,
+		MessageID: 1,
+		Token:     []byte{0xc0, 0xa9},
+		Payload:   payload,
+	}
+	if path != "" && path != "/" {
+		m.SetPathString(path)
+	}
+	return m
+}
+
+// ResponseRecorder invokes a coap.Handler directly, without any
+// sockets, and records the reply it returns as well as any messages
+// it transmits on its own, such as observe notifications.
+//
+// ResponseRecorder is the coap.Transport passed to the handler.
+type ResponseRecorder struct {
+	// RemoteAddr is the source address presented to the handler.
+	RemoteAddr net.Addr
+	// Response is the message returned by the handler, or nil.
+	Response *coap.Message
+
+	mu   sync.Mutex
+	sent []Transmission
+}
+
+// Transmission is a message a handler wrote to its transport.
+type Transmission struct {
+	Addr    net.Addr
+	Message coap.Message
+}
+
+var _ = coap.Transport(&ResponseRecorder{})
+
+// NewRecorder returns an initialized ResponseRecorder.
+func NewRecorder() *ResponseRecorder {
+	return &ResponseRecorder{RemoteAddr: RemoteAddr}
+}
+
+// Serve passes req to h as if it had arrived from RemoteAddr, and
+// records and returns the handler's reply.
+func (r *ResponseRecorder) Serve(h coap.Handler, req *coap.Message) *coap.Message {
+	r.Response = h.ServeCOAP(r, r.RemoteAddr, req)
+	return r.Response
+}
+
+// Transmissions returns the messages written by the handler so far.
+func (r *ResponseRecorder) Transmissions() []Transmission {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Transmission(nil), r.sent...)
+}
+
+// WriteTo records a message written by the handler.
+func (r *ResponseRecorder) WriteTo(b []byte, addr net.Addr) (int, error) {
+	m, err := coap.ParseMessage(b)
+	if err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, Transmission{addr, m})
+	return len(b), nil
+}
+
+// ReadFrom always fails; handlers served by a recorder have nothing
+// to read.
+func (r *ResponseRecorder) ReadFrom(b []byte) (int, net.Addr, error) {
+	return 0, nil, net.ErrClosed
+}
+
+// LocalAddr returns the address the recorder pretends to serve on.
+func (r *ResponseRecorder) LocalAddr() net.Addr { return LocalAddr }
+
+// SetReadDeadline does nothing.
+func (r *ResponseRecorder) SetReadDeadline(t time.Time) error { return nil }
+
+// Close does nothing.
+func (r *ResponseRecorder) Close() error { return nil }
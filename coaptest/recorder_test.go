@@ -0,0 +1,64 @@
+package coaptest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/zltl/go-coap"
+)
+
+func TestRecorder(t *testing.T) {
+	h := coap.FuncHandler(func(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
+		notification := coap.Message{
+			Type:      coap.NonConfirmable,
+			Code:      coap.Content,
+			MessageID: 2,
+			Token:     m.Token,
+			Payload:   []byte("notify"),
+		}
+		if err := coap.Transmit(l, a, notification); err != nil {
+			t.Errorf("Error transmitting: %v", err)
+		}
+		return &coap.Message{
+			Type:      coap.Acknowledgement,
+			Code:      coap.Created,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+		}
+	})
+
+	rec := NewRecorder()
+	req := NewRequest(coap.POST, "/things", []byte("x"))
+	rv := rec.Serve(h, req)
+
+	if rv == nil || rv.Code != coap.Created {
+		t.Fatalf("Expected Created, got %v", rv)
+	}
+	if rec.Response != rv {
+		t.Errorf("Expected recorder to keep the response")
+	}
+
+	sent := rec.Transmissions()
+	if len(sent) != 1 {
+		t.Fatalf("Expected 1 transmission, got %v", len(sent))
+	}
+	if sent[0].Addr != RemoteAddr {
+		t.Errorf("Expected transmission to %v, got %v", RemoteAddr, sent[0].Addr)
+	}
+	if string(sent[0].Message.Payload) != "notify" {
+		t.Errorf("Expected notify, got %q", sent[0].Message.Payload)
+	}
+}
+
+func TestNewRequest(t *testing.T) {
+	req := NewRequest(coap.GET, "/a/b", nil)
+	if !req.IsConfirmable() || req.Code != coap.GET {
+		t.Errorf("Expected confirmable GET, got %v %v", req.Type, req.Code)
+	}
+	if req.PathString() != "a/b" {
+		t.Errorf("Expected path a/b, got %q", req.PathString())
+	}
+	if root := NewRequest(coap.GET, "/", nil); len(root.Path()) != 0 {
+		t.Errorf("Expected empty path, got %q", root.Path())
+	}
+}
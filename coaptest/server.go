@@ -0,0 +1,60 @@
+package coaptest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/zltl/go-coap"
+)
+
+// Server is a CoAP server listening on an ephemeral loopback UDP
+// port, for use in end-to-end tests.
+type Server struct {
+	// Addr is the host:port the server listens on.
+	Addr string
+	// Listener is the transport the server reads requests from.
+	Listener coap.Transport
+	// Client is a connection to the server, ready to send requests.
+	Client *coap.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewServer starts and returns a new Server serving h.  The caller
+// should call Close when finished, to shut it down.
+func NewServer(h coap.Handler) *Server {
+	l, err := coap.Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("coaptest: failed to listen on a port: %v", err))
+	}
+	addr := l.LocalAddr().String()
+
+	c, err := coap.Dial("udp", addr)
+	if err != nil {
+		l.Close()
+		panic(fmt.Sprintf("coaptest: failed to dial %v: %v", addr, err))
+	}
+
+	s := &Server{
+		Addr:     addr,
+		Listener: l,
+		Client:   c,
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		coap.Serve(l, h)
+	}()
+	return s
+}
+
+// Close shuts down the server and its client, and waits for the
+// server to stop reading requests.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		s.Client.Close()
+		s.Listener.Close()
+		<-s.done
+	})
+}
@@ -0,0 +1,37 @@
+package coaptest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/zltl/go-coap"
+)
+
+func TestNewServer(t *testing.T) {
+	s := NewServer(coap.FuncHandler(func(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
+		return &coap.Message{
+			Type:      coap.Acknowledgement,
+			Code:      coap.Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   []byte(m.PathString()),
+		}
+	}))
+	defer s.Close()
+
+	rv, err := s.Client.Send(*NewRequest(coap.GET, "/a/b", nil))
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv == nil || string(rv.Payload) != "a/b" {
+		t.Fatalf("Expected a/b, got %v", rv)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	s := NewServer(coap.FuncHandler(func(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
+		return nil
+	}))
+	s.Close()
+	s.Close()
+}
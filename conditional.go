@@ -0,0 +1,74 @@
+package coap
+
+import (
+	"bytes"
+	"net"
+)
+
+// Conditional returns a handler that evaluates the conditional request
+// options against the current ETag of a resource before passing
+// requests to h.  etag returns the ETag of the representation m
+// targets, or nil if the resource does not exist; resources with
+// several representations must give each its own ETag.
+//
+// PUT, POST and DELETE requests whose If-Match or If-None-Match
+// condition fails are answered with 4.12 Precondition Failed (RFC 7252
+// section 5.10.8), non-confirmable ones included.  GET and FETCH
+// requests carrying the current ETag are answered with 2.03 Valid (RFC
+// 7252 section 5.10.6.2), and their 2.05 responses from h are given the
+// current ETag if they have none.
+func Conditional(etag func(m *Message) []byte, h Handler) Handler {
+	return funcHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		current := etag(m)
+		switch m.Code {
+		case PUT, POST, DELETE:
+			if !preconditionsMet(m, current) {
+				return replyTo(m, PreconditionFailed)
+			}
+		case GET, FETCH:
+			if current == nil {
+				break
+			}
+			for _, v := range m.Options(ETag) {
+				if bytes.Equal(v.([]byte), current) {
+					return validReply(m, current)
+				}
+			}
+			rv := h.ServeCOAP(l, a, m)
+			if rv != nil && rv.Code == Content && rv.Option(ETag) == nil {
+				rv.SetOption(ETag, current)
+			}
+			return rv
+		}
+		return h.ServeCOAP(l, a, m)
+	})
+}
+
+// preconditionsMet reports whether the If-Match and If-None-Match
+// options of m hold for a resource with the given ETag.  An empty
+// If-Match value matches any existing resource.
+func preconditionsMet(m *Message, current []byte) bool {
+	if m.Option(IfNoneMatch) != nil && current != nil {
+		return false
+	}
+	ifMatch := m.Options(IfMatch)
+	if len(ifMatch) == 0 {
+		return true
+	}
+	if current == nil {
+		return false
+	}
+	for _, v := range ifMatch {
+		if v := v.([]byte); len(v) == 0 || bytes.Equal(v, current) {
+			return true
+		}
+	}
+	return false
+}
+
+// validReply builds the 2.03 Valid response to m.
+func validReply(m *Message, etag []byte) *Message {
+	rv := replyTo(m, Valid)
+	rv.SetOption(ETag, etag)
+	return rv
+}
@@ -0,0 +1,89 @@
+package coap
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConditional(t *testing.T) {
+	var etag []byte
+	served := 0
+	h := Conditional(func(m *Message) []byte { return etag },
+		FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+			served++
+			code := Changed
+			if m.Code == GET {
+				code = Content
+			}
+			return &Message{Type: Acknowledgement, Code: code,
+				MessageID: m.MessageID, Token: m.Token, Payload: []byte("x")}
+		}))
+
+	type opt struct {
+		id OptionID
+		v  interface{}
+	}
+	tests := []struct {
+		etag   string // "" means the resource does not exist
+		code   COAPCode
+		opts   []opt
+		want   COAPCode
+		served bool
+	}{
+		{"v1", PUT, nil, Changed, true},
+		{"v1", PUT, []opt{{IfMatch, []byte("v1")}}, Changed, true},
+		{"v1", PUT, []opt{{IfMatch, []byte("v0")}, {IfMatch, []byte("v1")}}, Changed, true},
+		{"v1", PUT, []opt{{IfMatch, []byte("v0")}}, PreconditionFailed, false},
+		{"v1", DELETE, []opt{{IfMatch, []byte{}}}, Changed, true},
+		{"", DELETE, []opt{{IfMatch, []byte{}}}, PreconditionFailed, false},
+		{"", PUT, []opt{{IfNoneMatch, []byte{}}}, Changed, true},
+		{"v1", POST, []opt{{IfNoneMatch, []byte{}}}, PreconditionFailed, false},
+		{"v1", GET, nil, Content, true},
+		{"v1", GET, []opt{{ETag, []byte("v0")}}, Content, true},
+		{"v1", GET, []opt{{ETag, []byte("v0")}, {ETag, []byte("v1")}}, Valid, false},
+		{"v1", GET, []opt{{IfMatch, []byte("v0")}}, Content, true},
+		{"", GET, []opt{{ETag, []byte("v1")}}, Content, true},
+	}
+	for i, test := range tests {
+		etag = nil
+		if test.etag != "" {
+			etag = []byte(test.etag)
+		}
+		served = 0
+		m := &Message{Type: Confirmable, Code: test.code, MessageID: 9, Token: []byte("t")}
+		for _, o := range test.opts {
+			m.AddOption(o.id, o.v)
+		}
+		rv := h.ServeCOAP(nil, nil, m)
+		if rv.Code != test.want || (served == 1) != test.served {
+			t.Errorf("%d: got %v (served %d), want %v (served %v)",
+				i, rv.Code, served, test.want, test.served)
+		}
+		if rv.Type != Acknowledgement || rv.MessageID != 9 || string(rv.Token) != "t" {
+			t.Errorf("%d: bad response header %v", i, rv)
+		}
+		if test.code == GET && test.etag != "" {
+			if got, _ := rv.Option(ETag).([]byte); string(got) != test.etag {
+				t.Errorf("%d: ETag %q, want %q", i, got, test.etag)
+			}
+		}
+	}
+}
+
+func TestConditionalNonConfirmable(t *testing.T) {
+	h := Conditional(func(m *Message) []byte { return []byte("v1") },
+		FuncHandler(func(l Transport, a net.Addr, m *Message) *Message { return nil }))
+
+	m := &Message{Type: NonConfirmable, Code: GET, MessageID: 1}
+	m.SetOption(ETag, []byte("v1"))
+	if rv := h.ServeCOAP(nil, nil, m); rv == nil || rv.Type != NonConfirmable || rv.Code != Valid {
+		t.Errorf("got %v, want NON 2.03", rv)
+	}
+
+	m = &Message{Type: NonConfirmable, Code: PUT, MessageID: 2, Token: []byte("t")}
+	m.SetOption(IfMatch, []byte("v0"))
+	if rv := h.ServeCOAP(nil, nil, m); rv == nil || rv.Type != NonConfirmable || rv.Code != PreconditionFailed ||
+		string(rv.Token) != "t" {
+		t.Errorf("got %v, want NON 4.12", rv)
+	}
+}
@@ -0,0 +1,385 @@
+package dtls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Conn is a client DTLS session over a connected datagram socket.
+// Each Read returns the payload of one application data record and
+// each Write sends one.
+type Conn struct {
+	conn net.Conn
+	s    *session
+
+	rmu     sync.Mutex
+	buf     []byte
+	pending [][]byte
+
+	closeOnce sync.Once
+}
+
+// Dial connects to the DTLS server at addr and performs a handshake.
+func Dial(network, addr string, config *Config) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.DialUDP(network, nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := Client(c, config)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return dc, nil
+}
+
+// Client performs a client handshake over c, which must be a
+// connected datagram socket, and returns the established session.
+func Client(c net.Conn, config *Config) (*Conn, error) {
+	send := func(b []byte) error {
+		_, err := c.Write(b)
+		return err
+	}
+	dc := &Conn{
+		conn: c,
+		s:    newSession(config, true, c.RemoteAddr(), send),
+		buf:  make([]byte, maxDatagramLen),
+	}
+	if err := dc.handshake(); err != nil {
+		var ae *AlertError
+		if errors.As(err, &ae) && !ae.Remote {
+			dc.s.sendAlert(ae.desc)
+		}
+		return nil, err
+	}
+	return dc, nil
+}
+
+func (c *Conn) handshake() error {
+	s := c.s
+	if err := s.startClient(); err != nil {
+		return err
+	}
+
+	end := time.Now().Add(s.cfg.handshakeTimeout())
+	timeout := initialRetransmit
+	for !s.established() {
+		wait := time.Now().Add(timeout)
+		if wait.After(end) {
+			wait = end
+		}
+		c.conn.SetReadDeadline(wait)
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				return err
+			}
+			if !time.Now().Before(end) {
+				return ErrHandshakeTimeout
+			}
+			s.mu.Lock()
+			err = s.sendFlight()
+			s.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			if timeout *= 2; timeout > maxRetransmit {
+				timeout = maxRetransmit
+			}
+			continue
+		}
+
+		app, err := s.handleDatagram(c.buf[:n])
+		if err != nil {
+			return err
+		}
+		c.queue(app)
+	}
+	return c.conn.SetReadDeadline(time.Time{})
+}
+
+func (c *Conn) queue(app [][]byte) {
+	c.pending = append(c.pending, app...)
+}
+
+// Read reads the payload of the next application data record.  If b
+// is too small, the rest of the payload is discarded.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.pending) == 0 {
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		app, err := c.s.handleDatagram(c.buf[:n])
+		c.queue(app)
+		if err != nil && len(c.pending) == 0 {
+			var ae *AlertError
+			if errors.As(err, &ae) {
+				if !ae.Remote {
+					c.s.sendAlert(ae.desc)
+				} else if ae.desc == alertCloseNotify {
+					return 0, io.EOF
+				}
+			}
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.pending[0])
+	c.pending = c.pending[1:]
+	return n, nil
+}
+
+// Write sends b as one application data record.
+func (c *Conn) Write(b []byte) (int, error) {
+	d, err := c.s.seal(b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.conn.Write(d); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads like Read, reporting the server as the source.
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+// WriteTo writes like Write.  addr is ignored; datagrams always go to
+// the server.
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// RemoteAddr returns the server's network address.
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// SetReadDeadline sets the deadline for Read calls.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// CipherSuite returns the negotiated cipher suite.
+func (c *Conn) CipherSuite() CipherSuite { return c.s.suite }
+
+// PeerPublicKey returns the server's raw public key, if the session
+// was authenticated with one.
+func (c *Conn) PeerPublicKey() *ecdsa.PublicKey { return c.s.peerKey }
+
+// Close sends close_notify and closes the underlying socket.
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.s.sendAlert(alertCloseNotify)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (s *session) startClient() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.offered = s.cfg.suites(true)
+	if len(s.offered) == 0 {
+		return ErrNoCipherSuite
+	}
+	var err error
+	if s.clientRandom, err = s.random(); err != nil {
+		return err
+	}
+	s.state = stateClientWaitHello
+	return s.sendClientHello()
+}
+
+func (s *session) sendClientHello() error {
+	ch := &clientHello{
+		random: s.clientRandom,
+		cookie: s.cookie,
+		suites: s.offered,
+		ext:    extensions{renegotiation: true},
+	}
+	for _, suite := range s.offered {
+		if suite == TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8 {
+			ch.ext.groups = []int{curveSECP256R1}
+			ch.ext.pointFormats = []byte{pointUncompressed}
+			ch.ext.sigAlgs = []int{sigECDSAWithSHA256}
+			ch.ext.serverCertTypes = []byte{certTypeRawPublicKey}
+			if s.cfg.PrivateKey != nil {
+				ch.ext.clientCertTypes = []byte{certTypeRawPublicKey}
+			}
+		}
+	}
+
+	s.flight = nil
+	s.addHandshake(typeClientHello, ch.marshal())
+	return s.sendFlight()
+}
+
+// clientHandshake advances the client handshake with message m from
+// the server.  transcript holds the messages preceding m.
+func (s *session) clientHandshake(m handshake, epoch uint16, transcript []byte) error {
+	switch {
+	case s.state == stateClientWaitHello && m.typ == typeHelloVerifyRequest:
+		cookie, ok := parseHelloVerifyRequest(m.body)
+		if !ok {
+			return localAlert(alertDecodeError)
+		}
+		// Neither the initial ClientHello nor the
+		// HelloVerifyRequest are part of the transcript.
+		s.cookie = append([]byte{}, cookie...)
+		s.transcript = nil
+		return s.sendClientHello()
+
+	case s.state == stateClientWaitHello && m.typ == typeServerHello:
+		sh, ok := parseServerHello(m.body)
+		if !ok {
+			return localAlert(alertDecodeError)
+		}
+		if sh.version != versionDTLS12 {
+			return localAlert(alertProtocolVersion)
+		}
+		offered := false
+		for _, suite := range s.offered {
+			offered = offered || suite == sh.suite
+		}
+		if !offered {
+			return localAlert(alertIllegalParameter)
+		}
+		s.suite = sh.suite
+		s.serverRandom = append([]byte{}, sh.random...)
+		s.state = stateClientWaitKeyExchange
+		if s.suite == TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8 {
+			if !bytes.Equal(sh.ext.serverCertTypes, []byte{certTypeRawPublicKey}) {
+				return localAlert(alertUnsupportedCertificate)
+			}
+			s.state = stateClientWaitCertificate
+		}
+		return nil
+
+	case s.state == stateClientWaitCertificate && m.typ == typeCertificate:
+		pub, err := s.parsePublicKey(m.body)
+		if err != nil {
+			return err
+		}
+		s.peerKey = pub
+		s.state = stateClientWaitKeyExchange
+		return nil
+
+	case s.state == stateClientWaitKeyExchange && m.typ == typeServerKeyExchange:
+		if s.suite == TLS_PSK_WITH_AES_128_CCM_8 {
+			// Only an identity hint, which we have no use
+			// for.
+			r := reader{b: m.body}
+			r.vec16()
+			if !r.done() {
+				return localAlert(alertDecodeError)
+			}
+			s.state = stateClientWaitHelloDone
+			return nil
+		}
+		params, pub, sig, ok := parseServerKeyExchangeECDHE(m.body)
+		if !ok {
+			return localAlert(alertDecodeError)
+		}
+		signed := append(append(append([]byte{}, s.clientRandom...), s.serverRandom...), params...)
+		if !verify(s.peerKey, signed, sig) {
+			return localAlert(alertDecryptError)
+		}
+		s.peerECDH = append([]byte{}, pub...)
+		s.state = stateClientWaitHelloDone
+		return nil
+
+	case s.state == stateClientWaitHelloDone && m.typ == typeCertificateRequest:
+		if s.certRequest || !parseCertificateRequest(m.body) {
+			return localAlert(alertDecodeError)
+		}
+		s.certRequest = true
+		return nil
+
+	case (s.state == stateClientWaitHelloDone ||
+		s.state == stateClientWaitKeyExchange && s.suite == TLS_PSK_WITH_AES_128_CCM_8) &&
+		m.typ == typeServerHelloDone:
+		return s.sendClientFinished()
+
+	case s.state == stateClientWaitFinished && m.typ == typeFinished:
+		if err := s.checkFinished(m, epoch, transcript); err != nil {
+			return err
+		}
+		s.establish()
+		return nil
+	}
+	return localAlert(alertUnexpectedMessage)
+}
+
+// sendClientFinished sends the client's second flight.
+func (s *session) sendClientFinished() error {
+	s.flight = nil
+
+	if s.certRequest {
+		body := appendVec24(nil, nil)
+		if s.cfg.PrivateKey != nil {
+			var err error
+			if body, err = s.marshalPublicKey(); err != nil {
+				return err
+			}
+		}
+		s.addHandshake(typeCertificate, body)
+	}
+
+	var premaster, cke []byte
+	switch s.suite {
+	case TLS_PSK_WITH_AES_128_CCM_8:
+		psk, err := s.cfg.PSK(s.cfg.PSKIdentity)
+		if err != nil || psk == nil {
+			return localAlert(alertInternalError)
+		}
+		s.identity = s.cfg.PSKIdentity
+		premaster = pskPremaster(psk)
+		cke = appendVec16(nil, s.cfg.PSKIdentity)
+	case TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8:
+		if err := s.generateECDHKey(); err != nil {
+			return err
+		}
+		var err error
+		if premaster, err = s.ecdhe(s.peerECDH); err != nil {
+			return err
+		}
+		cke = appendVec8(nil, s.ecdhKey.PublicKey().Bytes())
+	}
+	s.addHandshake(typeClientKeyExchange, cke)
+	if err := s.deriveKeys(premaster); err != nil {
+		return err
+	}
+
+	if s.certRequest && s.cfg.PrivateKey != nil {
+		sig, err := s.sign(s.transcript)
+		if err != nil {
+			return err
+		}
+		s.addHandshake(typeCertificateVerify, sig)
+	}
+
+	s.addFinished()
+	s.state = stateClientWaitFinished
+	return s.sendFlight()
+}
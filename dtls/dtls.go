@@ -0,0 +1,244 @@
+// Package dtls implements a DTLS 1.2 (RFC 6347) transport for CoAP
+// over UDP ("coaps").
+//
+// Only the cipher suites RFC 7252 section 9 makes mandatory are
+// supported: TLS_PSK_WITH_AES_128_CCM_8 for pre-shared keys and
+// TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8 with raw P-256 public keys
+// (RFC 7250).  X.509 certificates, session resumption and
+// renegotiation are not supported.  Fragmented handshake messages are
+// reassembled, but the small messages of these suites are never
+// fragmented when sent.
+package dtls
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// CipherSuite identifies a DTLS cipher suite.
+type CipherSuite uint16
+
+// Supported cipher suites.
+const (
+	TLS_PSK_WITH_AES_128_CCM_8         CipherSuite = 0xc0a8
+	TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8 CipherSuite = 0xc0ae
+)
+
+func (c CipherSuite) String() string {
+	switch c {
+	case TLS_PSK_WITH_AES_128_CCM_8:
+		return "TLS_PSK_WITH_AES_128_CCM_8"
+	case TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8:
+		return "TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8"
+	}
+	return fmt.Sprintf("Unknown (0x%04x)", uint16(c))
+}
+
+const (
+	// DefaultHandshakeTimeout is the time allowed for a handshake
+	// to complete when Config.HandshakeTimeout is zero.
+	DefaultHandshakeTimeout = 30 * time.Second
+
+	// Handshake flight retransmission timer bounds (RFC 6347
+	// section 4.2.4.1).
+	initialRetransmit = time.Second
+	maxRetransmit     = 60 * time.Second
+
+	maxDatagramLen = 1500
+)
+
+// Config configures a DTLS client or server.  A Config must not be
+// modified after it has been passed to Dial or Listen.
+type Config struct {
+	// PSK returns the pre-shared key for a PSK identity.  Servers
+	// call it with the identity presented by the client; clients
+	// call it with PSKIdentity.  Setting PSK enables
+	// TLS_PSK_WITH_AES_128_CCM_8.
+	PSK func(identity []byte) ([]byte, error)
+	// PSKIdentity is the identity a client presents.
+	PSKIdentity []byte
+	// PSKIdentityHint is sent by servers to help clients choose an
+	// identity.
+	PSKIdentityHint []byte
+
+	// PrivateKey is the P-256 key used for raw public key
+	// authentication.  Setting it on a server enables
+	// TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8; setting it on a client
+	// allows it to authenticate when the server asks for a key.
+	PrivateKey *ecdsa.PrivateKey
+	// VerifyPeerPublicKey validates the raw public key presented
+	// by the peer.  Clients using
+	// TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8 must set it.  Servers
+	// without it accept any key; the key is still available to
+	// handlers through Addr.
+	VerifyPeerPublicKey func(pub *ecdsa.PublicKey) error
+	// RequireClientKey makes servers request and require a raw
+	// public key from clients negotiating
+	// TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8.
+	RequireClientKey bool
+
+	// CipherSuites restricts the cipher suites offered or accepted.
+	// If nil, every suite the configuration has credentials for is
+	// used.
+	CipherSuites []CipherSuite
+
+	// HandshakeTimeout bounds the duration of a handshake.  If
+	// zero, DefaultHandshakeTimeout is used.
+	HandshakeTimeout time.Duration
+
+	// Rand provides entropy.  If nil, crypto/rand.Reader is used.
+	Rand io.Reader
+}
+
+// suites returns the cipher suites usable with this configuration,
+// in order of preference.
+func (c *Config) suites(isClient bool) []CipherSuite {
+	var rv []CipherSuite
+	allowed := func(s CipherSuite) bool {
+		if c.CipherSuites == nil {
+			return true
+		}
+		for _, a := range c.CipherSuites {
+			if a == s {
+				return true
+			}
+		}
+		return false
+	}
+	if c.PSK != nil && (!isClient || c.PSKIdentity != nil) &&
+		allowed(TLS_PSK_WITH_AES_128_CCM_8) {
+		rv = append(rv, TLS_PSK_WITH_AES_128_CCM_8)
+	}
+	ecdhe := c.PrivateKey != nil
+	if isClient {
+		ecdhe = c.VerifyPeerPublicKey != nil
+	}
+	if ecdhe && allowed(TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8) {
+		rv = append(rv, TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8)
+	}
+	return rv
+}
+
+func (c *Config) handshakeTimeout() time.Duration {
+	if c.HandshakeTimeout > 0 {
+		return c.HandshakeTimeout
+	}
+	return DefaultHandshakeTimeout
+}
+
+// Addr is the address of an authenticated DTLS peer.  Listeners
+// report it as the source of every datagram, so handlers can
+// authorize requests by the credentials the peer used.
+type Addr struct {
+	// Addr is the peer's transport address.
+	net.Addr
+	// Identity is the PSK identity the peer authenticated with, if
+	// any.
+	Identity []byte
+	// PublicKey is the raw public key the peer authenticated with,
+	// if any.
+	PublicKey *ecdsa.PublicKey
+}
+
+// Network returns "dtls".
+func (a *Addr) Network() string { return "dtls" }
+
+// PeerIdentity returns the PSK identity of the peer at addr, or nil
+// if addr is not an authenticated DTLS address.
+func PeerIdentity(addr net.Addr) []byte {
+	if a, ok := addr.(*Addr); ok {
+		return a.Identity
+	}
+	return nil
+}
+
+// PeerPublicKey returns the raw public key of the peer at addr, or nil
+// if addr is not an authenticated DTLS address.
+func PeerPublicKey(addr net.Addr) *ecdsa.PublicKey {
+	if a, ok := addr.(*Addr); ok {
+		return a.PublicKey
+	}
+	return nil
+}
+
+// transportAddr unwraps a DTLS address.
+func transportAddr(addr net.Addr) net.Addr {
+	if a, ok := addr.(*Addr); ok {
+		return a.Addr
+	}
+	return addr
+}
+
+// Errors.
+var (
+	ErrHandshakeTimeout = errors.New("dtls: handshake timed out")
+	ErrNoSession        = errors.New("dtls: no session with peer")
+	ErrNoCipherSuite    = errors.New("dtls: no usable cipher suite")
+)
+
+type alertLevel uint8
+
+const (
+	alertWarning alertLevel = 1
+	alertFatal   alertLevel = 2
+)
+
+type alertDesc uint8
+
+const (
+	alertCloseNotify            alertDesc = 0
+	alertUnexpectedMessage      alertDesc = 10
+	alertBadRecordMAC           alertDesc = 20
+	alertHandshakeFailure       alertDesc = 40
+	alertBadCertificate         alertDesc = 42
+	alertUnsupportedCertificate alertDesc = 43
+	alertIllegalParameter       alertDesc = 47
+	alertDecodeError            alertDesc = 50
+	alertDecryptError           alertDesc = 51
+	alertProtocolVersion        alertDesc = 70
+	alertInternalError          alertDesc = 80
+	alertUnknownPSKIdentity     alertDesc = 115
+)
+
+var alertNames = map[alertDesc]string{
+	alertCloseNotify:            "close notify",
+	alertUnexpectedMessage:      "unexpected message",
+	alertBadRecordMAC:           "bad record MAC",
+	alertHandshakeFailure:       "handshake failure",
+	alertBadCertificate:         "bad certificate",
+	alertUnsupportedCertificate: "unsupported certificate",
+	alertIllegalParameter:       "illegal parameter",
+	alertDecodeError:            "decode error",
+	alertDecryptError:           "decrypt error",
+	alertProtocolVersion:        "protocol version",
+	alertInternalError:          "internal error",
+	alertUnknownPSKIdentity:     "unknown PSK identity",
+}
+
+func (d alertDesc) String() string {
+	if s, ok := alertNames[d]; ok {
+		return s
+	}
+	return fmt.Sprintf("alert(%d)", uint8(d))
+}
+
+// AlertError reports a DTLS alert sent or received during a
+// handshake or on an established session.
+type AlertError struct {
+	// Remote is true if the peer sent the alert.
+	Remote bool
+	desc   alertDesc
+}
+
+func (e *AlertError) Error() string {
+	if e.Remote {
+		return "dtls: remote error: " + e.desc.String()
+	}
+	return "dtls: local error: " + e.desc.String()
+}
+
+func localAlert(d alertDesc) error { return &AlertError{desc: d} }
@@ -0,0 +1,298 @@
+package dtls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPSK = func(identity []byte) ([]byte, error) {
+	if !bytes.Equal(identity, []byte("client1")) {
+		return nil, errors.New("unknown identity")
+	}
+	return []byte("secret key"), nil
+}
+
+func generateKey(t *testing.T) *ecdsa.PrivateKey {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func trustKey(k *ecdsa.PrivateKey) func(*ecdsa.PublicKey) error {
+	return func(pub *ecdsa.PublicKey) error {
+		if !pub.Equal(&k.PublicKey) {
+			return errors.New("untrusted key")
+		}
+		return nil
+	}
+}
+
+func listen(t *testing.T, cfg *Config) *Listener {
+	l, err := Listen("udp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	return l
+}
+
+// echo answers every datagram the listener reads with its payload,
+// prefixed by the peer's PSK identity.
+func echo(l *Listener) {
+	buf := make([]byte, maxDatagramLen)
+	for {
+		n, addr, err := l.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		reply := append(PeerIdentity(addr), buf[:n]...)
+		l.WriteTo(reply, addr)
+	}
+}
+
+func roundTrip(t *testing.T, c *Conn, msg string) string {
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxDatagramLen)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestHandshakePSK(t *testing.T) {
+	l := listen(t, &Config{PSK: testPSK, PSKIdentityHint: []byte("hint")})
+	defer l.Close()
+	go echo(l)
+
+	c, err := Dial("udp", l.LocalAddr().String(), &Config{
+		PSK:         testPSK,
+		PSKIdentity: []byte("client1"),
+	})
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	if c.CipherSuite() != TLS_PSK_WITH_AES_128_CCM_8 {
+		t.Errorf("Expected %v, got %v", TLS_PSK_WITH_AES_128_CCM_8, c.CipherSuite())
+	}
+	if got := roundTrip(t, c, "hello"); got != "client1hello" {
+		t.Errorf("Expected client1hello, got %q", got)
+	}
+}
+
+func TestHandshakeRawPublicKey(t *testing.T) {
+	serverKey, clientKey := generateKey(t), generateKey(t)
+
+	l := listen(t, &Config{
+		PrivateKey:          serverKey,
+		VerifyPeerPublicKey: trustKey(clientKey),
+		RequireClientKey:    true,
+	})
+	defer l.Close()
+
+	got := make(chan *ecdsa.PublicKey, 1)
+	go func() {
+		buf := make([]byte, maxDatagramLen)
+		n, addr, err := l.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		got <- PeerPublicKey(addr)
+		l.WriteTo(buf[:n], addr)
+	}()
+
+	c, err := Dial("udp", l.LocalAddr().String(), &Config{
+		PrivateKey:          clientKey,
+		VerifyPeerPublicKey: trustKey(serverKey),
+	})
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	if c.CipherSuite() != TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8 {
+		t.Errorf("Expected %v, got %v", TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8, c.CipherSuite())
+	}
+	if !c.PeerPublicKey().Equal(&serverKey.PublicKey) {
+		t.Errorf("Expected server key to be exposed")
+	}
+	if reply := roundTrip(t, c, "ping"); reply != "ping" {
+		t.Errorf("Expected ping, got %q", reply)
+	}
+	if pub := <-got; pub == nil || !pub.Equal(&clientKey.PublicKey) {
+		t.Errorf("Expected client key to be exposed to the server")
+	}
+}
+
+func TestHandshakeFailures(t *testing.T) {
+	serverKey := generateKey(t)
+	l := listen(t, &Config{PSK: testPSK, PrivateKey: serverKey})
+	defer l.Close()
+
+	tests := []struct {
+		name  string
+		cfg   *Config
+		alert bool
+	}{
+		{"unknown identity", &Config{PSK: testPSK, PSKIdentity: []byte("mallory")}, true},
+		{"untrusted server", &Config{VerifyPeerPublicKey: trustKey(generateKey(t))}, true},
+		// The server cannot authenticate the client's Finished and
+		// silently discards it.
+		{"wrong key", &Config{
+			PSK:         func([]byte) ([]byte, error) { return []byte("wrong"), nil },
+			PSKIdentity: []byte("client1"),
+		}, false},
+	}
+
+	for _, test := range tests {
+		test.cfg.HandshakeTimeout = 1500 * time.Millisecond
+		c, err := Dial("udp", l.LocalAddr().String(), test.cfg)
+		if err == nil {
+			c.Close()
+			t.Errorf("%v: expected handshake to fail", test.name)
+			continue
+		}
+		var ae *AlertError
+		if test.alert && !errors.As(err, &ae) {
+			t.Errorf("%v: expected alert, got %v", test.name, err)
+		}
+		if !test.alert && err != ErrHandshakeTimeout {
+			t.Errorf("%v: expected %v, got %v", test.name, ErrHandshakeTimeout, err)
+		}
+	}
+}
+
+func TestNoCipherSuite(t *testing.T) {
+	if _, err := Listen("udp", "127.0.0.1:0", &Config{}); err != ErrNoCipherSuite {
+		t.Errorf("Expected %v, got %v", ErrNoCipherSuite, err)
+	}
+}
+
+// lossyConn drops the first datagram the server sends after the
+// HelloVerifyRequest.
+type lossyConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	sent int
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.sent++
+	drop := c.sent == 2
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestHandshakeRetransmission(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewListener(&lossyConn{PacketConn: pc}, &Config{PSK: testPSK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go echo(l)
+
+	c, err := Dial("udp", l.LocalAddr().String(), &Config{
+		PSK:         testPSK,
+		PSKIdentity: []byte("client1"),
+	})
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+	if got := roundTrip(t, c, "again"); got != "client1again" {
+		t.Errorf("Expected client1again, got %q", got)
+	}
+}
+
+func TestCloseNotify(t *testing.T) {
+	l := listen(t, &Config{PSK: testPSK})
+	c, err := Dial("udp", l.LocalAddr().String(), &Config{
+		PSK:         testPSK,
+		PSKIdentity: []byte("client1"),
+	})
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	defer c.Close()
+
+	l.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 16)); err == nil || err.Error() != "EOF" {
+		t.Errorf("Expected EOF after close_notify, got %v", err)
+	}
+}
+
+func TestPRF(t *testing.T) {
+	secret := []byte{0x9b, 0xbe, 0x43, 0x6b, 0xa9, 0x40, 0xf0, 0x17,
+		0xb1, 0x76, 0x52, 0x84, 0x9a, 0x71, 0xdb, 0x35}
+	seed := []byte{0xa0, 0xba, 0x9f, 0x93, 0x6c, 0xda, 0x31, 0x18,
+		0x27, 0xa6, 0xf7, 0x96, 0xff, 0xd5, 0x19, 0x8c}
+	exp := []byte{0xe3, 0xf2, 0x29, 0xba, 0x72, 0x7b, 0xe1, 0x7b,
+		0x8d, 0x12, 0x26, 0x20, 0x55, 0x7c, 0xd4, 0x53}
+
+	if got := prf(secret, "test label", seed, 100); !bytes.Equal(got[:16], exp) {
+		t.Errorf("Expected %x..., got %x", exp, got)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, seq := range []uint64{5, 3, 7, 100} {
+		if !w.check(seq) {
+			t.Errorf("Expected %v to be new", seq)
+		}
+		w.update(seq)
+	}
+	for _, seq := range []uint64{5, 3, 7, 100, 36} {
+		if w.check(seq) {
+			t.Errorf("Expected %v to be rejected", seq)
+		}
+	}
+	if !w.check(99) {
+		t.Errorf("Expected 99 to be new")
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	s := newSession(&Config{}, true, nil, nil)
+	body := []byte("fragmented handshake message")
+	frag := func(off, n int) fragment {
+		return fragment{
+			handshake: handshake{typ: typeCertificate, body: body[off : off+n]},
+			length:    len(body),
+			offset:    off,
+		}
+	}
+
+	if _, ok, _ := s.reassemble(frag(10, 18)); ok {
+		t.Fatalf("Expected incomplete message")
+	}
+	if _, ok, _ := s.reassemble(frag(5, 10)); ok {
+		t.Fatalf("Expected incomplete message")
+	}
+	m, ok, _ := s.reassemble(frag(0, 5))
+	if !ok || !bytes.Equal(m.body, body) {
+		t.Fatalf("Expected %q, got %q", body, m.body)
+	}
+}
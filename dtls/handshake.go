@@ -0,0 +1,492 @@
+package dtls
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+type handshakeType uint8
+
+const (
+	typeClientHello        handshakeType = 1
+	typeServerHello        handshakeType = 2
+	typeHelloVerifyRequest handshakeType = 3
+	typeCertificate        handshakeType = 11
+	typeServerKeyExchange  handshakeType = 12
+	typeCertificateRequest handshakeType = 13
+	typeServerHelloDone    handshakeType = 14
+	typeCertificateVerify  handshakeType = 15
+	typeClientKeyExchange  handshakeType = 16
+	typeFinished           handshakeType = 20
+)
+
+const handshakeHeaderLen = 12
+
+// TLS extension and parameter code points.
+const (
+	extSupportedGroups       = 10
+	extECPointFormats        = 11
+	extSignatureAlgorithms   = 13
+	extClientCertificateType = 19
+	extServerCertificateType = 20
+	extRenegotiationInfo     = 0xff01
+
+	curveSECP256R1       = 23
+	curveTypeNamed       = 3
+	pointUncompressed    = 0
+	sigECDSAWithSHA256   = 0x0403
+	certTypeRawPublicKey = 2
+	certTypeECDSASign    = 64
+
+	// TLS_EMPTY_RENEGOTIATION_INFO_SCSV (RFC 5746 section 3.3)
+	scsvRenegotiation CipherSuite = 0x00ff
+)
+
+var errDecode = errors.New("dtls: malformed handshake message")
+
+/*
+	struct {
+	  HandshakeType msg_type;
+	  uint24 length;
+	  uint16 message_seq;
+	  uint24 fragment_offset;
+	  uint24 fragment_length;
+	  body;
+	} Handshake;
+*/
+type handshake struct {
+	typ  handshakeType
+	seq  uint16
+	body []byte
+}
+
+// marshal encodes the message unfragmented.  This is also the form
+// in which messages enter the handshake transcript.
+func (h *handshake) marshal() []byte {
+	b := make([]byte, handshakeHeaderLen, handshakeHeaderLen+len(h.body))
+	b[0] = byte(h.typ)
+	putUint24(b[1:], len(h.body))
+	binary.BigEndian.PutUint16(b[4:], h.seq)
+	putUint24(b[9:], len(h.body))
+	return append(b, h.body...)
+}
+
+// fragment is a possibly partial handshake message: body holds
+// the bytes of the message starting at offset.
+type fragment struct {
+	handshake
+	length int
+	offset int
+}
+
+func (f *fragment) complete() bool {
+	return f.offset == 0 && len(f.body) == f.length
+}
+
+// parseHandshakes splits a handshake record into its message
+// fragments.
+func parseHandshakes(b []byte) ([]fragment, error) {
+	var rv []fragment
+	for len(b) > 0 {
+		if len(b) < handshakeHeaderLen {
+			return rv, errDecode
+		}
+		length := uint24(b[1:])
+		offset := uint24(b[6:])
+		fragLen := uint24(b[9:])
+		if len(b) < handshakeHeaderLen+fragLen || offset+fragLen > length {
+			return rv, errDecode
+		}
+		rv = append(rv, fragment{
+			handshake: handshake{
+				typ:  handshakeType(b[0]),
+				seq:  binary.BigEndian.Uint16(b[4:]),
+				body: b[handshakeHeaderLen : handshakeHeaderLen+fragLen],
+			},
+			length: length,
+			offset: offset,
+		})
+		b = b[handshakeHeaderLen+fragLen:]
+	}
+	return rv, nil
+}
+
+func uint24(b []byte) int {
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
+
+// reader decodes the big endian, length prefixed fields of
+// handshake messages.  Any decoding failure sets err, after which
+// all reads return zero values.
+type reader struct {
+	b   []byte
+	err bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err || len(r.b) < n {
+		r.err = true
+		return nil
+	}
+	rv := r.b[:n]
+	r.b = r.b[n:]
+	return rv
+}
+
+func (r *reader) u8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *reader) u16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
+
+func (r *reader) u24() int {
+	b := r.bytes(3)
+	if b == nil {
+		return 0
+	}
+	return uint24(b)
+}
+
+func (r *reader) vec8() []byte  { return r.bytes(r.u8()) }
+func (r *reader) vec16() []byte { return r.bytes(r.u16()) }
+func (r *reader) vec24() []byte { return r.bytes(r.u24()) }
+
+// done reports whether the whole input was consumed without error.
+func (r *reader) done() bool { return !r.err && len(r.b) == 0 }
+
+func appendU16(b []byte, v int) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendVec8(b, v []byte) []byte {
+	return append(append(b, byte(len(v))), v...)
+}
+
+func appendVec16(b, v []byte) []byte {
+	return append(appendU16(b, len(v)), v...)
+}
+
+func appendVec24(b, v []byte) []byte {
+	return append(append(b, byte(len(v)>>16), byte(len(v)>>8), byte(len(v))), v...)
+}
+
+// extensions holds the hello extensions this implementation
+// understands.  Others are ignored.
+type extensions struct {
+	groups          []int
+	pointFormats    []byte
+	sigAlgs         []int
+	clientCertTypes []byte
+	serverCertTypes []byte
+	renegotiation   bool
+}
+
+func (e *extensions) marshal(isServer bool) []byte {
+	var b []byte
+	add := func(typ int, data []byte) {
+		b = appendU16(b, typ)
+		b = appendVec16(b, data)
+	}
+	u16s := func(vs []int) []byte {
+		var rv []byte
+		for _, v := range vs {
+			rv = appendU16(rv, v)
+		}
+		return appendVec16(nil, rv)
+	}
+	certTypes := func(ts []byte) []byte {
+		if isServer {
+			return ts[:1]
+		}
+		return appendVec8(nil, ts)
+	}
+
+	if e.renegotiation {
+		add(extRenegotiationInfo, []byte{0})
+	}
+	if len(e.groups) > 0 {
+		add(extSupportedGroups, u16s(e.groups))
+	}
+	if len(e.pointFormats) > 0 {
+		add(extECPointFormats, appendVec8(nil, e.pointFormats))
+	}
+	if len(e.sigAlgs) > 0 {
+		add(extSignatureAlgorithms, u16s(e.sigAlgs))
+	}
+	if len(e.clientCertTypes) > 0 {
+		add(extClientCertificateType, certTypes(e.clientCertTypes))
+	}
+	if len(e.serverCertTypes) > 0 {
+		add(extServerCertificateType, certTypes(e.serverCertTypes))
+	}
+	return b
+}
+
+func parseExtensions(b []byte, isServer bool) (extensions, bool) {
+	var e extensions
+	r := reader{b: b}
+	u16s := func(data []byte) []int {
+		rr := reader{b: data}
+		list := reader{b: rr.vec16()}
+		var rv []int
+		for len(list.b) > 0 && !list.err {
+			rv = append(rv, list.u16())
+		}
+		if list.err || !rr.done() {
+			r.err = true
+		}
+		return rv
+	}
+	certTypes := func(data []byte) []byte {
+		if isServer {
+			if len(data) != 1 {
+				r.err = true
+			}
+			return data
+		}
+		rr := reader{b: data}
+		rv := rr.vec8()
+		if !rr.done() {
+			r.err = true
+		}
+		return rv
+	}
+
+	for len(r.b) > 0 && !r.err {
+		typ := r.u16()
+		data := r.vec16()
+		if r.err {
+			break
+		}
+		switch typ {
+		case extRenegotiationInfo:
+			e.renegotiation = true
+		case extSupportedGroups:
+			e.groups = u16s(data)
+		case extECPointFormats:
+			rr := reader{b: data}
+			e.pointFormats = rr.vec8()
+			r.err = r.err || !rr.done()
+		case extSignatureAlgorithms:
+			e.sigAlgs = u16s(data)
+		case extClientCertificateType:
+			e.clientCertTypes = certTypes(data)
+		case extServerCertificateType:
+			e.serverCertTypes = certTypes(data)
+		}
+	}
+	return e, !r.err
+}
+
+/*
+	struct {
+	  ProtocolVersion client_version;
+	  Random random;
+	  SessionID session_id;
+	  opaque cookie<0..2^8-1>;
+	  CipherSuite cipher_suites<2..2^16-1>;
+	  CompressionMethod compression_methods<1..2^8-1>;
+	  select (extensions_present) { ... };
+	} ClientHello;
+*/
+type clientHello struct {
+	version   int
+	random    []byte
+	sessionID []byte
+	cookie    []byte
+	suites    []CipherSuite
+	ext       extensions
+}
+
+func (m *clientHello) marshal() []byte {
+	b := appendU16(nil, versionDTLS12)
+	b = append(b, m.random...)
+	b = appendVec8(b, m.sessionID)
+	b = appendVec8(b, m.cookie)
+	var suites []byte
+	for _, s := range m.suites {
+		suites = appendU16(suites, int(s))
+	}
+	b = appendVec16(b, suites)
+	b = appendVec8(b, []byte{0})
+	return appendVec16(b, m.ext.marshal(false))
+}
+
+func parseClientHello(b []byte) (*clientHello, bool) {
+	r := reader{b: b}
+	m := &clientHello{
+		version:   r.u16(),
+		random:    r.bytes(32),
+		sessionID: r.vec8(),
+		cookie:    r.vec8(),
+	}
+	suites := reader{b: r.vec16()}
+	for len(suites.b) > 0 && !suites.err {
+		m.suites = append(m.suites, CipherSuite(suites.u16()))
+	}
+	compression := r.vec8()
+	if len(r.b) > 0 {
+		var ok bool
+		if m.ext, ok = parseExtensions(r.vec16(), false); !ok {
+			return nil, false
+		}
+	}
+	nullCompression := false
+	for _, c := range compression {
+		nullCompression = nullCompression || c == 0
+	}
+	return m, r.done() && !suites.err && nullCompression
+}
+
+/*
+	struct {
+	  ProtocolVersion server_version;
+	  opaque cookie<0..2^8-1>;
+	} HelloVerifyRequest;
+*/
+func marshalHelloVerifyRequest(cookie []byte) []byte {
+	return appendVec8(appendU16(nil, versionDTLS10), cookie)
+}
+
+func parseHelloVerifyRequest(b []byte) ([]byte, bool) {
+	r := reader{b: b}
+	r.u16()
+	cookie := r.vec8()
+	return cookie, r.done()
+}
+
+type serverHello struct {
+	version   int
+	random    []byte
+	sessionID []byte
+	suite     CipherSuite
+	ext       extensions
+}
+
+func (m *serverHello) marshal() []byte {
+	b := appendU16(nil, versionDTLS12)
+	b = append(b, m.random...)
+	b = appendVec8(b, m.sessionID)
+	b = appendU16(b, int(m.suite))
+	b = append(b, 0)
+	if ext := m.ext.marshal(true); len(ext) > 0 {
+		b = appendVec16(b, ext)
+	}
+	return b
+}
+
+func parseServerHello(b []byte) (*serverHello, bool) {
+	r := reader{b: b}
+	m := &serverHello{
+		version:   r.u16(),
+		random:    r.bytes(32),
+		sessionID: r.vec8(),
+		suite:     CipherSuite(r.u16()),
+	}
+	if r.u8() != 0 {
+		return nil, false
+	}
+	if len(r.b) > 0 {
+		var ok bool
+		if m.ext, ok = parseExtensions(r.vec16(), true); !ok {
+			return nil, false
+		}
+	}
+	return m, r.done()
+}
+
+/*
+	struct {
+	  ECParameters curve_params;
+	  ECPoint public;
+	} ServerECDHParams;
+
+	struct {
+	  ServerECDHParams params;
+	  digitally-signed struct { ... } signed_params;
+	} ServerKeyExchange;
+*/
+func marshalECDHParams(pub []byte) []byte {
+	b := []byte{curveTypeNamed}
+	b = appendU16(b, curveSECP256R1)
+	return appendVec8(b, pub)
+}
+
+// parseServerKeyExchangeECDHE returns the signed parameters, the
+// server's ephemeral public key and the signature.
+func parseServerKeyExchangeECDHE(b []byte) (params, pub, sig []byte, ok bool) {
+	r := reader{b: b}
+	if r.u8() != curveTypeNamed || r.u16() != curveSECP256R1 {
+		return nil, nil, nil, false
+	}
+	pub = r.vec8()
+	if r.err {
+		return nil, nil, nil, false
+	}
+	params = b[:len(b)-len(r.b)]
+	if r.u16() != sigECDSAWithSHA256 {
+		return nil, nil, nil, false
+	}
+	sig = r.vec16()
+	return params, pub, sig, r.done()
+}
+
+func marshalSignature(sig []byte) []byte {
+	return appendVec16(appendU16(nil, sigECDSAWithSHA256), sig)
+}
+
+func parseSignature(b []byte) ([]byte, bool) {
+	r := reader{b: b}
+	if r.u16() != sigECDSAWithSHA256 {
+		return nil, false
+	}
+	sig := r.vec16()
+	return sig, r.done()
+}
+
+/*
+	struct {
+	  ClientCertificateType certificate_types<1..2^8-1>;
+	  SignatureAndHashAlgorithm
+	    supported_signature_algorithms<2..2^16-2>;
+	  DistinguishedName certificate_authorities<0..2^16-1>;
+	} CertificateRequest;
+*/
+func marshalCertificateRequest() []byte {
+	b := appendVec8(nil, []byte{certTypeECDSASign})
+	b = appendVec16(b, appendU16(nil, sigECDSAWithSHA256))
+	return appendVec16(b, nil)
+}
+
+func parseCertificateRequest(b []byte) bool {
+	r := reader{b: b}
+	types := r.vec8()
+	algs := r.vec16()
+	r.vec16()
+	if !r.done() {
+		return false
+	}
+	hasType := false
+	for _, t := range types {
+		hasType = hasType || t == certTypeECDSASign
+	}
+	hasAlg := false
+	for i := 0; i+1 < len(algs); i += 2 {
+		hasAlg = hasAlg || int(binary.BigEndian.Uint16(algs[i:])) == sigECDSAWithSHA256
+	}
+	return hasType && hasAlg
+}
@@ -0,0 +1,89 @@
+package dtls
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/zltl/go-coap/internal/ccm"
+)
+
+const (
+	masterSecretLen = 48
+	verifyDataLen   = 12
+
+	// AES_128_CCM_8 key material sizes (RFC 6655).
+	keyLen      = 16
+	fixedIVLen  = 4
+	explicitLen = 8
+	tagLen      = 8
+)
+
+// prf is the TLS 1.2 pseudorandom function with SHA-256 (RFC 5246
+// section 5).
+func prf(secret []byte, label string, seed []byte, n int) []byte {
+	labelSeed := append([]byte(label), seed...)
+	h := hmac.New(sha256.New, secret)
+
+	rv := make([]byte, 0, n+sha256.Size)
+	h.Write(labelSeed)
+	a := h.Sum(nil)
+	for len(rv) < n {
+		h.Reset()
+		h.Write(a)
+		h.Write(labelSeed)
+		rv = h.Sum(rv)
+
+		h.Reset()
+		h.Write(a)
+		a = h.Sum(nil)
+	}
+	return rv[:n]
+}
+
+func masterSecret(premaster, clientRandom, serverRandom []byte) []byte {
+	seed := append(append([]byte{}, clientRandom...), serverRandom...)
+	return prf(premaster, "master secret", seed, masterSecretLen)
+}
+
+// keys derives the client and server write states from the master
+// secret.
+func keys(master, clientRandom, serverRandom []byte) (client, server *cipherState, err error) {
+	seed := append(append([]byte{}, serverRandom...), clientRandom...)
+	kb := prf(master, "key expansion", seed, 2*keyLen+2*fixedIVLen)
+
+	client, err = newCipherState(kb[:keyLen], kb[2*keyLen:2*keyLen+fixedIVLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err = newCipherState(kb[keyLen:2*keyLen], kb[2*keyLen+fixedIVLen:])
+	return client, server, err
+}
+
+func verifyData(master []byte, label string, transcript []byte) []byte {
+	h := sha256.Sum256(transcript)
+	return prf(master, label, h[:], verifyDataLen)
+}
+
+func newCipherState(key, iv []byte) (*cipherState, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := ccm.New(b, tagLen, fixedIVLen+explicitLen)
+	if err != nil {
+		return nil, err
+	}
+	return &cipherState{aead: aead, iv: append([]byte{}, iv...)}, nil
+}
+
+// pskPremaster builds the premaster secret for plain PSK key exchange
+// (RFC 4279 section 2).
+func pskPremaster(psk []byte) []byte {
+	n := len(psk)
+	rv := make([]byte, 0, 4+2*n)
+	rv = append(rv, byte(n>>8), byte(n))
+	rv = append(rv, make([]byte, n)...)
+	rv = append(rv, byte(n>>8), byte(n))
+	return append(rv, psk...)
+}
@@ -0,0 +1,168 @@
+package dtls
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+)
+
+type contentType uint8
+
+const (
+	typeChangeCipherSpec contentType = 20
+	typeAlert            contentType = 21
+	typeHandshake        contentType = 22
+	typeApplicationData  contentType = 23
+)
+
+const (
+	recordHeaderLen = 13
+	maxSeq          = 1<<48 - 1
+
+	versionDTLS10 = 0xfeff
+	versionDTLS12 = 0xfefd
+)
+
+var errBadRecord = errors.New("dtls: malformed record")
+
+/*
+	struct {
+	     ContentType type;
+	     ProtocolVersion version;
+	     uint16 epoch;
+	     uint48 sequence_number;
+	     uint16 length;
+	     opaque fragment[DTLSPlaintext.length];
+	} DTLSPlaintext;
+*/
+type record struct {
+	typ     contentType
+	version uint16
+	epoch   uint16
+	seq     uint64
+	data    []byte
+}
+
+func (r *record) header(length int) []byte {
+	h := make([]byte, recordHeaderLen)
+	h[0] = byte(r.typ)
+	binary.BigEndian.PutUint16(h[1:], r.version)
+	binary.BigEndian.PutUint64(h[3:], uint64(r.epoch)<<48|r.seq)
+	binary.BigEndian.PutUint16(h[11:], uint16(length))
+	return h
+}
+
+func (r *record) marshal() []byte {
+	return append(r.header(len(r.data)), r.data...)
+}
+
+// parseRecords splits a datagram into its records.
+func parseRecords(b []byte) ([]record, error) {
+	var rv []record
+	for len(b) > 0 {
+		if len(b) < recordHeaderLen {
+			return rv, errBadRecord
+		}
+		n := int(binary.BigEndian.Uint16(b[11:]))
+		if len(b) < recordHeaderLen+n {
+			return rv, errBadRecord
+		}
+		es := binary.BigEndian.Uint64(b[3:])
+		rv = append(rv, record{
+			typ:     contentType(b[0]),
+			version: binary.BigEndian.Uint16(b[1:]),
+			epoch:   uint16(es >> 48),
+			seq:     es & maxSeq,
+			data:    b[recordHeaderLen : recordHeaderLen+n],
+		})
+		b = b[recordHeaderLen+n:]
+	}
+	return rv, nil
+}
+
+// cipherState protects records in one direction of an epoch with
+// AES_128_CCM_8 (RFC 6655).
+type cipherState struct {
+	aead cipher.AEAD
+	iv   []byte
+}
+
+// additionalData builds the AEAD additional data for a record whose
+// plaintext is n bytes long (RFC 5246 section 6.2.3.3).
+func additionalData(r *record, n int) []byte {
+	ad := make([]byte, 13)
+	binary.BigEndian.PutUint64(ad, uint64(r.epoch)<<48|r.seq)
+	ad[8] = byte(r.typ)
+	binary.BigEndian.PutUint16(ad[9:], r.version)
+	binary.BigEndian.PutUint16(ad[11:], uint16(n))
+	return ad
+}
+
+// seal encrypts r.data in place.  The explicit nonce is the record's
+// epoch and sequence number.
+func (c *cipherState) seal(r *record) {
+	explicit := make([]byte, explicitLen)
+	binary.BigEndian.PutUint64(explicit, uint64(r.epoch)<<48|r.seq)
+	nonce := append(append([]byte{}, c.iv...), explicit...)
+
+	ad := additionalData(r, len(r.data))
+	r.data = c.aead.Seal(explicit, nonce, r.data, ad)
+}
+
+// open decrypts r.data in place.
+func (c *cipherState) open(r *record) error {
+	if len(r.data) < explicitLen+tagLen {
+		return errBadRecord
+	}
+	nonce := append(append([]byte{}, c.iv...), r.data[:explicitLen]...)
+	ct := r.data[explicitLen:]
+
+	ad := additionalData(r, len(ct)-tagLen)
+	pt, err := c.aead.Open(nil, nonce, ct, ad)
+	if err != nil {
+		return err
+	}
+	r.data = pt
+	return nil
+}
+
+// replayWindow detects duplicate records (RFC 6347 section 4.1.2.6).
+type replayWindow struct {
+	top  uint64
+	mask uint64
+	used bool
+}
+
+const replayWindowSize = 64
+
+// check reports whether seq is new.
+func (w *replayWindow) check(seq uint64) bool {
+	if !w.used || seq > w.top {
+		return true
+	}
+	d := w.top - seq
+	if d >= replayWindowSize {
+		return false
+	}
+	return w.mask&(1<<d) == 0
+}
+
+// update marks seq as received.
+func (w *replayWindow) update(seq uint64) {
+	if !w.used {
+		w.used, w.top, w.mask = true, seq, 1
+		return
+	}
+	if seq > w.top {
+		d := seq - w.top
+		if d >= replayWindowSize {
+			w.mask = 0
+		} else {
+			w.mask <<= d
+		}
+		w.mask |= 1
+		w.top = seq
+		return
+	}
+	w.mask |= 1 << (w.top - seq)
+}
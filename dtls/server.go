@@ -0,0 +1,464 @@
+package dtls
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// listenerQueueLen is the number of application datagrams a Listener
+// buffers before further datagrams are dropped.
+const listenerQueueLen = 64
+
+type datagram struct {
+	data []byte
+	addr *Addr
+}
+
+// Listener is a DTLS server.  It answers handshakes from any number
+// of clients on a single datagram socket, and exchanges application
+// data with them through ReadFrom and WriteTo, addressing each client
+// by its *Addr.
+type Listener struct {
+	pc     net.PacketConn
+	cfg    *Config
+	secret []byte
+
+	mu       sync.Mutex
+	sessions map[string]*session
+
+	in   chan datagram
+	done chan struct{}
+	err  error
+
+	dmu      sync.Mutex
+	deadline time.Time
+
+	closeOnce sync.Once
+}
+
+// Listen announces on the local network address and returns a DTLS
+// server.
+func Listen(network, laddr string, config *Config) (*Listener, error) {
+	if len(config.suites(false)) == 0 {
+		return nil, ErrNoCipherSuite
+	}
+	pc, err := net.ListenPacket(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	l, err := NewListener(pc, config)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// NewListener creates a DTLS server reading from pc.
+func NewListener(pc net.PacketConn, config *Config) (*Listener, error) {
+	if len(config.suites(false)) == 0 {
+		return nil, ErrNoCipherSuite
+	}
+	r := config.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(r, secret); err != nil {
+		return nil, err
+	}
+
+	l := &Listener{
+		pc:       pc,
+		cfg:      config,
+		secret:   secret,
+		sessions: make(map[string]*session),
+		in:       make(chan datagram, listenerQueueLen),
+		done:     make(chan struct{}),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+func (l *Listener) readLoop() {
+	defer close(l.done)
+	buf := make([]byte, maxDatagramLen)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				continue
+			}
+			l.err = err
+			return
+		}
+		l.handle(buf[:n], addr)
+	}
+}
+
+// handle processes one datagram from addr.
+func (l *Listener) handle(b []byte, addr net.Addr) {
+	key := addr.String()
+	l.mu.Lock()
+	s := l.sessions[key]
+	l.mu.Unlock()
+
+	if r, m, ch := peekClientHello(b); ch != nil {
+		if s == nil || !hmac.Equal(s.clientRandom, ch.random) {
+			l.handleClientHello(r, m, ch, addr)
+			return
+		}
+		// A retransmitted ClientHello; the session will repeat
+		// its flight.
+	}
+	if s == nil {
+		return
+	}
+
+	app, err := s.handleDatagram(b)
+	for _, d := range app {
+		select {
+		case l.in <- datagram{d, s.addr}:
+		default:
+		}
+	}
+	if err != nil {
+		var ae *AlertError
+		if errors.As(err, &ae) && !ae.Remote {
+			s.sendAlert(ae.desc)
+		}
+		l.remove(key, s)
+	}
+}
+
+// peekClientHello returns the ClientHello b starts with, if any.
+func peekClientHello(b []byte) (*record, *handshake, *clientHello) {
+	recs, _ := parseRecords(b)
+	if len(recs) == 0 || recs[0].typ != typeHandshake || recs[0].epoch != 0 {
+		return nil, nil, nil
+	}
+	msgs, _ := parseHandshakes(recs[0].data)
+	if len(msgs) == 0 || msgs[0].typ != typeClientHello || !msgs[0].complete() {
+		return nil, nil, nil
+	}
+	ch, ok := parseClientHello(msgs[0].body)
+	if !ok {
+		return nil, nil, nil
+	}
+	return &recs[0], &msgs[0].handshake, ch
+}
+
+// cookie computes the stateless cookie for a ClientHello from addr
+// (RFC 6347 section 4.2.1).
+func (l *Listener) cookie(addr net.Addr, ch *clientHello) []byte {
+	h := hmac.New(sha256.New, l.secret)
+	h.Write([]byte(addr.String()))
+	h.Write(ch.random)
+	h.Write(ch.sessionID)
+	for _, s := range ch.suites {
+		h.Write([]byte{byte(s >> 8), byte(s)})
+	}
+	return h.Sum(nil)
+}
+
+func (l *Listener) handleClientHello(r *record, m *handshake, ch *clientHello, addr net.Addr) {
+	cookie := l.cookie(addr, ch)
+	if !hmac.Equal(ch.cookie, cookie) {
+		hvr := handshake{
+			typ:  typeHelloVerifyRequest,
+			seq:  m.seq,
+			body: marshalHelloVerifyRequest(cookie),
+		}
+		rec := record{
+			typ:     typeHandshake,
+			version: versionDTLS10,
+			seq:     r.seq,
+			data:    hvr.marshal(),
+		}
+		l.pc.WriteTo(rec.marshal(), addr)
+		return
+	}
+
+	send := func(b []byte) error {
+		_, err := l.pc.WriteTo(b, addr)
+		return err
+	}
+	s := newSession(l.cfg, false, addr, send)
+	if err := s.startServer(ch, m); err != nil {
+		var ae *AlertError
+		if errors.As(err, &ae) {
+			s.sendAlert(ae.desc)
+		}
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, old := range l.sessions {
+		if !old.established() && now.Sub(old.started) > l.cfg.handshakeTimeout() {
+			delete(l.sessions, k)
+		}
+	}
+	l.sessions[addr.String()] = s
+}
+
+func (l *Listener) remove(key string, s *session) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sessions[key] == s {
+		delete(l.sessions, key)
+	}
+}
+
+// ReadFrom reads the payload of the next application data record from
+// any client.  addr is the client's *Addr.
+func (l *Listener) ReadFrom(b []byte) (int, net.Addr, error) {
+	l.dmu.Lock()
+	deadline := l.deadline
+	l.dmu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case d := <-l.in:
+		return copy(b, d.data), d.addr, nil
+	case <-l.done:
+		if l.err != nil {
+			return 0, nil, l.err
+		}
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo sends b as one application data record to the client at
+// addr.  It fails with ErrNoSession unless a handshake with the
+// client has completed.
+func (l *Listener) WriteTo(b []byte, addr net.Addr) (int, error) {
+	addr = transportAddr(addr)
+	l.mu.Lock()
+	s := l.sessions[addr.String()]
+	l.mu.Unlock()
+	if s == nil {
+		return 0, ErrNoSession
+	}
+
+	d, err := s.seal(b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := l.pc.WriteTo(d, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// LocalAddr returns the listener's network address.
+func (l *Listener) LocalAddr() net.Addr { return l.pc.LocalAddr() }
+
+// SetReadDeadline sets the deadline for ReadFrom calls.
+func (l *Listener) SetReadDeadline(t time.Time) error {
+	l.dmu.Lock()
+	defer l.dmu.Unlock()
+	l.deadline = t
+	return nil
+}
+
+// Close sends close_notify to every client and closes the socket.
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		for _, s := range l.sessions {
+			if s.established() {
+				s.sendAlert(alertCloseNotify)
+			}
+		}
+		l.mu.Unlock()
+		err = l.pc.Close()
+		<-l.done
+	})
+	return err
+}
+
+// startServer answers a verified ClientHello with the server's first
+// flight.
+func (s *session) startServer(ch *clientHello, m *handshake) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clientRandom = append([]byte{}, ch.random...)
+	s.recvSeq = m.seq + 1
+	s.sendSeq = m.seq
+	s.transcript = m.marshal()
+
+	// DTLS versions count down: 0xfefd is newer than 0xfeff.
+	if ch.version > versionDTLS12 {
+		return localAlert(alertProtocolVersion)
+	}
+
+	ecdheOK := containsByte(ch.ext.serverCertTypes, certTypeRawPublicKey) &&
+		(ch.ext.groups == nil || containsInt(ch.ext.groups, curveSECP256R1)) &&
+		(ch.ext.sigAlgs == nil || containsInt(ch.ext.sigAlgs, sigECDSAWithSHA256))
+	supported := s.cfg.suites(false)
+	for _, c := range ch.suites {
+		for _, ours := range supported {
+			if c == ours && s.suite == 0 &&
+				(c != TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8 || ecdheOK) {
+				s.suite = c
+			}
+		}
+	}
+	if s.suite == 0 {
+		return localAlert(alertHandshakeFailure)
+	}
+
+	var err error
+	if s.serverRandom, err = s.random(); err != nil {
+		return localAlert(alertInternalError)
+	}
+	sh := &serverHello{random: s.serverRandom, suite: s.suite}
+	sh.ext.renegotiation = ch.ext.renegotiation
+	for _, c := range ch.suites {
+		if c == scsvRenegotiation {
+			sh.ext.renegotiation = true
+		}
+	}
+
+	s.flight = nil
+	switch s.suite {
+	case TLS_PSK_WITH_AES_128_CCM_8:
+		s.addHandshake(typeServerHello, sh.marshal())
+		if len(s.cfg.PSKIdentityHint) > 0 {
+			s.addHandshake(typeServerKeyExchange, appendVec16(nil, s.cfg.PSKIdentityHint))
+		}
+		s.state = stateServerWaitKeyExchange
+
+	case TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8:
+		s.certRequest = s.cfg.RequireClientKey
+		if s.certRequest && !containsByte(ch.ext.clientCertTypes, certTypeRawPublicKey) {
+			return localAlert(alertUnsupportedCertificate)
+		}
+		if ch.ext.pointFormats != nil {
+			sh.ext.pointFormats = []byte{pointUncompressed}
+		}
+		sh.ext.serverCertTypes = []byte{certTypeRawPublicKey}
+		if s.certRequest {
+			sh.ext.clientCertTypes = []byte{certTypeRawPublicKey}
+		}
+		s.addHandshake(typeServerHello, sh.marshal())
+
+		cert, err := s.marshalPublicKey()
+		if err != nil {
+			return err
+		}
+		s.addHandshake(typeCertificate, cert)
+
+		if err := s.generateECDHKey(); err != nil {
+			return err
+		}
+		params := marshalECDHParams(s.ecdhKey.PublicKey().Bytes())
+		signed := append(append(append([]byte{}, s.clientRandom...), s.serverRandom...), params...)
+		sig, err := s.sign(signed)
+		if err != nil {
+			return err
+		}
+		s.addHandshake(typeServerKeyExchange, append(params, sig...))
+
+		s.state = stateServerWaitKeyExchange
+		if s.certRequest {
+			s.addHandshake(typeCertificateRequest, marshalCertificateRequest())
+			s.state = stateServerWaitCertificate
+		}
+	}
+	s.addHandshake(typeServerHelloDone, nil)
+	return s.sendFlight()
+}
+
+// serverHandshake advances the server handshake with message m from
+// the client.  transcript holds the messages preceding m.
+func (s *session) serverHandshake(m handshake, epoch uint16, transcript []byte) error {
+	switch {
+	case s.state == stateServerWaitCertificate && m.typ == typeCertificate:
+		pub, err := s.parsePublicKey(m.body)
+		if err != nil {
+			return err
+		}
+		s.peerKey = pub
+		s.state = stateServerWaitKeyExchange
+		return nil
+
+	case s.state == stateServerWaitKeyExchange && m.typ == typeClientKeyExchange:
+		r := reader{b: m.body}
+		var premaster []byte
+		switch s.suite {
+		case TLS_PSK_WITH_AES_128_CCM_8:
+			identity := r.vec16()
+			if !r.done() {
+				return localAlert(alertDecodeError)
+			}
+			psk, err := s.cfg.PSK(identity)
+			if err != nil || psk == nil {
+				return localAlert(alertUnknownPSKIdentity)
+			}
+			s.identity = append([]byte{}, identity...)
+			premaster = pskPremaster(psk)
+		case TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8:
+			pub := r.vec8()
+			if !r.done() {
+				return localAlert(alertDecodeError)
+			}
+			var err error
+			if premaster, err = s.ecdhe(pub); err != nil {
+				return err
+			}
+		}
+		if err := s.deriveKeys(premaster); err != nil {
+			return err
+		}
+		s.state = stateServerWaitFinished
+		if s.peerKey != nil {
+			s.state = stateServerWaitCertificateVerify
+		}
+		return nil
+
+	case s.state == stateServerWaitCertificateVerify && m.typ == typeCertificateVerify:
+		sig, ok := parseSignature(m.body)
+		if !ok {
+			return localAlert(alertDecodeError)
+		}
+		if !verify(s.peerKey, transcript, sig) {
+			return localAlert(alertDecryptError)
+		}
+		s.state = stateServerWaitFinished
+		return nil
+
+	case s.state == stateServerWaitFinished && m.typ == typeFinished:
+		if err := s.checkFinished(m, epoch, transcript); err != nil {
+			return err
+		}
+		s.flight = nil
+		s.addFinished()
+		s.establish()
+		return s.sendFlight()
+	}
+	return localAlert(alertUnexpectedMessage)
+}
@@ -0,0 +1,498 @@
+package dtls
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Handshake states.
+const (
+	stateStart = iota
+
+	stateClientWaitHello
+	stateClientWaitCertificate
+	stateClientWaitKeyExchange
+	stateClientWaitHelloDone
+	stateClientWaitFinished
+
+	stateServerWaitCertificate
+	stateServerWaitKeyExchange
+	stateServerWaitCertificateVerify
+	stateServerWaitFinished
+
+	stateEstablished
+)
+
+// maxQueued bounds the number of out of order handshake messages
+// buffered while waiting for earlier ones.
+const maxQueued = 8
+
+// maxHandshakeLen bounds the size of a reassembled handshake message.
+const maxHandshakeLen = 1 << 14
+
+type flightMsg struct {
+	typ   contentType
+	epoch uint16
+	data  []byte
+}
+
+type queuedHandshake struct {
+	handshake
+	epoch uint16
+}
+
+// partial is a handshake message being reassembled.
+type partial struct {
+	typ     handshakeType
+	body    []byte
+	have    []bool
+	missing int
+}
+
+// session is the state of one DTLS association.  It is driven by
+// datagrams passed to handleDatagram and sends its own datagrams
+// through send.
+type session struct {
+	cfg      *Config
+	isClient bool
+	peer     net.Addr
+	send     func([]byte) error
+	rand     io.Reader
+	started  time.Time
+
+	mu    sync.Mutex
+	state int
+
+	sendSeq    uint16
+	recvSeq    uint16
+	queued     map[uint16]queuedHandshake
+	partials   map[uint16]*partial
+	transcript []byte
+	flight     []flightMsg
+
+	offered      []CipherSuite
+	suite        CipherSuite
+	clientRandom []byte
+	serverRandom []byte
+	cookie       []byte
+	master       []byte
+	certRequest  bool
+	ecdhKey      *ecdh.PrivateKey
+	peerECDH     []byte
+	identity     []byte
+	peerKey      *ecdsa.PublicKey
+	addr         *Addr
+
+	writeEpoch  uint16
+	writeSeq    [2]uint64
+	write       [2]*cipherState
+	read        [2]*cipherState
+	pendingRead *cipherState
+	replay      replayWindow
+}
+
+func newSession(cfg *Config, isClient bool, peer net.Addr, send func([]byte) error) *session {
+	s := &session{
+		cfg:      cfg,
+		isClient: isClient,
+		peer:     peer,
+		send:     send,
+		rand:     cfg.Rand,
+		started:  time.Now(),
+		queued:   make(map[uint16]queuedHandshake),
+		partials: make(map[uint16]*partial),
+	}
+	if s.rand == nil {
+		s.rand = rand.Reader
+	}
+	return s
+}
+
+func (s *session) established() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == stateEstablished
+}
+
+func (s *session) random() ([]byte, error) {
+	r := make([]byte, 32)
+	_, err := io.ReadFull(s.rand, r)
+	return r, err
+}
+
+// addHandshake appends a handshake message to the current flight and
+// to the transcript.
+func (s *session) addHandshake(typ handshakeType, body []byte) {
+	h := handshake{typ: typ, seq: s.sendSeq, body: body}
+	s.sendSeq++
+	b := h.marshal()
+	if typ != typeHelloVerifyRequest {
+		s.transcript = append(s.transcript, b...)
+	}
+	s.flight = append(s.flight, flightMsg{typeHandshake, s.writeEpoch, b})
+}
+
+// addChangeCipherSpec appends a ChangeCipherSpec to the current flight
+// and switches writing to the next epoch.
+func (s *session) addChangeCipherSpec() {
+	s.flight = append(s.flight, flightMsg{typeChangeCipherSpec, s.writeEpoch, []byte{1}})
+	s.writeEpoch++
+}
+
+// sendFlight transmits the current flight.  Each transmission uses
+// fresh record sequence numbers.
+func (s *session) sendFlight() error {
+	var d []byte
+	for _, m := range s.flight {
+		r := s.newRecord(m.typ, m.epoch, m.data)
+		b := r.marshal()
+		if len(d) > 0 && len(d)+len(b) > maxDatagramLen {
+			if err := s.send(d); err != nil {
+				return err
+			}
+			d = nil
+		}
+		d = append(d, b...)
+	}
+	return s.send(d)
+}
+
+// newRecord builds a record, encrypting it if the epoch is protected.
+func (s *session) newRecord(typ contentType, epoch uint16, data []byte) *record {
+	r := &record{
+		typ:     typ,
+		version: versionDTLS12,
+		epoch:   epoch,
+		seq:     s.writeSeq[epoch],
+		data:    append([]byte{}, data...),
+	}
+	s.writeSeq[epoch]++
+	if epoch > 0 {
+		s.write[epoch].seal(r)
+	}
+	return r
+}
+
+// seal protects application data for transmission.
+func (s *session) seal(b []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != stateEstablished {
+		return nil, ErrNoSession
+	}
+	return s.newRecord(typeApplicationData, 1, b).marshal(), nil
+}
+
+// sendAlert sends a fatal alert, or close_notify.
+func (s *session) sendAlert(d alertDesc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	level := alertFatal
+	if d == alertCloseNotify {
+		level = alertWarning
+	}
+	s.send(s.newRecord(typeAlert, s.writeEpoch, []byte{byte(level), byte(d)}).marshal())
+}
+
+// handleDatagram processes an incoming datagram, returning any
+// application data it carried.  A returned *AlertError terminates
+// the session; if it is local, the caller should send it.
+func (s *session) handleDatagram(b []byte) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recs, _ := parseRecords(b)
+	var app [][]byte
+	retransmit := false
+	for _, r := range recs {
+		if r.epoch > 1 {
+			continue
+		}
+		if r.epoch == 1 {
+			if s.read[1] == nil || !s.replay.check(r.seq) {
+				continue
+			}
+			if err := s.read[1].open(&r); err != nil {
+				// Invalid records are silently discarded
+				// (RFC 6347 section 4.1.2.7).
+				continue
+			}
+			s.replay.update(r.seq)
+		}
+
+		switch r.typ {
+		case typeChangeCipherSpec:
+			if r.epoch == 0 && len(r.data) == 1 && r.data[0] == 1 &&
+				s.pendingRead != nil {
+				s.read[1], s.pendingRead = s.pendingRead, nil
+			}
+		case typeAlert:
+			if len(r.data) != 2 {
+				continue
+			}
+			d := alertDesc(r.data[1])
+			if alertLevel(r.data[0]) == alertFatal || d == alertCloseNotify {
+				return app, &AlertError{Remote: true, desc: d}
+			}
+		case typeHandshake:
+			msgs, err := parseHandshakes(r.data)
+			if err != nil {
+				return app, localAlert(alertDecodeError)
+			}
+			for _, f := range msgs {
+				m, ok, again := s.reassemble(f)
+				if !ok {
+					retransmit = retransmit || again
+					continue
+				}
+				again, err := s.receiveHandshake(m, r.epoch)
+				if err != nil {
+					return app, err
+				}
+				retransmit = retransmit || again
+			}
+		case typeApplicationData:
+			if r.epoch == 1 && s.state == stateEstablished {
+				app = append(app, r.data)
+			}
+		}
+	}
+
+	// The peer repeated messages we already processed, so our last
+	// flight was probably lost.  Clients retransmit on a timer
+	// instead.
+	if retransmit && !s.isClient && len(s.flight) > 0 {
+		s.sendFlight()
+	}
+	return app, nil
+}
+
+// reassemble collects handshake message fragments.  It returns the
+// message once complete, and reports whether f belongs to a message
+// already processed.
+func (s *session) reassemble(f fragment) (handshake, bool, bool) {
+	if f.seq < s.recvSeq {
+		return handshake{}, false, true
+	}
+	if f.complete() {
+		return f.handshake, true, false
+	}
+	if s.partials == nil || f.length > maxHandshakeLen || f.seq > s.recvSeq+maxQueued {
+		return handshake{}, false, false
+	}
+
+	p := s.partials[f.seq]
+	if p == nil {
+		p = &partial{
+			typ:     f.typ,
+			body:    make([]byte, f.length),
+			have:    make([]bool, f.length),
+			missing: f.length,
+		}
+		s.partials[f.seq] = p
+	}
+	if p.typ != f.typ || len(p.body) != f.length {
+		return handshake{}, false, false
+	}
+	copy(p.body[f.offset:], f.body)
+	for i := f.offset; i < f.offset+len(f.body); i++ {
+		if !p.have[i] {
+			p.have[i] = true
+			p.missing--
+		}
+	}
+	if p.missing > 0 {
+		return handshake{}, false, false
+	}
+	delete(s.partials, f.seq)
+	return handshake{typ: p.typ, seq: f.seq, body: p.body}, true, false
+}
+
+// receiveHandshake processes handshake messages in sequence order.
+// It reports whether m was a retransmission of a message already
+// processed.
+func (s *session) receiveHandshake(m handshake, epoch uint16) (bool, error) {
+	switch {
+	case m.seq < s.recvSeq:
+		return true, nil
+	case m.seq > s.recvSeq:
+		if s.queued != nil && len(s.queued) < maxQueued {
+			m.body = append([]byte{}, m.body...)
+			s.queued[m.seq] = queuedHandshake{m, epoch}
+		}
+		return false, nil
+	}
+
+	for {
+		before := len(s.transcript)
+		if m.typ != typeHelloVerifyRequest {
+			s.transcript = append(s.transcript, m.marshal()...)
+		}
+		s.recvSeq++
+
+		var err error
+		if s.isClient {
+			err = s.clientHandshake(m, epoch, s.transcript[:before])
+		} else {
+			err = s.serverHandshake(m, epoch, s.transcript[:before])
+		}
+		if err != nil {
+			return false, err
+		}
+
+		q, ok := s.queued[s.recvSeq]
+		if !ok {
+			return false, nil
+		}
+		delete(s.queued, s.recvSeq)
+		m, epoch = q.handshake, q.epoch
+	}
+}
+
+// deriveKeys computes the master secret and installs the epoch 1
+// write state.  The read state takes effect at the peer's
+// ChangeCipherSpec.
+func (s *session) deriveKeys(premaster []byte) error {
+	s.master = masterSecret(premaster, s.clientRandom, s.serverRandom)
+	client, server, err := keys(s.master, s.clientRandom, s.serverRandom)
+	if err != nil {
+		return localAlert(alertInternalError)
+	}
+	if s.isClient {
+		s.write[1], s.pendingRead = client, server
+	} else {
+		s.write[1], s.pendingRead = server, client
+	}
+	return nil
+}
+
+// checkFinished verifies the peer's Finished message.
+func (s *session) checkFinished(m handshake, epoch uint16, transcript []byte) error {
+	if epoch != 1 {
+		return localAlert(alertUnexpectedMessage)
+	}
+	label := "client finished"
+	if s.isClient {
+		label = "server finished"
+	}
+	if subtle.ConstantTimeCompare(m.body, verifyData(s.master, label, transcript)) != 1 {
+		return localAlert(alertDecryptError)
+	}
+	return nil
+}
+
+// addFinished appends our ChangeCipherSpec and Finished messages to
+// the current flight.
+func (s *session) addFinished() {
+	label := "server finished"
+	if s.isClient {
+		label = "client finished"
+	}
+	s.addChangeCipherSpec()
+	s.addHandshake(typeFinished, verifyData(s.master, label, s.transcript))
+}
+
+// establish completes the handshake.
+func (s *session) establish() {
+	s.state = stateEstablished
+	s.queued = nil
+	s.partials = nil
+	s.addr = &Addr{Addr: s.peer, Identity: s.identity, PublicKey: s.peerKey}
+}
+
+// parsePublicKey decodes a raw public key (RFC 7250) Certificate
+// message and validates the key.
+func (s *session) parsePublicKey(body []byte) (*ecdsa.PublicKey, error) {
+	r := reader{b: body}
+	spki := r.vec24()
+	if !r.done() || len(spki) == 0 {
+		return nil, localAlert(alertDecodeError)
+	}
+	k, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		return nil, localAlert(alertBadCertificate)
+	}
+	pub, ok := k.(*ecdsa.PublicKey)
+	if !ok || pub.Curve != elliptic.P256() {
+		return nil, localAlert(alertUnsupportedCertificate)
+	}
+	if s.cfg.VerifyPeerPublicKey != nil {
+		if err := s.cfg.VerifyPeerPublicKey(pub); err != nil {
+			return nil, localAlert(alertBadCertificate)
+		}
+	}
+	return pub, nil
+}
+
+// marshalPublicKey encodes our raw public key Certificate message.
+func (s *session) marshalPublicKey() ([]byte, error) {
+	spki, err := x509.MarshalPKIXPublicKey(&s.cfg.PrivateKey.PublicKey)
+	if err != nil {
+		return nil, localAlert(alertInternalError)
+	}
+	return appendVec24(nil, spki), nil
+}
+
+func (s *session) sign(data []byte) ([]byte, error) {
+	h := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(s.rand, s.cfg.PrivateKey, h[:])
+	if err != nil {
+		return nil, localAlert(alertInternalError)
+	}
+	return marshalSignature(sig), nil
+}
+
+func verify(pub *ecdsa.PublicKey, data, sig []byte) bool {
+	h := sha256.Sum256(data)
+	return ecdsa.VerifyASN1(pub, h[:], sig)
+}
+
+// ecdhe completes an ephemeral P-256 key exchange, returning the
+// premaster secret.
+func (s *session) ecdhe(peer []byte) ([]byte, error) {
+	pub, err := ecdh.P256().NewPublicKey(peer)
+	if err != nil {
+		return nil, localAlert(alertIllegalParameter)
+	}
+	pre, err := s.ecdhKey.ECDH(pub)
+	if err != nil {
+		return nil, localAlert(alertIllegalParameter)
+	}
+	return pre, nil
+}
+
+func (s *session) generateECDHKey() error {
+	k, err := ecdh.P256().GenerateKey(s.rand)
+	if err != nil {
+		return localAlert(alertInternalError)
+	}
+	s.ecdhKey = k
+	return nil
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsByte(list []byte, v byte) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
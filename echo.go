@@ -0,0 +1,126 @@
+package coap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// echoMACLen is the length of the MAC in Echo values, which follows an
+// 8-byte timestamp.
+const echoMACLen = 8
+
+// EchoGuard issues and checks Echo values (RFC 9175 section 2).  Values
+// are bound to the client's address and authenticated, so the guard
+// keeps no state per value.  It is safe for concurrent use.
+type EchoGuard struct {
+	key []byte
+	now func() time.Time
+
+	mu       sync.Mutex
+	verified map[string]time.Time // endpoint address to expiry
+}
+
+// NewEchoGuard returns a guard authenticating Echo values with key.
+// Servers sharing a key accept each other's values.  If key is nil, a
+// random key is used.
+func NewEchoGuard(key []byte) *EchoGuard {
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	return &EchoGuard{key: key, now: time.Now, verified: map[string]time.Time{}}
+}
+
+func (g *EchoGuard) mac(a net.Addr, ts []byte) []byte {
+	h := hmac.New(sha256.New, g.key)
+	h.Write(ts)
+	h.Write([]byte(a.String()))
+	return h.Sum(nil)[:echoMACLen]
+}
+
+// value returns a new Echo value for the endpoint at a.
+func (g *EchoGuard) value(a net.Addr) []byte {
+	ts := binary.BigEndian.AppendUint64(nil, uint64(g.now().UnixNano()))
+	return append(ts, g.mac(a, ts)...)
+}
+
+// age returns how long ago the Echo value of m was issued to a, or
+// false if m has none or it was not issued to a.
+func (g *EchoGuard) age(a net.Addr, m *Message) (time.Duration, bool) {
+	v := optionBytes(*m, Echo)
+	if len(v) != 8+echoMACLen || !hmac.Equal(v[8:], g.mac(a, v[:8])) {
+		return 0, false
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+	return g.now().Sub(issued), true
+}
+
+// challenge answers m with 4.01 Unauthorized and a new Echo value.
+func (g *EchoGuard) challenge(a net.Addr, m *Message) *Message {
+	rv := replyTo(m, Unauthorized)
+	rv.SetOption(Echo, g.value(a))
+	rv.SetOption(MaxAge, 0)
+	return rv
+}
+
+// Fresh returns middleware requiring requests to echo a value issued
+// at most maxAge ago, as actuators need to reject delayed or replayed
+// requests (RFC 9175 section 2.3).  Other requests are challenged with
+// 4.01 Unauthorized and a new Echo value.
+func (g *EchoGuard) Fresh(maxAge time.Duration) Middleware {
+	return func(h Handler) Handler {
+		return funcHandler(func(l Transport, a net.Addr, m *Message) *Message {
+			if m.Code == Empty || m.Code >= Created {
+				return h.ServeCOAP(l, a, m)
+			}
+			if age, ok := g.age(a, m); !ok || age > maxAge {
+				return g.challenge(a, m)
+			}
+			return h.ServeCOAP(l, a, m)
+		})
+	}
+}
+
+// Verified returns middleware serving only endpoints that have shown
+// they receive responses at their address, mitigating amplification
+// attacks (RFC 9175 section 2.4).  Requests from other endpoints are
+// challenged with 4.01 Unauthorized and an Echo value; echoing it
+// verifies the endpoint for lifetime.
+func (g *EchoGuard) Verified(lifetime time.Duration) Middleware {
+	return func(h Handler) Handler {
+		return funcHandler(func(l Transport, a net.Addr, m *Message) *Message {
+			if m.Code == Empty || m.Code >= Created || g.isVerified(a, m, lifetime) {
+				return h.ServeCOAP(l, a, m)
+			}
+			return g.challenge(a, m)
+		})
+	}
+}
+
+// isVerified reports whether the endpoint at a is verified, verifying
+// it if m echoes a value issued within lifetime.
+func (g *EchoGuard) isVerified(a net.Addr, m *Message, lifetime time.Duration) bool {
+	now := g.now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if exp, ok := g.verified[a.String()]; ok && now.Before(exp) {
+		return true
+	}
+	if age, ok := g.age(a, m); !ok || age > lifetime {
+		return false
+	}
+	for k, exp := range g.verified {
+		if !now.Before(exp) {
+			delete(g.verified, k)
+		}
+	}
+	g.verified[a.String()] = now.Add(lifetime)
+	return true
+}
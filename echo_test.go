@@ -0,0 +1,107 @@
+package coap
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+type testAddr string
+
+func (a testAddr) Network() string { return "test" }
+func (a testAddr) String() string  { return string(a) }
+
+func TestEchoFresh(t *testing.T) {
+	g := NewEchoGuard([]byte("key"))
+	now := time.Unix(1000, 0)
+	g.now = func() time.Time { return now }
+	served := 0
+	h := g.Fresh(10 * time.Second)(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		served++
+		return &Message{Type: Acknowledgement, Code: Changed, MessageID: m.MessageID}
+	}))
+	a, b := testAddr("a"), testAddr("b")
+
+	req := &Message{Type: Confirmable, Code: PUT, MessageID: 1, Token: []byte("t")}
+	rv := h.ServeCOAP(nil, a, req)
+	echo, _ := rv.Option(Echo).([]byte)
+	if rv.Code != Unauthorized || rv.Type != Acknowledgement || len(echo) == 0 ||
+		!bytes.Equal(rv.Token, req.Token) || served != 0 {
+		t.Fatalf("got %v, want 4.01 with Echo", rv)
+	}
+
+	req.SetOption(Echo, echo)
+	now = now.Add(5 * time.Second)
+	if rv := h.ServeCOAP(nil, a, req); rv.Code != Changed || served != 1 {
+		t.Errorf("echoed request: got %v", rv)
+	}
+	if rv := h.ServeCOAP(nil, b, req); rv.Code != Unauthorized {
+		t.Errorf("value from another endpoint: got %v", rv)
+	}
+	now = now.Add(6 * time.Second)
+	if rv := h.ServeCOAP(nil, a, req); rv.Code != Unauthorized {
+		t.Errorf("stale value: got %v", rv)
+	}
+	if rv := h.ServeCOAP(nil, a, &Message{Type: NonConfirmable, Code: PUT}); rv == nil || rv.Type != NonConfirmable || rv.Code != Unauthorized {
+		t.Errorf("NON request: got %v", rv)
+	}
+
+	// Values from guards with another key are rejected.
+	other := NewEchoGuard(nil)
+	req.SetOption(Echo, other.value(a))
+	if rv := h.ServeCOAP(nil, a, req); rv.Code != Unauthorized {
+		t.Errorf("foreign value: got %v", rv)
+	}
+}
+
+func TestEchoVerified(t *testing.T) {
+	g := NewEchoGuard(nil)
+	now := time.Unix(1000, 0)
+	g.now = func() time.Time { return now }
+	h := g.Verified(time.Minute)(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		return &Message{Type: Acknowledgement, Code: Content, MessageID: m.MessageID}
+	}))
+	a := testAddr("a")
+
+	req := &Message{Type: Confirmable, Code: GET}
+	rv := h.ServeCOAP(nil, a, req)
+	if rv.Code != Unauthorized {
+		t.Fatalf("unverified: got %v", rv)
+	}
+	req.SetOption(Echo, rv.Option(Echo))
+	if rv := h.ServeCOAP(nil, a, req); rv.Code != Content {
+		t.Fatalf("echoed request: got %v", rv)
+	}
+
+	// The endpoint stays verified for the lifetime without echoing.
+	now = now.Add(30 * time.Second)
+	if rv := h.ServeCOAP(nil, a, &Message{Type: Confirmable, Code: GET}); rv.Code != Content {
+		t.Errorf("verified: got %v", rv)
+	}
+	now = now.Add(time.Minute)
+	if rv := h.ServeCOAP(nil, a, &Message{Type: Confirmable, Code: GET}); rv.Code != Unauthorized {
+		t.Errorf("expired: got %v", rv)
+	}
+}
+
+func TestConnEchoRetry(t *testing.T) {
+	srv, cli := Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	g := NewEchoGuard(nil)
+	var ids []uint16
+	go Serve(srv, g.Fresh(time.Minute)(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		ids = append(ids, m.MessageID)
+		return &Message{Type: Acknowledgement, Code: Changed, MessageID: m.MessageID}
+	})))
+	c := NewConn(cli, srv.LocalAddr())
+
+	rv, err := c.Send(Message{Type: Confirmable, Code: PUT, MessageID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv.Code != Changed || len(ids) != 1 || ids[0] != 8 {
+		t.Errorf("got %v after %v, want 2.04 after retry with MID 8", rv, ids)
+	}
+}
@@ -9,7 +9,7 @@ import (
 	"github.com/zltl/go-coap"
 )
 
-func periodicTransmitter(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) {
+func periodicTransmitter(l coap.Transport, a net.Addr, m *coap.Message) {
 	subded := time.Now()
 
 	for {
@@ -36,7 +36,7 @@ func periodicTransmitter(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) {
 
 func main() {
 	log.Fatal(coap.ListenAndServe("udp", ":5683",
-		coap.FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) *coap.Message {
+		coap.FuncHandler(func(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
 			log.Printf("Got message path=%q: %#v from %v", m.Path(), m, a)
 			if m.Code == coap.GET && m.Option(coap.Observe) != nil {
 				if value, ok := m.Option(coap.Observe).([]uint8); ok &&
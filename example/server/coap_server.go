@@ -7,7 +7,7 @@ import (
 	"github.com/zltl/go-coap"
 )
 
-func handleA(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) *coap.Message {
+func handleA(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
 	log.Printf("Got message in handleA: path=%q: %#v from %v", m.Path(), m, a)
 	if m.IsConfirmable() {
 		res := &coap.Message{
@@ -25,7 +25,7 @@ func handleA(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) *coap.Message {
 	return nil
 }
 
-func handleB(l *net.UDPConn, a *net.UDPAddr, m *coap.Message) *coap.Message {
+func handleB(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
 	log.Printf("Got message in handleB: path=%q: %#v from %v", m.Path(), m, a)
 	if m.IsConfirmable() {
 		res := &coap.Message{
@@ -0,0 +1,190 @@
+package httpcoap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zltl/go-coap"
+)
+
+// CoAPToHTTP is a coap.Handler forwarding proxy requests for http and
+// https URIs to HTTP servers, with the mappings of RFC 8075 applied in
+// reverse.  HTTP servers that cannot be reached are reported with 5.02
+// Bad Gateway, and those that do not answer in time with 5.04 Gateway
+// Timeout.  Responses too large for a single CoAP message are reported
+// with 5.02, and requests whose Hop-Limit is exhausted are answered
+// with 5.08 Hop Limit Reached.
+type CoAPToHTTP struct {
+	// Client sends the HTTP requests.  If nil, a client timing out
+	// after coap.ResponseTimeout is used.
+	Client *http.Client
+
+	// Next serves requests that are not for http or https URIs,
+	// such as a coap.Proxy.  If nil, proxy requests for other
+	// schemes are answered with 5.05 Proxying Not Supported and
+	// other requests with 4.04 Not Found.
+	Next coap.Handler
+}
+
+var defaultClient = &http.Client{Timeout: coap.ResponseTimeout}
+
+// httpMethods maps CoAP request codes to HTTP methods.
+var httpMethods = map[coap.COAPCode]string{}
+
+func init() {
+	for method, code := range methods {
+		httpMethods[code] = method
+	}
+}
+
+// ServeCOAP forwards a proxy request.
+func (p *CoAPToHTTP) ServeCOAP(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
+	u, err := m.ProxyTarget()
+	if err != nil {
+		return reply(m, coap.BadOption)
+	}
+	if u == nil || u.Scheme != "http" && u.Scheme != "https" {
+		switch {
+		case p.Next != nil:
+			return p.Next.ServeCOAP(l, a, m)
+		case u == nil:
+			return reply(m, coap.NotFound)
+		}
+		return reply(m, coap.ProxyingNotSupported)
+	}
+	if _, ok := coap.NextHopLimit(m); !ok {
+		return reply(m, coap.HopLimitReached)
+	}
+	method, ok := httpMethods[m.Code]
+	if !ok {
+		return reply(m, coap.MethodNotAllowed)
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(m.Payload))
+	if err != nil {
+		return reply(m, coap.BadOption)
+	}
+	if mt, ok := m.Option(coap.ContentFormat).(coap.MediaType); ok {
+		req.Header.Set("Content-Type", contentType(mt))
+	}
+	if mt, ok := m.Option(coap.Accept).(coap.MediaType); ok {
+		req.Header.Set("Accept", contentType(mt))
+	}
+	for _, v := range m.Options(coap.IfMatch) {
+		if etag := v.([]byte); len(etag) == 0 {
+			req.Header.Add("If-Match", "*")
+		} else {
+			req.Header.Add("If-Match", formatETag(etag))
+		}
+	}
+	if m.Option(coap.IfNoneMatch) != nil {
+		req.Header.Set("If-None-Match", "*")
+	} else {
+		for _, v := range m.Options(coap.ETag) {
+			req.Header.Add("If-None-Match", formatETag(v.([]byte)))
+		}
+	}
+
+	client := p.Client
+	if client == nil {
+		client = defaultClient
+	}
+	resp, err := client.Do(req)
+	var nerr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &nerr) && nerr.Timeout():
+		return reply(m, coap.GatewayTimeout)
+	case err != nil:
+		return reply(m, coap.BadGateway)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPayload+1))
+	if err != nil || len(body) > maxPayload {
+		return reply(m, coap.BadGateway)
+	}
+
+	rv := reply(m, responseCode(m.Code, resp.StatusCode))
+	if rv == nil {
+		return nil
+	}
+	rv.Payload = body
+	if ct := resp.Header.Get("Content-Type"); ct != "" && len(body) > 0 {
+		if mt, err := coap.ParseMediaType(ct); err == nil {
+			rv.SetOption(coap.ContentFormat, mt)
+		}
+	}
+	if etags := parseETags(resp.Header.Get("ETag")); len(etags) == 1 {
+		rv.SetOption(coap.ETag, etags[0])
+	}
+	if age, ok := maxAge(resp.Header); ok {
+		rv.SetOption(coap.MaxAge, age)
+	}
+	return rv
+}
+
+// responseCode maps an HTTP status to a CoAP response code.  The
+// response to a successful request depends on its method.
+func responseCode(method coap.COAPCode, status int) coap.COAPCode {
+	if code, ok := responseCodes[status]; ok {
+		if code == coap.Changed && method == coap.DELETE {
+			return coap.Deleted
+		}
+		return code
+	}
+	switch {
+	case status >= 200 && status < 300:
+		switch method {
+		case coap.GET, coap.FETCH:
+			return coap.Content
+		case coap.DELETE:
+			return coap.Deleted
+		}
+		return coap.Changed
+	case status >= 400 && status < 500:
+		return coap.BadRequest
+	case status >= 500 && status < 600:
+		return coap.InternalServerError
+	}
+	return coap.BadGateway
+}
+
+// maxAge returns the freshness lifetime in a Cache-Control header.
+// Responses that must not be reused get 0.
+func maxAge(h http.Header) (uint32, bool) {
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		switch {
+		case d == "no-cache" || d == "no-store":
+			return 0, true
+		case strings.HasPrefix(d, "max-age="):
+			n, err := strconv.ParseUint(d[len("max-age="):], 10, 32)
+			if err == nil {
+				return uint32(n), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// reply builds a response to m without payload, or returns nil for
+// non-confirmable requests answered with an error.
+func reply(m *coap.Message, code coap.COAPCode) *coap.Message {
+	rv := &coap.Message{
+		Type:      coap.NonConfirmable,
+		Code:      code,
+		MessageID: m.MessageID,
+		Token:     m.Token,
+	}
+	if m.IsConfirmable() {
+		rv.Type = coap.Acknowledgement
+	} else if code >= coap.BadRequest {
+		return nil
+	}
+	return rv
+}
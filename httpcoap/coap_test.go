@@ -0,0 +1,133 @@
+package httpcoap
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zltl/go-coap"
+)
+
+func proxyRequest(code coap.COAPCode, uri string, payload string) *coap.Message {
+	m := &coap.Message{Type: coap.Confirmable, Code: code, MessageID: 5,
+		Token: []byte("tk"), Payload: []byte(payload)}
+	m.SetOption(coap.ProxyURI, uri)
+	return m
+}
+
+func TestCoAPToHTTP(t *testing.T) {
+	var last *http.Request
+	var lastBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		last = r
+		b, _ := io.ReadAll(r.Body)
+		lastBody = string(b)
+		switch {
+		case r.URL.Path == "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case r.Header.Get("If-None-Match") == `"0102"`:
+			w.WriteHeader(http.StatusNotModified)
+		case r.Method == http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"0102"`)
+			w.Header().Set("Cache-Control", "public, max-age=120")
+			w.Write([]byte(`{"t":1}`))
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusTeapot)
+		}
+	}))
+	defer srv.Close()
+	p := &CoAPToHTTP{Client: &http.Client{Timeout: 100 * time.Millisecond}}
+
+	m := proxyRequest(coap.GET, srv.URL+"/things?a=1", "")
+	m.SetOption(coap.Accept, coap.AppJSON)
+	rv := p.ServeCOAP(nil, nil, m)
+	if rv.Code != coap.Content || string(rv.Payload) != `{"t":1}` || rv.MessageID != 5 ||
+		string(rv.Token) != "tk" || rv.Type != coap.Acknowledgement {
+		t.Fatalf("GET: %v", rv)
+	}
+	if rv.Option(coap.ContentFormat) != coap.AppJSON || rv.Option(coap.MaxAge) != uint32(120) ||
+		string(rv.Option(coap.ETag).([]byte)) != "\x01\x02" {
+		t.Errorf("GET options: %v %v %v", rv.Option(coap.ContentFormat),
+			rv.Option(coap.MaxAge), rv.Option(coap.ETag))
+	}
+	if last.URL.RawQuery != "a=1" || last.Header.Get("Accept") != "application/json" {
+		t.Errorf("forwarded %v, Accept %q", last.URL, last.Header.Get("Accept"))
+	}
+
+	m = proxyRequest(coap.GET, srv.URL+"/things", "")
+	m.SetOption(coap.ETag, []byte{1, 2})
+	if rv := p.ServeCOAP(nil, nil, m); rv.Code != coap.Valid {
+		t.Errorf("validation: %v", rv.Code)
+	}
+
+	m = proxyRequest(coap.POST, srv.URL+"/things", "hello")
+	m.SetOption(coap.ContentFormat, coap.TextPlain)
+	if rv := p.ServeCOAP(nil, nil, m); rv.Code != coap.Created {
+		t.Errorf("POST: %v", rv.Code)
+	}
+	if lastBody != "hello" || last.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("POST forwarded %q as %q", lastBody, last.Header.Get("Content-Type"))
+	}
+
+	tests := []struct {
+		m    *coap.Message
+		want coap.COAPCode
+	}{
+		{proxyRequest(coap.DELETE, srv.URL+"/things", ""), coap.Deleted},
+		{proxyRequest(coap.PUT, srv.URL+"/things", ""), coap.BadRequest},
+		{proxyRequest(coap.GET, srv.URL+"/slow", ""), coap.GatewayTimeout},
+		{proxyRequest(coap.GET, "http://127.0.0.1:1/", ""), coap.BadGateway},
+		{proxyRequest(coap.GET, "coap://127.0.0.1/", ""), coap.ProxyingNotSupported},
+		{&coap.Message{Type: coap.Confirmable, Code: coap.GET}, coap.NotFound},
+		{hopLimit(proxyRequest(coap.GET, srv.URL+"/things", ""), 1), coap.HopLimitReached},
+	}
+	for _, test := range tests {
+		if rv := p.ServeCOAP(nil, nil, test.m); rv == nil || rv.Code != test.want {
+			t.Errorf("%v %v: got %v, want %v", test.m.Code, test.m.Option(coap.ProxyURI), rv, test.want)
+		}
+	}
+}
+
+func TestCoAPToHTTPNext(t *testing.T) {
+	p := &CoAPToHTTP{Next: coap.FuncHandler(func(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
+		return &coap.Message{Type: coap.Acknowledgement, Code: coap.Content, MessageID: m.MessageID}
+	})}
+	if rv := p.ServeCOAP(nil, nil, proxyRequest(coap.GET, "coap://127.0.0.1/", "")); rv.Code != coap.Content {
+		t.Errorf("coap URI not passed to Next: %v", rv)
+	}
+}
+
+func TestResponseCode(t *testing.T) {
+	tests := []struct {
+		method coap.COAPCode
+		status int
+		want   coap.COAPCode
+	}{
+		{coap.GET, 200, coap.Content},
+		{coap.PUT, 200, coap.Changed},
+		{coap.DELETE, 200, coap.Deleted},
+		{coap.DELETE, 204, coap.Deleted},
+		{coap.POST, 204, coap.Changed},
+		{coap.GET, 410, coap.BadRequest},
+		{coap.GET, 507, coap.InternalServerError},
+		{coap.GET, 302, coap.BadGateway},
+	}
+	for _, test := range tests {
+		if got := responseCode(test.method, test.status); got != test.want {
+			t.Errorf("responseCode(%v, %d) = %v, want %v", test.method, test.status, got, test.want)
+		}
+	}
+}
+
+func hopLimit(m *coap.Message, n uint32) *coap.Message {
+	m.SetOption(coap.HopLimit, n)
+	return m
+}
@@ -0,0 +1,202 @@
+package httpcoap
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/zltl/go-coap"
+)
+
+// DefaultPrefix is the path under which HTTPToCoAP expects target
+// URIs, as in RFC 8075 section 5.3.
+const DefaultPrefix = "/hc/"
+
+// HTTPToCoAP is an http.Handler forwarding HTTP requests to CoAP
+// servers.  The target CoAP URI follows the prefix in the request path,
+// as in http://proxy.example/hc/coap://sensor.example/temp, and may be
+// percent-encoded.
+//
+// Methods, status codes, Content-Type and Content-Format, entity-tags
+// and Cache-Control max-age are mapped as in RFC 8075.  Payloads are
+// limited to what fits in a single CoAP message.  Requests leave with
+// the Proxy's default Hop-Limit, and 5.08 Hop Limit Reached is reported
+// as 508 Loop Detected.
+type HTTPToCoAP struct {
+	// Prefix is the path prefix before the target URI.  If empty,
+	// DefaultPrefix is used.
+	Prefix string
+
+	// Proxy forwards the translated requests, and its Cache, if any,
+	// holds the CoAP responses.  If nil, a Proxy with default
+	// settings is used.
+	Proxy *coap.Proxy
+}
+
+func (h *HTTPToCoAP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := h.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	tu, ok := strings.CutPrefix(r.URL.EscapedPath(), prefix)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.Contains(tu, "://") {
+		var err error
+		if tu, err = url.PathUnescape(tu); err != nil {
+			http.Error(w, "malformed target URI", http.StatusBadRequest)
+			return
+		}
+	}
+	if r.URL.RawQuery != "" {
+		tu += "?" + r.URL.RawQuery
+	}
+	target, err := url.Parse(tu)
+	if err != nil || !target.IsAbs() || target.Host == "" {
+		http.Error(w, "malformed target URI", http.StatusBadRequest)
+		return
+	}
+
+	req, status := h.request(r, target)
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	p := h.Proxy
+	if p == nil {
+		p = &coap.Proxy{}
+	}
+	res := p.ServeCOAP(nil, nil, req)
+	if res == nil {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	writeResponse(w, res, prefix+target.Scheme+"://"+target.Host)
+}
+
+// request translates r into a CoAP proxy request for target, or
+// returns the HTTP status to reply with if it cannot be translated.
+func (h *HTTPToCoAP) request(r *http.Request, target *url.URL) (*coap.Message, int) {
+	code, ok := methods[r.Method]
+	if !ok {
+		return nil, http.StatusNotImplemented
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPayload+1))
+	if err != nil {
+		return nil, http.StatusBadRequest
+	}
+	if len(body) > maxPayload {
+		return nil, http.StatusRequestEntityTooLarge
+	}
+
+	m := &coap.Message{
+		Type:    coap.Confirmable,
+		Code:    code,
+		Payload: body,
+	}
+	m.SetOption(coap.ProxyURI, target.String())
+
+	if ct := r.Header.Get("Content-Type"); ct != "" && len(body) > 0 {
+		mt, err := coap.ParseMediaType(ct)
+		if err != nil {
+			return nil, http.StatusUnsupportedMediaType
+		}
+		m.SetOption(coap.ContentFormat, mt)
+	}
+	if accept := r.Header.Get("Accept"); accept != "" {
+		mt, ok := acceptFormat(accept)
+		if !ok {
+			return nil, http.StatusNotAcceptable
+		}
+		if mt != nil {
+			m.SetOption(coap.Accept, *mt)
+		}
+	}
+
+	if v := r.Header.Get("If-Match"); v == "*" {
+		m.AddOption(coap.IfMatch, []byte{})
+	} else if v != "" {
+		for _, etag := range parseETags(v) {
+			m.AddOption(coap.IfMatch, etag)
+		}
+	}
+	if v := r.Header.Get("If-None-Match"); v == "*" {
+		m.SetOption(coap.IfNoneMatch, []byte{})
+	} else if v != "" && (code == coap.GET || code == coap.FETCH) {
+		for _, etag := range parseETags(v) {
+			m.AddOption(coap.ETag, etag)
+		}
+	}
+	return m, 0
+}
+
+// acceptFormat returns the content format of the first media range in
+// an Accept header that has one.  It returns nil if any format is
+// acceptable, and false if none of the ranges can be requested.
+func acceptFormat(accept string) (*coap.MediaType, bool) {
+	wildcard := false
+	for _, s := range strings.Split(accept, ",") {
+		s = strings.TrimSpace(s)
+		if strings.Contains(s, "*") {
+			wildcard = true
+			continue
+		}
+		// Drop the weight; the first range that maps wins.
+		if i := strings.Index(s, ";q="); i >= 0 {
+			s = s[:i]
+		}
+		if mt, err := coap.ParseMediaType(s); err == nil {
+			return &mt, true
+		}
+	}
+	return nil, wildcard
+}
+
+// writeResponse translates a CoAP response.  base is the proxy URI of
+// the origin server, for Location.
+func writeResponse(w http.ResponseWriter, res *coap.Message, base string) {
+	status, ok := statusCodes[res.Code]
+	switch {
+	case !ok:
+		status = http.StatusBadGateway
+	case (res.Code == coap.Deleted || res.Code == coap.Changed) && len(res.Payload) == 0:
+		status = http.StatusNoContent
+	}
+
+	hdr := w.Header()
+	if mt, ok := res.Option(coap.ContentFormat).(coap.MediaType); ok {
+		hdr.Set("Content-Type", contentType(mt))
+	}
+	if etag, ok := res.Option(coap.ETag).([]byte); ok {
+		hdr.Set("ETag", formatETag(etag))
+	}
+	if age, ok := res.Option(coap.MaxAge).(uint32); ok {
+		hdr.Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(age), 10))
+	} else if res.Code == coap.Content || res.Code == coap.Valid {
+		hdr.Set("Cache-Control", "max-age="+strconv.Itoa(coap.DefaultMaxAge))
+	}
+	if path := res.Options(coap.LocationPath); len(path) > 0 {
+		var segs []string
+		for _, s := range path {
+			segs = append(segs, url.PathEscape(s.(string)))
+		}
+		loc := base + "/" + strings.Join(segs, "/")
+		var q []string
+		for _, s := range res.Options(coap.LocationQuery) {
+			q = append(q, url.QueryEscape(s.(string)))
+		}
+		if len(q) > 0 {
+			loc += "?" + strings.Join(q, "&")
+		}
+		hdr.Set("Location", loc)
+	}
+
+	w.WriteHeader(status)
+	if status != http.StatusNotModified && status != http.StatusNoContent {
+		w.Write(res.Payload)
+	}
+}
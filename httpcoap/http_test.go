@@ -0,0 +1,145 @@
+package httpcoap
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zltl/go-coap"
+)
+
+// startOrigin serves a CoAP thermostat on loopback UDP and returns its
+// address.
+func startOrigin(t *testing.T) string {
+	l, err := coap.Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	temp := "22.5"
+	etag := func(m *coap.Message) []byte { return []byte{0xab, byte(len(temp))} }
+	mux := coap.NewServeMux()
+	mux.HandleMethod(coap.GET, "temp", coap.Conditional(etag,
+		coap.FuncHandler(func(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
+			rv := &coap.Message{Type: coap.Acknowledgement, Code: coap.Content,
+				MessageID: m.MessageID, Token: m.Token, Payload: []byte(temp)}
+			rv.SetOption(coap.ContentFormat, coap.TextPlain)
+			rv.SetOption(coap.MaxAge, uint32(30))
+			return rv
+		})))
+	mux.HandleMethod(coap.PUT, "temp", coap.Conditional(etag,
+		coap.FuncHandler(func(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
+			temp = string(m.Payload)
+			return &coap.Message{Type: coap.Acknowledgement, Code: coap.Changed,
+				MessageID: m.MessageID, Token: m.Token}
+		})))
+	mux.HandleMethodFunc(coap.POST, "items", func(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
+		if m.Option(coap.ContentFormat) != coap.AppJSON {
+			return &coap.Message{Type: coap.Acknowledgement, Code: coap.UnsupportedContentFormat,
+				MessageID: m.MessageID, Token: m.Token}
+		}
+		rv := &coap.Message{Type: coap.Acknowledgement, Code: coap.Created,
+			MessageID: m.MessageID, Token: m.Token}
+		rv.SetOption(coap.LocationPath, []string{"items", "7"})
+		return rv
+	})
+	go coap.Serve(l, mux)
+	return l.LocalAddr().String()
+}
+
+func TestHTTPToCoAP(t *testing.T) {
+	origin := startOrigin(t)
+	srv := httptest.NewServer(&HTTPToCoAP{})
+	defer srv.Close()
+	base := srv.URL + "/hc/coap://" + origin
+
+	do := func(method, path string, body string, hdr ...string) *http.Response {
+		req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := do("GET", "/temp", "", "Accept", "text/plain")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "22.5" {
+		t.Fatalf("GET: %v %q", resp.Status, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "max-age=30" {
+		t.Errorf("Cache-Control %q", cc)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag != `"ab04"` {
+		t.Errorf("ETag %q", etag)
+	}
+
+	if resp := do("GET", "/temp", "", "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional GET: %v", resp.Status)
+	}
+	if resp := do("PUT", "/temp", "19", "If-Match", `"ffff"`, "Content-Type", "text/plain"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PUT with stale If-Match: %v", resp.Status)
+	}
+	if resp := do("PUT", "/temp", "19.5", "If-Match", etag, "Content-Type", "text/plain"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("PUT: %v", resp.Status)
+	}
+
+	resp = do("POST", "/items", `{"a":1}`, "Content-Type", "application/json")
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != "/hc/coap://"+origin+"/items/7" {
+		t.Errorf("POST: %v, Location %q", resp.Status, resp.Header.Get("Location"))
+	}
+	if resp := do("POST", "/items", `x`, "Content-Type", "text/x-unknown"); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("POST with unmapped Content-Type: %v", resp.Status)
+	}
+	if resp := do("GET", "/temp", "", "Accept", "text/x-unknown"); resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("GET with unmapped Accept: %v", resp.Status)
+	}
+	if resp := do("PATCH", "/temp", ""); resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("PATCH: %v", resp.Status)
+	}
+	if resp := do("GET", "/missing", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing resource: %v", resp.Status)
+	}
+}
+
+func TestHTTPToCoAPTarget(t *testing.T) {
+	origin := startOrigin(t)
+	srv := httptest.NewServer(&HTTPToCoAP{Prefix: "/proxy/"})
+	defer srv.Close()
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/proxy/coap%3A%2F%2F" + strings.Replace(origin, ":", "%3A", 1) + "%2Ftemp", http.StatusOK},
+		{"/proxy/coap://" + origin + "/temp", http.StatusOK},
+		{"/proxy/mqtt://" + origin + "/temp", http.StatusBadGateway},
+		{"/proxy/temp", http.StatusBadRequest},
+		{"/hc/coap://" + origin + "/temp", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(srv.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got %v, want %d", test.path, resp.Status, test.status)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Package httpcoap implements HTTP-CoAP cross proxies (RFC 8075):
+// HTTPToCoAP lets HTTP clients reach CoAP servers, and CoAPToHTTP lets
+// CoAP clients reach HTTP servers.
+package httpcoap
+
+import (
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/zltl/go-coap"
+)
+
+// maxPayload is the largest payload carried in a single CoAP message
+// (RFC 7252 section 4.6); block-wise transfers are not supported.
+const maxPayload = 1024
+
+// methods maps HTTP methods to CoAP request codes.
+var methods = map[string]coap.COAPCode{
+	http.MethodGet:    coap.GET,
+	http.MethodPost:   coap.POST,
+	http.MethodPut:    coap.PUT,
+	http.MethodDelete: coap.DELETE,
+	"FETCH":           coap.FETCH,
+}
+
+// statusCodes maps CoAP response codes to HTTP status codes (RFC 8075
+// section 7).  2.02 Deleted and 2.04 Changed without a payload map to
+// 204 No Content instead.
+var statusCodes = map[coap.COAPCode]int{
+	coap.Created:                  http.StatusCreated,
+	coap.Deleted:                  http.StatusOK,
+	coap.Valid:                    http.StatusNotModified,
+	coap.Changed:                  http.StatusOK,
+	coap.Content:                  http.StatusOK,
+	coap.BadRequest:               http.StatusBadRequest,
+	coap.Unauthorized:             http.StatusForbidden,
+	coap.BadOption:                http.StatusBadRequest,
+	coap.Forbidden:                http.StatusForbidden,
+	coap.NotFound:                 http.StatusNotFound,
+	coap.MethodNotAllowed:         http.StatusBadRequest,
+	coap.NotAcceptable:            http.StatusNotAcceptable,
+	coap.RequestEntityIncomplete:  http.StatusBadRequest,
+	coap.Conflict:                 http.StatusConflict,
+	coap.PreconditionFailed:       http.StatusPreconditionFailed,
+	coap.RequestEntityTooLarge:    http.StatusRequestEntityTooLarge,
+	coap.UnsupportedContentFormat: http.StatusUnsupportedMediaType,
+	coap.InternalServerError:      http.StatusInternalServerError,
+	coap.NotImplemented:           http.StatusNotImplemented,
+	coap.BadGateway:               http.StatusBadGateway,
+	coap.ServiceUnavailable:       http.StatusServiceUnavailable,
+	coap.GatewayTimeout:           http.StatusGatewayTimeout,
+	coap.ProxyingNotSupported:     http.StatusBadGateway,
+	coap.HopLimitReached:          http.StatusLoopDetected,
+}
+
+// responseCodes maps HTTP status codes to CoAP response codes.  Other
+// 4xx and 5xx statuses map to 4.00 and 5.00; 200 depends on the method.
+var responseCodes = map[int]coap.COAPCode{
+	http.StatusCreated:               coap.Created,
+	http.StatusNoContent:             coap.Changed,
+	http.StatusNotModified:           coap.Valid,
+	http.StatusBadRequest:            coap.BadRequest,
+	http.StatusUnauthorized:          coap.Unauthorized,
+	http.StatusForbidden:             coap.Forbidden,
+	http.StatusNotFound:              coap.NotFound,
+	http.StatusMethodNotAllowed:      coap.MethodNotAllowed,
+	http.StatusNotAcceptable:         coap.NotAcceptable,
+	http.StatusConflict:              coap.Conflict,
+	http.StatusPreconditionFailed:    coap.PreconditionFailed,
+	http.StatusRequestEntityTooLarge: coap.RequestEntityTooLarge,
+	http.StatusUnsupportedMediaType:  coap.UnsupportedContentFormat,
+	http.StatusInternalServerError:   coap.InternalServerError,
+	http.StatusNotImplemented:        coap.NotImplemented,
+	http.StatusBadGateway:            coap.BadGateway,
+	http.StatusServiceUnavailable:    coap.ServiceUnavailable,
+	http.StatusGatewayTimeout:        coap.GatewayTimeout,
+	http.StatusLoopDetected:          coap.HopLimitReached,
+}
+
+// contentType returns the HTTP Content-Type of a content format.
+// Formats without a registered media type are sent as
+// application/octet-stream.
+func contentType(mt coap.MediaType) string {
+	if _, _, err := mime.ParseMediaType(mt.String()); err != nil {
+		return "application/octet-stream"
+	}
+	return mt.String()
+}
+
+// formatETag returns a CoAP ETag as an HTTP entity-tag.
+func formatETag(b []byte) string {
+	return `"` + hex.EncodeToString(b) + `"`
+}
+
+// parseETags returns the CoAP ETags in an HTTP If-Match or
+// If-None-Match header.  Entity-tags that are not the hex form of a
+// CoAP ETag are skipped.
+func parseETags(h string) [][]byte {
+	var rv [][]byte
+	for _, s := range strings.Split(h, ",") {
+		s = strings.TrimPrefix(strings.TrimSpace(s), "W/")
+		s = strings.Trim(s, `"`)
+		b, err := hex.DecodeString(s)
+		if err == nil && len(b) > 0 && len(b) <= 8 {
+			rv = append(rv, b)
+		}
+	}
+	return rv
+}
@@ -0,0 +1,345 @@
+// Package cbor implements the subset of CBOR (RFC 8949) used by the
+// CoAP extensions in this module.
+package cbor
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"unicode/utf8"
+)
+
+// Major types.
+const (
+	MajorUint   = 0
+	MajorNegInt = 1
+	MajorBytes  = 2
+	MajorText   = 3
+	MajorArray  = 4
+	MajorMap    = 5
+	MajorTag    = 6
+	MajorSimple = 7
+)
+
+// AppendHead appends the initial byte and argument of a data item.
+func AppendHead(b []byte, major byte, v uint64) []byte {
+	m := major << 5
+	switch {
+	case v < 24:
+		return append(b, m|byte(v))
+	case v <= math.MaxUint8:
+		return append(b, m|24, byte(v))
+	case v <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, m|25), uint16(v))
+	case v <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, m|26), uint32(v))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, m|27), v)
+	}
+}
+
+// AppendUint appends an unsigned integer.
+func AppendUint(b []byte, v uint64) []byte {
+	return AppendHead(b, MajorUint, v)
+}
+
+// AppendInt appends a signed integer.
+func AppendInt(b []byte, v int64) []byte {
+	if v < 0 {
+		return AppendHead(b, MajorNegInt, uint64(-1-v))
+	}
+	return AppendHead(b, MajorUint, uint64(v))
+}
+
+// AppendBytes appends a byte string.
+func AppendBytes(b, v []byte) []byte {
+	return append(AppendHead(b, MajorBytes, uint64(len(v))), v...)
+}
+
+// AppendText appends a text string.
+func AppendText(b []byte, v string) []byte {
+	return append(AppendHead(b, MajorText, uint64(len(v))), v...)
+}
+
+// AppendArray appends the head of an array of n items.
+func AppendArray(b []byte, n int) []byte {
+	return AppendHead(b, MajorArray, uint64(n))
+}
+
+// AppendMap appends the head of a map of n pairs.
+func AppendMap(b []byte, n int) []byte {
+	return AppendHead(b, MajorMap, uint64(n))
+}
+
+// AppendBool appends true or false.
+func AppendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xf5)
+	}
+	return append(b, 0xf4)
+}
+
+// AppendNull appends null.
+func AppendNull(b []byte) []byte {
+	return append(b, 0xf6)
+}
+
+// AppendFloat appends a floating-point number in the shortest of the
+// half, single and double precision encodings that represents it
+// exactly.
+func AppendFloat(b []byte, f float64) []byte {
+	if f32 := float32(f); float64(f32) == f || f != f {
+		if h, ok := float16Bits(f32); ok {
+			return binary.BigEndian.AppendUint16(append(b, 0xf9), h)
+		}
+		return binary.BigEndian.AppendUint32(append(b, 0xfa), math.Float32bits(f32))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xfb), math.Float64bits(f))
+}
+
+// float16Bits returns the half precision encoding of f, if it is
+// exact.
+func float16Bits(f float32) (uint16, bool) {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23&0xff) - 127
+	mant := bits & 0x7fffff
+	switch {
+	case f != f:
+		return 0x7e00, true
+	case exp == 128:
+		return sign | 0x7c00, true // infinity
+	case f == 0:
+		return sign, true
+	case exp >= -14 && exp <= 15 && mant&0x1fff == 0:
+		return sign | uint16(exp+15)<<10 | uint16(mant>>13), true
+	case exp >= -24 && exp < -14:
+		// Subnormal: the implicit leading bit becomes explicit.
+		m := mant | 0x800000
+		shift := uint(-exp - 14 + 13)
+		if m&(1<<shift-1) != 0 {
+			return 0, false
+		}
+		return sign | uint16(m>>shift), true
+	}
+	return 0, false
+}
+
+// Tag is a tagged data item.
+type Tag struct {
+	Number  uint64
+	Content interface{}
+}
+
+const maxDepth = 32
+
+// Decode decodes the first data item in b and returns it with the
+// remaining bytes.  Items decode to uint64, int64 (negative integers
+// only), float64, []byte, string, []interface{},
+// map[interface{}]interface{}, bool, nil (null and undefined) and Tag.
+func Decode(b []byte) (interface{}, []byte, error) {
+	d := decoder{b: b}
+	v, err := d.item(0)
+	return v, d.b, err
+}
+
+// Errors.
+var (
+	ErrTruncated   = errors.New("cbor: truncated data item")
+	ErrMalformed   = errors.New("cbor: malformed data item")
+	ErrTooDeep     = errors.New("cbor: nesting too deep")
+	ErrUnsupported = errors.New("cbor: unsupported data item")
+)
+
+type decoder struct {
+	b []byte
+}
+
+// head decodes an initial byte and its argument.  For indefinite
+// lengths and break, indef is true.
+func (d *decoder) head() (major byte, arg uint64, indef bool, err error) {
+	if len(d.b) == 0 {
+		return 0, 0, false, ErrTruncated
+	}
+	major, info := d.b[0]>>5, d.b[0]&0x1f
+	d.b = d.b[1:]
+	n := 0
+	switch {
+	case info < 24:
+		return major, uint64(info), false, nil
+	case info == 24:
+		n = 1
+	case info == 25:
+		n = 2
+	case info == 26:
+		n = 4
+	case info == 27:
+		n = 8
+	case info == 31:
+		return major, 0, true, nil
+	default:
+		return 0, 0, false, ErrMalformed
+	}
+	if len(d.b) < n {
+		return 0, 0, false, ErrTruncated
+	}
+	for _, c := range d.b[:n] {
+		arg = arg<<8 | uint64(c)
+	}
+	d.b = d.b[n:]
+	return major, arg, false, nil
+}
+
+func (d *decoder) item(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, ErrTooDeep
+	}
+	start := d.b
+	major, arg, indef, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case MajorUint:
+		return arg, nil
+	case MajorNegInt:
+		if arg > math.MaxInt64 {
+			return nil, ErrUnsupported
+		}
+		return -1 - int64(arg), nil
+	case MajorBytes, MajorText:
+		s, err := d.str(major, arg, indef)
+		if err != nil {
+			return nil, err
+		}
+		if major == MajorText {
+			if !utf8.Valid(s) {
+				return nil, ErrMalformed
+			}
+			return string(s), nil
+		}
+		return s, nil
+	case MajorArray:
+		var rv []interface{}
+		for i := uint64(0); indef || i < arg; i++ {
+			if indef && d.isBreak() {
+				break
+			}
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			rv = append(rv, v)
+		}
+		if rv == nil {
+			rv = []interface{}{}
+		}
+		return rv, nil
+	case MajorMap:
+		rv := map[interface{}]interface{}{}
+		for i := uint64(0); indef || i < arg; i++ {
+			if indef && d.isBreak() {
+				break
+			}
+			k, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch k.(type) {
+			case []byte, []interface{}, map[interface{}]interface{}, Tag:
+				return nil, ErrUnsupported
+			}
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := rv[k]; dup {
+				return nil, ErrMalformed
+			}
+			rv[k] = v
+		}
+		return rv, nil
+	case MajorTag:
+		v, err := d.item(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return Tag{Number: arg, Content: v}, nil
+	}
+
+	// Major type 7: simple values and floats.
+	switch info := start[0] & 0x1f; {
+	case info == 20:
+		return false, nil
+	case info == 21:
+		return true, nil
+	case info == 22 || info == 23:
+		return nil, nil
+	case info == 25:
+		return float16(uint16(arg)), nil
+	case info == 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case info == 27:
+		return math.Float64frombits(arg), nil
+	}
+	return nil, ErrUnsupported
+}
+
+// isBreak consumes a break code if it is next.
+func (d *decoder) isBreak() bool {
+	if len(d.b) > 0 && d.b[0] == 0xff {
+		d.b = d.b[1:]
+		return true
+	}
+	return false
+}
+
+// str decodes the contents of a byte or text string.
+func (d *decoder) str(major byte, n uint64, indef bool) ([]byte, error) {
+	if !indef {
+		if n > uint64(len(d.b)) {
+			return nil, ErrTruncated
+		}
+		s := d.b[:n]
+		d.b = d.b[n:]
+		return s, nil
+	}
+	var rv []byte
+	for !d.isBreak() {
+		m, n, indef, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if m != major || indef {
+			return nil, ErrMalformed
+		}
+		chunk, err := d.str(major, n, false)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, chunk...)
+	}
+	return rv, nil
+}
+
+func float16(h uint16) float64 {
+	exp := int(h >> 10 & 0x1f)
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
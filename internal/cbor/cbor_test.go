@@ -0,0 +1,115 @@
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Examples from RFC 8949 Appendix A.
+func TestAppend(t *testing.T) {
+	tests := []struct {
+		got []byte
+		exp string
+	}{
+		{AppendUint(nil, 0), "00"},
+		{AppendUint(nil, 23), "17"},
+		{AppendUint(nil, 24), "1818"},
+		{AppendUint(nil, 1000), "1903e8"},
+		{AppendUint(nil, 1000000), "1a000f4240"},
+		{AppendUint(nil, 1000000000000), "1b000000e8d4a51000"},
+		{AppendInt(nil, -1), "20"},
+		{AppendInt(nil, -1000), "3903e7"},
+		{AppendBytes(nil, []byte{1, 2, 3, 4}), "4401020304"},
+		{AppendText(nil, "IETF"), "6449455446"},
+		{AppendArray(AppendUint(AppendUint(nil, 1), 2), 2), "010282"},
+		{AppendMap(nil, 0), "a0"},
+		{AppendBool(nil, true), "f5"},
+		{AppendNull(nil), "f6"},
+	}
+	for _, test := range tests {
+		exp, _ := hex.DecodeString(test.exp)
+		if !bytes.Equal(test.got, exp) {
+			t.Errorf("Expected %x, got %x", exp, test.got)
+		}
+	}
+}
+
+func TestAppendFloat(t *testing.T) {
+	tests := []struct {
+		f   float64
+		exp string
+	}{
+		{0.0, "f90000"},
+		{math.Copysign(0, -1), "f98000"},
+		{1.0, "f93c00"},
+		{1.1, "fb3ff199999999999a"},
+		{1.5, "f93e00"},
+		{65504.0, "f97bff"},
+		{100000.0, "fa47c35000"},
+		{3.4028234663852886e+38, "fa7f7fffff"},
+		{1.0e+300, "fb7e37e43c8800759c"},
+		{5.960464477539063e-8, "f90001"},
+		{0.00006103515625, "f90400"},
+		{-4.0, "f9c400"},
+		{-4.1, "fbc010666666666666"},
+		{math.Inf(1), "f97c00"},
+		{math.NaN(), "f97e00"},
+		{math.Inf(-1), "f9fc00"},
+	}
+	for _, test := range tests {
+		got := AppendFloat(nil, test.f)
+		if hex.EncodeToString(got) != test.exp {
+			t.Errorf("%v: Expected %s, got %x", test.f, test.exp, got)
+		}
+		v, rest, err := Decode(got)
+		f, ok := v.(float64)
+		if err != nil || len(rest) != 0 || !ok ||
+			!(f == test.f || f != f && test.f != test.f) {
+			t.Errorf("%s: decoded %v, %x, %v", test.exp, v, rest, err)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp interface{}
+	}{
+		{"1903e8", uint64(1000)},
+		{"3903e7", int64(-1000)},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"6449455446", "IETF"},
+		{"8301820203820405", []interface{}{uint64(1),
+			[]interface{}{uint64(2), uint64(3)}, []interface{}{uint64(4), uint64(5)}}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": uint64(1),
+			"b": []interface{}{uint64(2), uint64(3)}}},
+		{"5f42010243030405ff", []byte{1, 2, 3, 4, 5}},
+		{"7f657374726561646d696e67ff", "streaming"},
+		{"9fff", []interface{}{}},
+		{"bf6346756ef563416d7421ff", map[interface{}]interface{}{"Fun": true, "Amt": int64(-2)}},
+		{"c11a514b67b0", Tag{1, uint64(1363896240)}},
+		{"f4", false},
+		{"f6", nil},
+	}
+	for _, test := range tests {
+		in, _ := hex.DecodeString(test.in)
+		v, rest, err := Decode(in)
+		if err != nil || len(rest) != 0 || !reflect.DeepEqual(v, test.exp) {
+			t.Errorf("%s: Expected %#v, got %#v, %x, %v", test.in, test.exp, v, rest, err)
+		}
+	}
+
+	for _, in := range []string{"", "18", "62aa", "5f01ff", "a1800102", "a2616101616102", "1c", "62c328"} {
+		b, _ := hex.DecodeString(in)
+		if v, _, err := Decode(b); err == nil {
+			t.Errorf("%s: Expected error, got %#v", in, v)
+		}
+	}
+	deep := bytes.Repeat([]byte{0x81}, 100)
+	if _, _, err := Decode(append(deep, 0)); err != ErrTooDeep {
+		t.Errorf("Expected ErrTooDeep, got %v", err)
+	}
+}
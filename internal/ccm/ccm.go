@@ -0,0 +1,181 @@
+// Package ccm implements the CCM authenticated encryption mode of
+// RFC 3610 for 128-bit block ciphers.
+package ccm
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+var errOpen = errors.New("ccm: message authentication failed")
+
+type ccm struct {
+	b         cipher.Block
+	tagSize   int
+	nonceSize int
+}
+
+// New returns a CCM AEAD wrapping b, producing tags of tagSize bytes
+// and using nonces of nonceSize bytes.  tagSize must be an even
+// number between 4 and 16; nonceSize must be between 7 and 13.
+func New(b cipher.Block, tagSize, nonceSize int) (cipher.AEAD, error) {
+	if b.BlockSize() != 16 {
+		return nil, errors.New("ccm: block size must be 16 bytes")
+	}
+	if tagSize < 4 || tagSize > 16 || tagSize&1 != 0 {
+		return nil, errors.New("ccm: invalid tag size")
+	}
+	if nonceSize < 7 || nonceSize > 13 {
+		return nil, errors.New("ccm: invalid nonce size")
+	}
+	return &ccm{b: b, tagSize: tagSize, nonceSize: nonceSize}, nil
+}
+
+func (c *ccm) NonceSize() int { return c.nonceSize }
+
+func (c *ccm) Overhead() int { return c.tagSize }
+
+// maxLen returns the largest message length the length field can
+// represent.
+func (c *ccm) maxLen() uint64 {
+	l := 15 - c.nonceSize
+	if l >= 8 {
+		return 1<<63 - 1
+	}
+	return 1<<(8*uint(l)) - 1
+}
+
+func (c *ccm) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != c.nonceSize {
+		panic("ccm: incorrect nonce length")
+	}
+	if uint64(len(plaintext)) > c.maxLen() {
+		panic("ccm: plaintext too large")
+	}
+
+	ret, out := sliceForAppend(dst, len(plaintext)+c.tagSize)
+	tag := c.mac(nonce, plaintext, additionalData)
+	c.ctr(nonce, out[:len(plaintext)], plaintext)
+	c.ctr0(nonce, out[len(plaintext):], tag)
+	return ret
+}
+
+func (c *ccm) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != c.nonceSize {
+		panic("ccm: incorrect nonce length")
+	}
+	if len(ciphertext) < c.tagSize {
+		return nil, errOpen
+	}
+	n := len(ciphertext) - c.tagSize
+	if uint64(n) > c.maxLen() {
+		return nil, errOpen
+	}
+
+	ret, out := sliceForAppend(dst, n)
+	c.ctr(nonce, out, ciphertext[:n])
+	tag := make([]byte, c.tagSize)
+	c.ctr0(nonce, tag, ciphertext[n:])
+
+	if subtle.ConstantTimeCompare(tag, c.mac(nonce, out, additionalData)) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errOpen
+	}
+	return ret, nil
+}
+
+// counterBlock builds the counter block A_i for the given nonce.
+func (c *ccm) counterBlock(nonce []byte, i uint64) []byte {
+	a := make([]byte, 16)
+	a[0] = byte(14 - c.nonceSize)
+	copy(a[1:], nonce)
+	putUint(a[1+c.nonceSize:], i)
+	return a
+}
+
+// ctr0 encrypts src into dst with the key stream block S_0.
+func (c *ccm) ctr0(nonce, dst, src []byte) {
+	s := make([]byte, 16)
+	c.b.Encrypt(s, c.counterBlock(nonce, 0))
+	subtle.XORBytes(dst, src, s[:len(src)])
+}
+
+// ctr encrypts src into dst with the key stream starting at S_1.
+func (c *ccm) ctr(nonce, dst, src []byte) {
+	a := c.counterBlock(nonce, 1)
+	cipher.NewCTR(c.b, a).XORKeyStream(dst, src)
+}
+
+// mac computes the unencrypted CBC-MAC tag T.
+func (c *ccm) mac(nonce, plaintext, additionalData []byte) []byte {
+	b0 := make([]byte, 16)
+	b0[0] = byte((c.tagSize-2)/2)<<3 | byte(14-c.nonceSize)
+	if len(additionalData) > 0 {
+		b0[0] |= 1 << 6
+	}
+	copy(b0[1:], nonce)
+	putUint(b0[1+c.nonceSize:], uint64(len(plaintext)))
+
+	x := make([]byte, 16)
+	c.b.Encrypt(x, b0)
+
+	block := func(data []byte) {
+		for len(data) > 0 {
+			n := subtle.XORBytes(x, x, data)
+			data = data[n:]
+			c.b.Encrypt(x, x)
+		}
+	}
+
+	if len(additionalData) > 0 {
+		var hdr []byte
+		switch {
+		case len(additionalData) < 1<<16-1<<8:
+			hdr = []byte{0, 0}
+			binary.BigEndian.PutUint16(hdr, uint16(len(additionalData)))
+		case uint64(len(additionalData)) < 1<<32:
+			hdr = []byte{0xff, 0xfe, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(hdr[2:], uint32(len(additionalData)))
+		default:
+			hdr = []byte{0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0}
+			binary.BigEndian.PutUint64(hdr[2:], uint64(len(additionalData)))
+		}
+		block(pad(append(hdr, additionalData...)))
+	}
+	if len(plaintext) > 0 {
+		block(pad(plaintext))
+	}
+
+	return x[:c.tagSize]
+}
+
+// pad copies b, zero padded to a multiple of the block size.
+func pad(b []byte) []byte {
+	n := (len(b) + 15) &^ 15
+	rv := make([]byte, n)
+	copy(rv, b)
+	return rv
+}
+
+// putUint writes v big endian into all of b.
+func putUint(b []byte, v uint64) {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+}
+
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
@@ -0,0 +1,79 @@
+package ccm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// RFC 3610 section 8, packet vectors #1 and #2.
+var vectors = []struct {
+	key, nonce, aad, plaintext, ciphertext string
+	tagSize                                int
+}{
+	{
+		key:        "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf",
+		nonce:      "00000003020100a0a1a2a3a4a5",
+		aad:        "0001020304050607",
+		plaintext:  "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e",
+		ciphertext: "588c979a61c663d2f066d0c2c0f989806d5f6b61dac38417e8d12cfdf926e0",
+		tagSize:    8,
+	},
+	{
+		key:        "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf",
+		nonce:      "00000004030201a0a1a2a3a4a5",
+		aad:        "0001020304050607",
+		plaintext:  "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		ciphertext: "72c91a36e135f8cf291ca894085c87e3cc15c439c9e43a3ba091d56e10400916",
+		tagSize:    8,
+	},
+}
+
+func TestVectors(t *testing.T) {
+	for i, v := range vectors {
+		b, err := aes.NewCipher(unhex(v.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := New(b, v.tagSize, len(unhex(v.nonce)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ct := c.Seal(nil, unhex(v.nonce), unhex(v.plaintext), unhex(v.aad))
+		if !bytes.Equal(ct, unhex(v.ciphertext)) {
+			t.Errorf("#%v: expected %x, got %x", i, unhex(v.ciphertext), ct)
+		}
+
+		pt, err := c.Open(nil, unhex(v.nonce), ct, unhex(v.aad))
+		if err != nil {
+			t.Fatalf("#%v: error opening: %v", i, err)
+		}
+		if !bytes.Equal(pt, unhex(v.plaintext)) {
+			t.Errorf("#%v: expected %x, got %x", i, unhex(v.plaintext), pt)
+		}
+
+		ct[0] ^= 1
+		if _, err := c.Open(nil, unhex(v.nonce), ct, unhex(v.aad)); err == nil {
+			t.Errorf("#%v: expected tampered ciphertext to fail", i)
+		}
+	}
+}
+
+func TestInvalidParameters(t *testing.T) {
+	b, _ := aes.NewCipher(make([]byte, 16))
+	for _, tc := range []struct{ tag, nonce int }{{3, 12}, {5, 12}, {18, 12}, {8, 6}, {8, 14}} {
+		if _, err := New(b, tc.tag, tc.nonce); err == nil {
+			t.Errorf("Expected error for tag %v nonce %v", tc.tag, tc.nonce)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Package linkformat implements the CoRE Link Format (RFC 6690) used
+// by CoAP resource discovery.
+package linkformat
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Param is a link parameter.  Parameters without a value, such as
+// obs, have an empty Value.
+type Param struct {
+	Name, Value string
+}
+
+// Link is a link to a resource.
+type Link struct {
+	// Target is the URI reference of the linked resource.  It is
+	// usually relative, such as "/sensors/temp".
+	Target string
+	// Params holds the link parameters in their original order.  A
+	// parameter may occur several times.
+	Params []Param
+}
+
+// Add appends a parameter.
+func (l *Link) Add(name, value string) {
+	l.Params = append(l.Params, Param{name, value})
+}
+
+// Get returns the value of the first parameter with the given name.
+func (l Link) Get(name string) (string, bool) {
+	for _, p := range l.Params {
+		if p.Name == name {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// listParams are the parameters whose values are space-separated
+// lists.
+var listParams = map[string]bool{"rt": true, "if": true, "rel": true, "rev": true, "ct": true}
+
+// Values returns every value of the named parameter.  The values of
+// rt, if, rel, rev and ct are split at spaces.  The target is the
+// value of "href".
+func (l Link) Values(name string) []string {
+	if name == "href" {
+		return []string{l.Target}
+	}
+	var rv []string
+	for _, p := range l.Params {
+		if p.Name != name {
+			continue
+		}
+		if listParams[name] {
+			rv = append(rv, strings.Fields(p.Value)...)
+		} else {
+			rv = append(rv, p.Value)
+		}
+	}
+	return rv
+}
+
+// Match reports whether the link has the parameter name with the given
+// value.  A trailing "*" in value matches any suffix, as in the query
+// filters of RFC 6690 section 4.1.
+func (l Link) Match(name, value string) bool {
+	prefix, wild := strings.CutSuffix(value, "*")
+	for _, v := range l.Values(name) {
+		if v == value || wild && strings.HasPrefix(v, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the absolute URI of the target.  Relative targets
+// are resolved against the anchor parameter, if present, and otherwise
+// against base, normally the URI the links were retrieved from.
+func (l Link) Resolve(base *url.URL) (*url.URL, error) {
+	if anchor, ok := l.Get("anchor"); ok {
+		a, err := url.Parse(anchor)
+		if err != nil {
+			return nil, err
+		}
+		base = base.ResolveReference(a)
+	}
+	t, err := url.Parse(l.Target)
+	if err != nil {
+		return nil, err
+	}
+	return base.ResolveReference(t), nil
+}
+
+// Filter returns the links matching name and value, as in Link.Match.
+func Filter(links []Link, name, value string) []Link {
+	var rv []Link
+	for _, l := range links {
+		if l.Match(name, value) {
+			rv = append(rv, l)
+		}
+	}
+	return rv
+}
+
+func (l Link) String() string {
+	var b strings.Builder
+	b.WriteString("<" + l.Target + ">")
+	for _, p := range l.Params {
+		b.WriteString(";" + p.Name)
+		switch {
+		case p.Value == "":
+		case isDigits(p.Value):
+			b.WriteString("=" + p.Value)
+		default:
+			b.WriteString("=" + quote(p.Value))
+		}
+	}
+	return b.String()
+}
+
+// Marshal encodes links as a link-format document.
+func Marshal(links []Link) []byte {
+	var b strings.Builder
+	for i, l := range links {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.String())
+	}
+	return []byte(b.String())
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// quote returns s as a quoted-string (RFC 2616 section 2.2).
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// SyntaxError describes malformed link-format input.
+type SyntaxError struct {
+	Offset int // byte offset of the error
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("linkformat: %s at offset %d", e.Msg, e.Offset)
+}
+
+// Parse decodes a link-format document.  The parser is strict: it
+// accepts exactly the grammar of RFC 6690 section 2, without
+// whitespace between links or parameters.
+func Parse(data []byte) ([]Link, error) {
+	p := parser{s: string(data)}
+	var rv []Link
+	for p.i < len(p.s) {
+		if len(rv) > 0 && !p.consume(',') {
+			return nil, p.errorf("expected ','")
+		}
+		l, err := p.link()
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, l)
+	}
+	return rv, nil
+}
+
+type parser struct {
+	s string
+	i int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Offset: p.i, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) consume(c byte) bool {
+	if p.i < len(p.s) && p.s[p.i] == c {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) link() (Link, error) {
+	var l Link
+	if !p.consume('<') {
+		return l, p.errorf("expected '<'")
+	}
+	end := strings.IndexByte(p.s[p.i:], '>')
+	if end < 0 {
+		return l, p.errorf("unterminated URI reference")
+	}
+	l.Target = p.s[p.i : p.i+end]
+	if _, err := url.Parse(l.Target); err != nil {
+		return l, p.errorf("invalid URI reference %q", l.Target)
+	}
+	p.i += end + 1
+
+	for p.consume(';') {
+		name := p.span(isParmnameChar)
+		if name == "" {
+			return l, p.errorf("expected parameter name")
+		}
+		value := ""
+		if p.consume('=') {
+			var err error
+			if value, err = p.value(); err != nil {
+				return l, err
+			}
+		}
+		l.Add(name, value)
+	}
+	return l, nil
+}
+
+func (p *parser) value() (string, error) {
+	if !p.consume('"') {
+		v := p.span(isPtokenChar)
+		if v == "" {
+			return "", p.errorf("expected parameter value")
+		}
+		return v, nil
+	}
+	var b strings.Builder
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		p.i++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.i == len(p.s) {
+				return "", p.errorf("unterminated quoted-string")
+			}
+			c = p.s[p.i]
+			p.i++
+		}
+		b.WriteByte(c)
+	}
+	return "", p.errorf("unterminated quoted-string")
+}
+
+// span consumes the longest run of bytes satisfying f.
+func (p *parser) span(f func(byte) bool) string {
+	start := p.i
+	for p.i < len(p.s) && f(p.s[p.i]) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// isParmnameChar reports whether c may occur in a parameter name
+// (RFC 5987 attr-char).
+func isParmnameChar(c byte) bool {
+	return isAlnum(c) || strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
+
+// isPtokenChar reports whether c may occur in an unquoted value.
+func isPtokenChar(c byte) bool {
+	return isAlnum(c) || strings.IndexByte("!#$%&'()*+-./:<=>?@[]^_`{|}~", c) >= 0
+}
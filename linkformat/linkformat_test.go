@@ -0,0 +1,102 @@
+package linkformat
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	// RFC 6690 section 5 examples, with a few edge cases.
+	in := `</sensors>;ct=40;title="Sensor Index",` +
+		`</sensors/temp>;rt="temperature-c";if="sensor",` +
+		`</sensors/light>;rt="light-lux core.s";if=sensor;obs,` +
+		`<http://www.example.com/sensors/t123>;anchor="/sensors/temp";rel="describedby",` +
+		`</t>;anchor="/sensors/temp";rel="alternate";title="say \"hi\" \\ bye"`
+	links, err := Parse([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []Link{
+		{"/sensors", []Param{{"ct", "40"}, {"title", "Sensor Index"}}},
+		{"/sensors/temp", []Param{{"rt", "temperature-c"}, {"if", "sensor"}}},
+		{"/sensors/light", []Param{{"rt", "light-lux core.s"}, {"if", "sensor"}, {"obs", ""}}},
+		{"http://www.example.com/sensors/t123", []Param{{"anchor", "/sensors/temp"}, {"rel", "describedby"}}},
+		{"/t", []Param{{"anchor", "/sensors/temp"}, {"rel", "alternate"}, {"title", `say "hi" \ bye`}}},
+	}
+	if !reflect.DeepEqual(links, exp) {
+		t.Fatalf("Expected %#v\ngot %#v", exp, links)
+	}
+
+	if got := links[2].Values("rt"); !reflect.DeepEqual(got, []string{"light-lux", "core.s"}) {
+		t.Errorf("rt values: %q", got)
+	}
+	if got := Filter(links, "rt", "core.*"); len(got) != 1 || got[0].Target != "/sensors/light" {
+		t.Errorf("Filter rt=core.*: %v", got)
+	}
+	if got := Filter(links, "href", "/sensors/*"); len(got) != 2 {
+		t.Errorf("Filter href=/sensors/*: %v", got)
+	}
+
+	links, err = Parse(nil)
+	if err != nil || links != nil {
+		t.Errorf("Parse(nil) = %v, %v", links, err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, in := range []string{
+		`/a`,
+		`</a`,
+		`</a>;`,
+		`</a>;x=`,
+		`</a>;x="open`,
+		`</a>,`,
+		`</a> ,</b>`,
+		`</a>;x=a b`,
+		`</a>;x=a,b`,
+		`</a>;x=a;`,
+	} {
+		_, err := Parse([]byte(in))
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("%q: Expected syntax error, got %v", in, err)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	links := []Link{
+		{"/sensors/temp", []Param{{"rt", "temperature-c"}, {"ct", "0"}, {"obs", ""}}},
+		{"/x", []Param{{"title", `a "b"`}, {"ct", "0 50"}}},
+	}
+	exp := `</sensors/temp>;rt="temperature-c";ct=0;obs,</x>;title="a \"b\"";ct="0 50"`
+	got := Marshal(links)
+	if string(got) != exp {
+		t.Errorf("Expected %s\ngot      %s", exp, got)
+	}
+	back, err := Parse(got)
+	if err != nil || !reflect.DeepEqual(back, links) {
+		t.Errorf("Round trip: %v, %v", back, err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	base, _ := url.Parse("coap://[2001:db8::1]/.well-known/core")
+	tests := []struct {
+		link Link
+		exp  string
+	}{
+		{Link{Target: "/sensors/temp"}, "coap://[2001:db8::1]/sensors/temp"},
+		{Link{Target: "temp"}, "coap://[2001:db8::1]/.well-known/temp"},
+		{Link{Target: "coap://other/x"}, "coap://other/x"},
+		{Link{Target: "t", Params: []Param{{"anchor", "/sensors/"}}}, "coap://[2001:db8::1]/sensors/t"},
+	}
+	for _, test := range tests {
+		u, err := test.link.Resolve(base)
+		if err != nil || u.String() != test.exp {
+			t.Errorf("%v: Expected %s, got %v, %v", test.link, test.exp, u, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package coap
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// MediaType specifies the content type of a message, as a CoAP
+// Content-Format identifier.
+type MediaType uint16
+
+// Content types from the IANA CoAP Content-Formats registry.
+const (
+	TextPlain           MediaType = 0     // text/plain;charset=utf-8
+	AppCOSEEncrypt0     MediaType = 16    // application/cose; cose-type="cose-encrypt0"
+	AppCOSEMac0         MediaType = 17    // application/cose; cose-type="cose-mac0"
+	AppCOSESign1        MediaType = 18    // application/cose; cose-type="cose-sign1"
+	AppACECBOR          MediaType = 19    // application/ace+cbor
+	ImageGIF            MediaType = 21    // image/gif
+	ImageJPEG           MediaType = 22    // image/jpeg
+	ImagePNG            MediaType = 23    // image/png
+	AppLinkFormat       MediaType = 40    // application/link-format
+	AppXML              MediaType = 41    // application/xml
+	AppOctets           MediaType = 42    // application/octet-stream
+	AppExi              MediaType = 47    // application/exi
+	AppJSON             MediaType = 50    // application/json
+	AppJSONPatch        MediaType = 51    // application/json-patch+json
+	AppMergePatch       MediaType = 52    // application/merge-patch+json
+	AppCBOR             MediaType = 60    // application/cbor
+	AppCWT              MediaType = 61    // application/cwt
+	AppMultipartCore    MediaType = 62    // application/multipart-core
+	AppCBORSeq          MediaType = 63    // application/cbor-seq
+	AppCOSEEncrypt      MediaType = 96    // application/cose; cose-type="cose-encrypt"
+	AppCOSEMac          MediaType = 97    // application/cose; cose-type="cose-mac"
+	AppCOSESign         MediaType = 98    // application/cose; cose-type="cose-sign"
+	AppCOSEKey          MediaType = 101   // application/cose-key
+	AppCOSEKeySet       MediaType = 102   // application/cose-key-set
+	AppSenMLJSON        MediaType = 110   // application/senml+json
+	AppSensMLJSON       MediaType = 111   // application/sensml+json
+	AppSenMLCBOR        MediaType = 112   // application/senml+cbor
+	AppSensMLCBOR       MediaType = 113   // application/sensml+cbor
+	AppSenMLExi         MediaType = 114   // application/senml-exi
+	AppSensMLExi        MediaType = 115   // application/sensml-exi
+	AppYANGDataCBORSID  MediaType = 140   // application/yang-data+cbor; id=sid
+	AppCoAPGroupJSON    MediaType = 256   // application/coap-group+json
+	AppProblemDetails   MediaType = 257   // application/concise-problem-details+cbor
+	AppSWIDCBOR         MediaType = 258   // application/swid+cbor
+	AppDOTSCBOR         MediaType = 271   // application/dots+cbor
+	AppMissingBlocks    MediaType = 272   // application/missing-blocks+cbor-seq
+	AppPKCS7ServerKey   MediaType = 280   // application/pkcs7-mime; smime-type=server-generated-key
+	AppPKCS7CertsOnly   MediaType = 281   // application/pkcs7-mime; smime-type=certs-only
+	AppPKCS8            MediaType = 284   // application/pkcs8
+	AppCSRAttrs         MediaType = 285   // application/csrattrs
+	AppPKCS10           MediaType = 286   // application/pkcs10
+	AppPKIXCert         MediaType = 287   // application/pkix-cert
+	AppSenMLXML         MediaType = 310   // application/senml+xml
+	AppSensMLXML        MediaType = 311   // application/sensml+xml
+	AppSenMLEtchJSON    MediaType = 320   // application/senml-etch+json
+	AppSenMLEtchCBOR    MediaType = 322   // application/senml-etch+cbor
+	AppYANGDataCBOR     MediaType = 340   // application/yang-data+cbor
+	AppYANGDataCBORName MediaType = 341   // application/yang-data+cbor; id=name
+	AppTDJSON           MediaType = 432   // application/td+json
+	AppTMJSON           MediaType = 433   // application/tm+json
+	AppOCFCBOR          MediaType = 10000 // application/vnd.ocf+cbor
+	AppOSCORE           MediaType = 10001 // application/oscore
+	AppJavaScript       MediaType = 10002 // application/javascript
+	AppLwM2MTLV         MediaType = 11542 // application/vnd.oma.lwm2m+tlv
+	AppLwM2MJSON        MediaType = 11543 // application/vnd.oma.lwm2m+json
+	AppLwM2MCBOR        MediaType = 11544 // application/vnd.oma.lwm2m+cbor
+	TextCSS             MediaType = 20000 // text/css
+	ImageSVGXML         MediaType = 30000 // image/svg+xml
+)
+
+var mediaTypeNames = map[MediaType]string{
+	TextPlain:           "text/plain; charset=utf-8",
+	AppCOSEEncrypt0:     `application/cose; cose-type="cose-encrypt0"`,
+	AppCOSEMac0:         `application/cose; cose-type="cose-mac0"`,
+	AppCOSESign1:        `application/cose; cose-type="cose-sign1"`,
+	AppACECBOR:          "application/ace+cbor",
+	ImageGIF:            "image/gif",
+	ImageJPEG:           "image/jpeg",
+	ImagePNG:            "image/png",
+	AppLinkFormat:       "application/link-format",
+	AppXML:              "application/xml",
+	AppOctets:           "application/octet-stream",
+	AppExi:              "application/exi",
+	AppJSON:             "application/json",
+	AppJSONPatch:        "application/json-patch+json",
+	AppMergePatch:       "application/merge-patch+json",
+	AppCBOR:             "application/cbor",
+	AppCWT:              "application/cwt",
+	AppMultipartCore:    "application/multipart-core",
+	AppCBORSeq:          "application/cbor-seq",
+	AppCOSEEncrypt:      `application/cose; cose-type="cose-encrypt"`,
+	AppCOSEMac:          `application/cose; cose-type="cose-mac"`,
+	AppCOSESign:         `application/cose; cose-type="cose-sign"`,
+	AppCOSEKey:          "application/cose-key",
+	AppCOSEKeySet:       "application/cose-key-set",
+	AppSenMLJSON:        "application/senml+json",
+	AppSensMLJSON:       "application/sensml+json",
+	AppSenMLCBOR:        "application/senml+cbor",
+	AppSensMLCBOR:       "application/sensml+cbor",
+	AppSenMLExi:         "application/senml-exi",
+	AppSensMLExi:        "application/sensml-exi",
+	AppYANGDataCBORSID:  "application/yang-data+cbor; id=sid",
+	AppCoAPGroupJSON:    "application/coap-group+json",
+	AppProblemDetails:   "application/concise-problem-details+cbor",
+	AppSWIDCBOR:         "application/swid+cbor",
+	AppDOTSCBOR:         "application/dots+cbor",
+	AppMissingBlocks:    "application/missing-blocks+cbor-seq",
+	AppPKCS7ServerKey:   "application/pkcs7-mime; smime-type=server-generated-key",
+	AppPKCS7CertsOnly:   "application/pkcs7-mime; smime-type=certs-only",
+	AppPKCS8:            "application/pkcs8",
+	AppCSRAttrs:         "application/csrattrs",
+	AppPKCS10:           "application/pkcs10",
+	AppPKIXCert:         "application/pkix-cert",
+	AppSenMLXML:         "application/senml+xml",
+	AppSensMLXML:        "application/sensml+xml",
+	AppSenMLEtchJSON:    "application/senml-etch+json",
+	AppSenMLEtchCBOR:    "application/senml-etch+cbor",
+	AppYANGDataCBOR:     "application/yang-data+cbor",
+	AppYANGDataCBORName: "application/yang-data+cbor; id=name",
+	AppTDJSON:           "application/td+json",
+	AppTMJSON:           "application/tm+json",
+	AppOCFCBOR:          "application/vnd.ocf+cbor",
+	AppOSCORE:           "application/oscore",
+	AppJavaScript:       "application/javascript",
+	AppLwM2MTLV:         "application/vnd.oma.lwm2m+tlv",
+	AppLwM2MJSON:        "application/vnd.oma.lwm2m+json",
+	AppLwM2MCBOR:        "application/vnd.oma.lwm2m+cbor",
+	TextCSS:             "text/css",
+	ImageSVGXML:         "image/svg+xml",
+}
+
+// String returns the MIME type of a registered content format.
+func (t MediaType) String() string {
+	if s, ok := mediaTypeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown (%d)", uint16(t))
+}
+
+// ParseMediaType returns the content format registered for a MIME
+// type, such as "application/senml+json".  Type, subtype and parameter
+// names are case-insensitive, and text/plain defaults to UTF-8.
+func ParseMediaType(s string) (MediaType, error) {
+	mt, params, err := mime.ParseMediaType(s)
+	if err != nil {
+		return 0, err
+	}
+	if mt == "text/plain" {
+		if cs, ok := params["charset"]; !ok || strings.EqualFold(cs, "utf-8") {
+			delete(params, "charset")
+			if len(params) == 0 {
+				return TextPlain, nil
+			}
+		}
+	}
+	for t, name := range mediaTypeNames {
+		rmt, rparams, _ := mime.ParseMediaType(name)
+		if rmt == mt && sameParams(rparams, params) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unregistered media type %q", s)
+}
+
+func sameParams(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if !strings.EqualFold(b[k], v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package coap
+
+import (
+	"testing"
+)
+
+func TestMediaTypeString(t *testing.T) {
+	tests := map[MediaType]string{
+		TextPlain:    "text/plain; charset=utf-8",
+		AppSenMLCBOR: "application/senml+cbor",
+		AppLwM2MTLV:  "application/vnd.oma.lwm2m+tlv",
+		AppCOSESign1: `application/cose; cose-type="cose-sign1"`,
+		65000:        "Unknown (65000)",
+	}
+	for mt, exp := range tests {
+		if got := mt.String(); got != exp {
+			t.Errorf("Expected %q, got %q", exp, got)
+		}
+	}
+}
+
+func TestParseMediaType(t *testing.T) {
+	tests := map[string]MediaType{
+		"text/plain":                            TextPlain,
+		"text/plain; charset=UTF-8":             TextPlain,
+		"Application/SenML+JSON":                AppSenMLJSON,
+		"application/cose; cose-type=cose-mac0": AppCOSEMac0,
+		"application/yang-data+cbor":            AppYANGDataCBOR,
+		"application/yang-data+cbor;id=sid":     AppYANGDataCBORSID,
+		"application/vnd.oma.lwm2m+json":        AppLwM2MJSON,
+	}
+	for s, exp := range tests {
+		got, err := ParseMediaType(s)
+		if err != nil || got != exp {
+			t.Errorf("%q: Expected %v, got %v, %v", s, exp, got, err)
+		}
+	}
+
+	for _, s := range []string{"", "text/plain; charset=latin1", "application/cose", "foo/bar"} {
+		if got, err := ParseMediaType(s); err == nil {
+			t.Errorf("%q: Expected error, got %v", s, got)
+		}
+	}
+
+	// Every registered name parses back to its content format.
+	for mt, name := range mediaTypeNames {
+		if got, err := ParseMediaType(name); err != nil || got != mt {
+			t.Errorf("%q: Expected %d, got %v, %v", name, mt, got, err)
+		}
+	}
+}
+
+func TestWideMediaTypeOption(t *testing.T) {
+	m := Message{Type: Confirmable, Code: GET}
+	m.SetOption(Accept, AppLwM2MCBOR)
+	d, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseMessage(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parsed.Option(Accept); got != AppLwM2MCBOR {
+		t.Errorf("Expected %v, got %v", AppLwM2MCBOR, got)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"net/url"
 	"reflect"
 	"sort"
 	"strings"
@@ -69,6 +70,7 @@ const (
 	POST   COAPCode = 2
 	PUT    COAPCode = 3
 	DELETE COAPCode = 4
+	FETCH  COAPCode = 5
 
 	// Response Codes
 
@@ -101,6 +103,7 @@ const (
 	ServiceUnavailable   COAPCode = 163 // 5.03
 	GatewayTimeout       COAPCode = 164 // 5.04
 	ProxyingNotSupported COAPCode = 165 // 5.05
+	HopLimitReached      COAPCode = 168 // 5.08
 )
 
 var codeNames = [256]string{
@@ -108,11 +111,13 @@ var codeNames = [256]string{
 	POST:                     "POST",
 	PUT:                      "PUT",
 	DELETE:                   "DELETE",
+	FETCH:                    "FETCH",
 	Created:                  "Created",
 	Deleted:                  "Deleted",
 	Valid:                    "Valid",
 	Changed:                  "Changed",
 	Content:                  "Content",
+	Continue:                 "Continue",
 	BadRequest:               "BadRequest",
 	Unauthorized:             "Unauthorized",
 	BadOption:                "BadOption",
@@ -120,6 +125,7 @@ var codeNames = [256]string{
 	NotFound:                 "NotFound",
 	MethodNotAllowed:         "MethodNotAllowed",
 	NotAcceptable:            "NotAcceptable",
+	RequestEntityIncomplete:  "RequestEntityIncomplete",
 	PreconditionFailed:       "PreconditionFailed",
 	RequestEntityTooLarge:    "RequestEntityTooLarge",
 	UnsupportedContentFormat: "UnsupportedContentFormat",
@@ -129,6 +135,7 @@ var codeNames = [256]string{
 	ServiceUnavailable:       "ServiceUnavailable",
 	GatewayTimeout:           "GatewayTimeout",
 	ProxyingNotSupported:     "ProxyingNotSupported",
+	HopLimitReached:          "HopLimitReached",
 }
 
 func init() {
@@ -155,7 +162,7 @@ var (
 )
 
 // OptionID identifies an option in a message.
-type OptionID uint8
+type OptionID uint16
 
 /*
    +-----+----+---+---+---+----------------+--------+--------+-------------+
@@ -168,18 +175,25 @@ type OptionID uint8
    |   6 |    | x | - |   | Observe        | uint   | 0-3    | (none)      |
    |   7 | x  | x | - |   | Uri-Port       | uint   | 0-2    | (see below) |
    |   8 |    |   |   | x | Location-Path  | string | 0-255  | (none)      |
+   |   9 | x  |   |   |   | OSCORE         | opaque | 0-255  | (none)      |
    |  11 | x  | x | - | x | Uri-Path       | string | 0-255  | (none)      |
    |  12 |    |   |   |   | Content-Format | uint   | 0-2    | (none)      |
    |  14 |    | x | - |   | Max-Age        | uint   | 0-4    | 60          |
    |  15 | x  | x | - | x | Uri-Query      | string | 0-255  | (none)      |
+   |  16 |    |   |   |   | Hop-Limit      | uint   | 1      | 16          |
    |  17 | x  |   |   |   | Accept         | uint   | 0-2    | (none)      |
+   |  19 | x  | x | - |   | Q-Block1       | uint   | 0-3    | (none)      |
    |  20 |    |   |   | x | Location-Query | string | 0-255  | (none)      |
    |  23 |    |   | - | - | Block2         | uint   | 0-3    | (none)      |
    |  27 |    |   | - | - | Block1         | uint   | 0-3    | (none)      |
    |  28 |    |   | x |   | Size2          | uint   | 0-4    | (none)      |
+   |  31 | x  | x | - | x | Q-Block2       | uint   | 0-3    | (none)      |
    |  35 | x  | x | - |   | Proxy-Uri      | string | 1-1034 | (none)      |
    |  39 | x  | x | - |   | Proxy-Scheme   | string | 1-255  | (none)      |
    |  60 |    |   | x |   | Size1          | uint   | 0-4    | (none)      |
+   | 252 |    |   | x |   | Echo           | opaque | 1-40   | (none)      |
+   | 258 |    | x | - |   | No-Response    | uint   | 0-1    | 0           |
+   | 292 |    |   |   | x | Request-Tag    | opaque | 0-8    | (none)      |
    +-----+----+---+---+---+----------------+--------+--------+-------------+
 */
 
@@ -192,18 +206,25 @@ const (
 	Observe       OptionID = 6
 	URIPort       OptionID = 7
 	LocationPath  OptionID = 8
+	OSCORE        OptionID = 9
 	URIPath       OptionID = 11
 	ContentFormat OptionID = 12
 	MaxAge        OptionID = 14
 	URIQuery      OptionID = 15
+	HopLimit      OptionID = 16
 	Accept        OptionID = 17
+	QBlock1       OptionID = 19
 	LocationQuery OptionID = 20
 	Block2        OptionID = 23
 	Block1        OptionID = 27
 	Size2         OptionID = 28
+	QBlock2       OptionID = 31
 	ProxyURI      OptionID = 35
 	ProxyScheme   OptionID = 39
 	Size1         OptionID = 60
+	Echo          OptionID = 252
+	NoResponse    OptionID = 258
+	RequestTag    OptionID = 292
 )
 
 // Option value format (RFC7252 section 3.2)
@@ -223,7 +244,7 @@ type optionDef struct {
 	maxLen      int
 }
 
-var optionDefs = [256]optionDef{
+var optionDefs = map[OptionID]optionDef{
 	IfMatch:       optionDef{valueFormat: valueOpaque, minLen: 0, maxLen: 8},
 	URIHost:       optionDef{valueFormat: valueString, minLen: 1, maxLen: 255},
 	ETag:          optionDef{valueFormat: valueOpaque, minLen: 1, maxLen: 8},
@@ -231,33 +252,27 @@ var optionDefs = [256]optionDef{
 	Observe:       optionDef{valueFormat: valueUint, minLen: 0, maxLen: 3},
 	URIPort:       optionDef{valueFormat: valueUint, minLen: 0, maxLen: 2},
 	LocationPath:  optionDef{valueFormat: valueString, minLen: 0, maxLen: 255},
+	OSCORE:        optionDef{valueFormat: valueOpaque, minLen: 0, maxLen: 255},
 	URIPath:       optionDef{valueFormat: valueString, minLen: 0, maxLen: 255},
 	ContentFormat: optionDef{valueFormat: valueUint, minLen: 0, maxLen: 2},
 	MaxAge:        optionDef{valueFormat: valueUint, minLen: 0, maxLen: 4},
 	URIQuery:      optionDef{valueFormat: valueString, minLen: 0, maxLen: 255},
+	HopLimit:      optionDef{valueFormat: valueUint, minLen: 1, maxLen: 1},
 	Accept:        optionDef{valueFormat: valueUint, minLen: 0, maxLen: 2},
+	QBlock1:       optionDef{valueFormat: valueUint, minLen: 0, maxLen: 3},
 	LocationQuery: optionDef{valueFormat: valueString, minLen: 0, maxLen: 255},
 	Block2:        optionDef{valueFormat: valueUint, minLen: 0, maxLen: 3},
 	Block1:        optionDef{valueFormat: valueUint, minLen: 0, maxLen: 3},
 	Size2:         optionDef{valueFormat: valueUint, minLen: 0, maxLen: 4},
+	QBlock2:       optionDef{valueFormat: valueUint, minLen: 0, maxLen: 3},
 	ProxyURI:      optionDef{valueFormat: valueString, minLen: 1, maxLen: 1034},
 	ProxyScheme:   optionDef{valueFormat: valueString, minLen: 1, maxLen: 255},
 	Size1:         optionDef{valueFormat: valueUint, minLen: 0, maxLen: 4},
+	Echo:          optionDef{valueFormat: valueOpaque, minLen: 1, maxLen: 40},
+	NoResponse:    optionDef{valueFormat: valueUint, minLen: 0, maxLen: 1},
+	RequestTag:    optionDef{valueFormat: valueOpaque, minLen: 0, maxLen: 8},
 }
 
-// MediaType specifies the content type of a message.
-type MediaType byte
-
-// Content types.
-const (
-	TextPlain     MediaType = 0  // text/plain;charset=utf-8
-	AppLinkFormat MediaType = 40 // application/link-format
-	AppXML        MediaType = 41 // application/xml
-	AppOctets     MediaType = 42 // application/octet-stream
-	AppExi        MediaType = 47 // application/exi
-	AppJSON       MediaType = 50 // application/json
-)
-
 type option struct {
 	ID    OptionID
 	Value interface{}
@@ -387,6 +402,11 @@ type Message struct {
 	Token, Payload []byte
 
 	opts options
+
+	// pathValues holds the parameters captured by a ServeMux
+	// pattern.  It is replaced, never modified, so that copies of
+	// the message do not share updates.
+	pathValues map[string]string
 }
 
 // IsConfirmable returns true if this message is confirmable.
@@ -407,6 +427,21 @@ func (m Message) Options(o OptionID) []interface{} {
 	return rv
 }
 
+// OptionIDs returns the IDs of the options present in m, in ascending
+// order.
+func (m Message) OptionIDs() []OptionID {
+	var rv []OptionID
+	for _, o := range m.opts {
+		i := sort.Search(len(rv), func(i int) bool { return rv[i] >= o.ID })
+		if i == len(rv) || rv[i] != o.ID {
+			rv = append(rv, 0)
+			copy(rv[i+1:], rv[i:])
+			rv[i] = o.ID
+		}
+	}
+	return rv
+}
+
 // Option gets the first value for the given option ID.
 func (m Message) Option(o OptionID) interface{} {
 	for _, v := range m.opts {
@@ -435,6 +470,58 @@ func (m Message) PathString() string {
 	return strings.Join(m.Path(), "/")
 }
 
+// Query parses the Uri-Query options of this message.  Options of the
+// form key=value are split at the first "=", and options without one
+// have an empty value.  Unlike URL queries, the options are not
+// percent-encoded.
+func (m Message) Query() url.Values {
+	q := url.Values{}
+	for _, s := range m.optionStrings(URIQuery) {
+		k, v, _ := strings.Cut(s, "=")
+		q[k] = append(q[k], v)
+	}
+	return q
+}
+
+// SetQuery replaces the Uri-Query options of this message with q,
+// sorted by key.  Empty values are sent as the bare key.
+func (m *Message) SetQuery(q url.Values) {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var opts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			if v == "" {
+				opts = append(opts, k)
+			} else {
+				opts = append(opts, k+"="+v)
+			}
+		}
+	}
+	m.SetOption(URIQuery, opts)
+}
+
+// PathValue returns the value of the named path parameter captured by
+// the ServeMux pattern that matched this message, or "" if there is
+// none.
+func (m Message) PathValue(name string) string {
+	return m.pathValues[name]
+}
+
+// SetPathValue sets the named path parameter to value.
+func (m *Message) SetPathValue(name, value string) {
+	vals := make(map[string]string, len(m.pathValues)+1)
+	for k, v := range m.pathValues {
+		vals[k] = v
+	}
+	vals[name] = value
+	m.pathValues = vals
+}
+
 // SetPathString sets a path by a / separated string.
 func (m *Message) SetPathString(s string) {
 	for s[0] == '/' {
@@ -671,6 +758,9 @@ func (m *Message) UnmarshalBinary(data []byte) error {
 			return ErrTruncated
 		}
 
+		if prev+delta > 0xffff {
+			return ErrOptionGapTooLarge
+		}
 		oid := OptionID(prev + delta)
 		opval := parseOptionValue(oid, b[:length])
 		b = b[length:]
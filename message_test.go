@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding"
 	"fmt"
+	"net/url"
 	"reflect"
 	"testing"
 )
@@ -418,6 +419,23 @@ func TestPathAsOption(t *testing.T) {
 	}
 }
 
+func TestQuery(t *testing.T) {
+	m := &Message{Type: Confirmable, Code: GET}
+	m.AddOption(URIQuery, "rt=temperature")
+	m.AddOption(URIQuery, "if")
+	m.AddOption(URIQuery, "rt=a=b")
+	exp := url.Values{"rt": {"temperature", "a=b"}, "if": {""}}
+	if got := m.Query(); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	m.SetQuery(url.Values{"b": {"1", "2"}, "a": {""}})
+	expOpts := []interface{}{"a", "b=1", "b=2"}
+	if got := m.Options(URIQuery); !reflect.DeepEqual(got, expOpts) {
+		t.Errorf("Expected %v, got %v", expOpts, got)
+	}
+}
+
 func TestEncodePath14(t *testing.T) {
 	req := Message{
 		Type:      Confirmable,
@@ -781,3 +799,29 @@ func TestEncodeMessageWithAllOptions(t *testing.T) {
 	}
 	assertEqualMessages(t, req, parsedMsg)
 }
+
+func TestWideOptionID(t *testing.T) {
+	m := Message{Type: NonConfirmable, Code: POST, MessageID: 1}
+	m.SetOption(NoResponse, uint32(NoResponse2xx))
+	m.SetOption(ContentFormat, TextPlain)
+	b, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Option(NoResponse) != uint32(NoResponse2xx) {
+		t.Errorf("No-Response = %v", got.Option(NoResponse))
+	}
+	if ids := got.OptionIDs(); len(ids) != 2 || ids[0] != ContentFormat || ids[1] != NoResponse {
+		t.Errorf("OptionIDs = %v", ids)
+	}
+
+	// Option numbers beyond 65535 are malformed.
+	bad := []byte{0x40, 0x01, 0, 0, 0xe0, 0xff, 0xff, 0xe0, 0xff, 0xff}
+	if _, err := ParseMessage(bad); err != ErrOptionGapTooLarge {
+		t.Errorf("ParseMessage = %v, want %v", err, ErrOptionGapTooLarge)
+	}
+}
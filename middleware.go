@@ -0,0 +1,37 @@
+package coap
+
+import (
+	"log"
+	"net"
+	"runtime/debug"
+)
+
+// Middleware wraps a Handler with behaviour common to many handlers,
+// such as logging, authorization or metrics.
+type Middleware func(Handler) Handler
+
+// Chain combines middleware into one.  The first middleware is the
+// outermost.
+func Chain(mws ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			h = mws[i](h)
+		}
+		return h
+	}
+}
+
+// Recover is middleware that turns a panic in the wrapped handler into
+// a 5.00 Internal Server Error response, non-confirmable requests
+// included.  The panic and a stack trace are logged.
+func Recover(h Handler) Handler {
+	return funcHandler(func(l Transport, a net.Addr, m *Message) (rv *Message) {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Printf("coap: panic serving %v: %v\n%s", a, err, debug.Stack())
+				rv = replyTo(m, InternalServerError)
+			}
+		}()
+		return h.ServeCOAP(l, a, m)
+	})
+}
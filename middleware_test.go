@@ -0,0 +1,74 @@
+package coap
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	var trace []string
+	mw := func(name string) Middleware {
+		return func(h Handler) Handler {
+			return FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+				trace = append(trace, name)
+				return h.ServeCOAP(l, a, m)
+			})
+		}
+	}
+	ok := func(l Transport, a net.Addr, m *Message) *Message {
+		trace = append(trace, "handler")
+		return &Message{Type: Acknowledgement, Code: Content}
+	}
+
+	mux := NewServeMux()
+	mux.Use(mw("outer"), mw("inner"))
+	mux.HandleFunc("plain", ok)
+	mux.With(mw("group")).HandleMethodFunc(GET, "grouped", ok)
+
+	for _, test := range []struct {
+		path string
+		exp  []string
+	}{
+		{"plain", []string{"outer", "inner", "handler"}},
+		{"grouped", []string{"outer", "inner", "group", "handler"}},
+		{"missing", []string{"outer", "inner"}},
+	} {
+		trace = nil
+		req := &Message{Type: Confirmable, Code: GET}
+		req.SetPathString(test.path)
+		mux.ServeCOAP(nil, nil, req)
+		if !reflect.DeepEqual(trace, test.exp) {
+			t.Errorf("%s: Expected %v, got %v", test.path, test.exp, trace)
+		}
+	}
+}
+
+func TestRecover(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	mux := NewServeMux()
+	mux.Use(Recover)
+	mux.HandleFunc("boom", func(l Transport, a net.Addr, m *Message) *Message {
+		panic("boom")
+	})
+
+	req := &Message{Type: Confirmable, Code: GET, MessageID: 9, Token: []byte("t")}
+	req.SetPathString("boom")
+	rv := mux.ServeCOAP(nil, nil, req)
+	if rv == nil || rv.Code != InternalServerError || rv.MessageID != 9 ||
+		string(rv.Token) != "t" {
+		t.Errorf("Expected 5.00 acknowledgement, got %v", rv)
+	}
+
+	req.Type = NonConfirmable
+	rv = mux.ServeCOAP(nil, nil, req)
+	if rv == nil || rv.Code != InternalServerError || rv.Type != NonConfirmable ||
+		string(rv.Token) != "t" {
+		t.Errorf("Expected 5.00 non-confirmable response, got %v", rv)
+	}
+}
@@ -0,0 +1,259 @@
+package coap
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// All-CoAP-Nodes multicast addresses (RFC 7252 section 12.8).
+const (
+	AllCoAPNodesIPv4          = "224.0.1.187"
+	AllCoAPNodesIPv6LinkLocal = "ff02::fd"
+	AllCoAPNodesIPv6SiteLocal = "ff05::fd"
+)
+
+// MulticastConfig configures a multicast listener.
+type MulticastConfig struct {
+	// Interface is the interface on which groups are joined.  If
+	// nil, the system chooses one.
+	Interface *net.Interface
+	// Port is the port requests are sent to.  If zero, DefaultPort
+	// is used.
+	Port int
+	// Groups are the multicast addresses to join.  If empty, the
+	// All-CoAP-Nodes groups are joined: 224.0.1.187, ff02::fd and
+	// ff05::fd, skipping those of an address family the host lacks.
+	Groups []string
+	// Leisure bounds the random delay before responding to a
+	// multicast request (RFC 7252 section 8.2).  If zero,
+	// DefaultLeisure seconds are used; it must not be negative.
+	Leisure time.Duration
+	// Reply is the transport responses are sent from, normally the
+	// server's unicast listener, so that clients can follow up at the
+	// address that answered.  If nil, an ephemeral UDP socket is
+	// used.
+	Reply Transport
+}
+
+// multicastConn is a Transport receiving requests sent to multicast
+// groups and replying from a unicast address.
+type multicastConn struct {
+	conns     []*net.UDPConn
+	reply     Transport
+	ownReply  bool
+	leisure   time.Duration
+	rx        chan datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+type datagram struct {
+	b    []byte
+	addr net.Addr
+	err  error
+}
+
+// ListenMulticast returns a Transport receiving requests sent to the
+// multicast groups of cfg.  Serve treats such requests as RFC 7252
+// section 8.2 requires: confirmable requests are ignored, error
+// responses and empty 2.05 responses are suppressed, and responses are
+// sent after a random delay within the leisure.
+func ListenMulticast(cfg MulticastConfig) (Transport, error) {
+	if cfg.Leisure < 0 {
+		return nil, errors.New("negative multicast leisure")
+	}
+	groups, defaults := cfg.Groups, len(cfg.Groups) == 0
+	if defaults {
+		groups = []string{AllCoAPNodesIPv4, AllCoAPNodesIPv6LinkLocal, AllCoAPNodesIPv6SiteLocal}
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	mc := &multicastConn{
+		reply:   cfg.Reply,
+		leisure: cfg.Leisure,
+		rx:      make(chan datagram),
+		closed:  make(chan struct{}),
+	}
+	if mc.leisure == 0 {
+		mc.leisure = DefaultLeisure * time.Second
+	}
+
+	var joinErr error
+	for _, g := range groups {
+		ip := net.ParseIP(g)
+		if ip == nil || !ip.IsMulticast() {
+			mc.Close()
+			return nil, errors.New("not a multicast address: " + g)
+		}
+		c, err := listenGroup(cfg.Interface, ip, port)
+		switch {
+		case err == nil:
+			mc.conns = append(mc.conns, c)
+		case defaults:
+			// The host may lack IPv4 or IPv6 altogether.
+			if joinErr == nil {
+				joinErr = err
+			}
+		default:
+			mc.Close()
+			return nil, err
+		}
+	}
+	if len(mc.conns) == 0 {
+		mc.Close()
+		return nil, joinErr
+	}
+	if mc.reply == nil {
+		c, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			mc.Close()
+			return nil, err
+		}
+		mc.reply, mc.ownReply = c, true
+	}
+	for _, c := range mc.conns {
+		go mc.read(c)
+	}
+	return mc, nil
+}
+
+// read passes the datagrams received on c to ReadFrom.
+func (mc *multicastConn) read(c *net.UDPConn) {
+	buf := make([]byte, maxPktLen)
+	for {
+		n, addr, err := c.ReadFrom(buf)
+		d := datagram{append([]byte{}, buf[:n]...), addr, err}
+		select {
+		case mc.rx <- d:
+		case <-mc.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (mc *multicastConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	mc.mu.Lock()
+	deadline := mc.deadline
+	mc.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case d := <-mc.rx:
+		return copy(b, d.b), d.addr, d.err
+	case <-mc.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (mc *multicastConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return mc.reply.WriteTo(b, addr)
+}
+
+func (mc *multicastConn) LocalAddr() net.Addr { return mc.conns[0].LocalAddr() }
+
+func (mc *multicastConn) SetReadDeadline(t time.Time) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.deadline = t
+	return nil
+}
+
+func (mc *multicastConn) Close() error {
+	mc.closeOnce.Do(func() {
+		close(mc.closed)
+		for _, c := range mc.conns {
+			c.Close()
+		}
+		if mc.ownReply {
+			mc.reply.Close()
+		}
+	})
+	return nil
+}
+
+// multicastHandler wraps h to serve requests received over multicast.
+func multicastHandler(h Handler, leisure time.Duration) Handler {
+	return funcHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		// Multicast requests must not be confirmable (RFC 7252
+		// section 8.1).
+		if m.IsConfirmable() || m.Code == Empty || m.Code >= Created {
+			return nil
+		}
+		rv := h.ServeCOAP(l, a, m)
+		if rv == nil || rv.Code >= BadRequest || rv.Code == Content && len(rv.Payload) == 0 {
+			return nil
+		}
+		rv.Type = NonConfirmable
+		if leisure > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(leisure))))
+		}
+		return rv
+	})
+}
+
+// A MulticastResponse is a response to a multicast request.
+type MulticastResponse struct {
+	From    net.Addr
+	Message Message
+}
+
+// Multicast sends req, which must be non-confirmable, to the multicast
+// group the connection was dialed to and collects the responses
+// matching its token until ctx is done.
+func (c *Conn) Multicast(ctx context.Context, req Message) ([]MulticastResponse, error) {
+	if req.IsConfirmable() {
+		return nil, errors.New("multicast request is confirmable")
+	}
+	if err := Transmit(c.conn, c.addr, req); err != nil {
+		return nil, err
+	}
+
+	var rv []MulticastResponse
+	for {
+		deadline := time.Now().Add(100 * time.Millisecond)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		c.conn.SetReadDeadline(deadline)
+		n, from, err := c.conn.ReadFrom(c.buf)
+		if ctx.Err() != nil {
+			return rv, nil
+		}
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			continue
+		} else if err != nil {
+			return rv, err
+		}
+		m, err := ParseMessage(c.buf[:n])
+		if err != nil || string(m.Token) != string(req.Token) || m.Code < Created {
+			continue
+		}
+		rv = append(rv, MulticastResponse{From: from, Message: m})
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package coap
+
+import (
+	"errors"
+	"net"
+)
+
+func listenGroup(ifi *net.Interface, group net.IP, port int) (*net.UDPConn, error) {
+	return nil, errors.New("multicast listening is not supported on this platform")
+}
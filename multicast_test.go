@@ -0,0 +1,122 @@
+package coap
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMulticastHandler(t *testing.T) {
+	h := multicastHandler(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		rv := &Message{Type: Acknowledgement, Code: Content, MessageID: m.MessageID, Token: m.Token}
+		switch m.PathString() {
+		case "missing":
+			rv.Code = NotFound
+		case "filtered":
+		default:
+			rv.Payload = []byte("here")
+		}
+		return rv
+	}), time.Millisecond)
+
+	req := func(typ COAPType, path string) *Message {
+		m := &Message{Type: typ, Code: GET, MessageID: 1, Token: []byte("t")}
+		m.SetPathString(path)
+		return m
+	}
+	rv := h.ServeCOAP(nil, nil, req(NonConfirmable, "a"))
+	if rv == nil || rv.Type != NonConfirmable || string(rv.Payload) != "here" {
+		t.Errorf("got %v", rv)
+	}
+	for _, m := range []*Message{
+		req(Confirmable, "a"),
+		req(NonConfirmable, "missing"),
+		req(NonConfirmable, "filtered"),
+	} {
+		if rv := h.ServeCOAP(nil, nil, m); rv != nil {
+			t.Errorf("%v %s: got %v, want no response", m.Type, m.PathString(), rv)
+		}
+	}
+}
+
+func TestMulticastHandlerNoLeisure(t *testing.T) {
+	h := multicastHandler(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		return &Message{Code: Content, Payload: []byte("now")}
+	}), 0)
+	if rv := h.ServeCOAP(nil, nil, &Message{Type: NonConfirmable, Code: GET}); rv == nil {
+		t.Errorf("no response")
+	}
+}
+
+func TestListenMulticastConfig(t *testing.T) {
+	if _, err := ListenMulticast(MulticastConfig{Port: 56831, Leisure: -time.Second}); err == nil {
+		t.Errorf("negative leisure accepted")
+	}
+	if _, err := ListenMulticast(MulticastConfig{Port: 56831, Groups: []string{"192.0.2.1"}}); err == nil {
+		t.Errorf("unicast group accepted")
+	}
+
+	// The default groups need only one address family.
+	l, err := ListenMulticast(MulticastConfig{Port: 56831})
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	l.Close()
+}
+
+func TestMulticastWellKnownCoreFilter(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("temp", func(l Transport, a net.Addr, m *Message) *Message { return nil })
+	mux.Describe("temp", Resource{ResourceTypes: []string{"temperature"}})
+	h := multicastHandler(mux, time.Millisecond)
+
+	m := &Message{Type: NonConfirmable, Code: GET, MessageID: 1}
+	m.SetPathString("/.well-known/core")
+	m.SetOption(URIQuery, "rt=humidity")
+	if rv := h.ServeCOAP(nil, nil, m); rv != nil {
+		t.Errorf("unmatched filter answered: %q", rv.Payload)
+	}
+	m.SetOption(URIQuery, "rt=temp*")
+	if rv := h.ServeCOAP(nil, nil, m); rv == nil || len(rv.Payload) == 0 {
+		t.Errorf("matched filter not answered: %v", rv)
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	const port = 56830
+	l, err := ListenMulticast(MulticastConfig{
+		Port:    port,
+		Groups:  []string{AllCoAPNodesIPv4},
+		Leisure: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	defer l.Close()
+	go Serve(l, FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		return &Message{Type: NonConfirmable, Code: Content, MessageID: m.MessageID,
+			Token: m.Token, Payload: []byte("hello")}
+	}))
+
+	c, err := Dial("udp4", net.JoinHostPort(AllCoAPNodesIPv4, "56830"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Multicast(context.Background(), Message{Type: Confirmable, Code: GET}); err == nil {
+		t.Error("confirmable multicast request sent")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	req := Message{Type: NonConfirmable, Code: GET, MessageID: 8, Token: []byte("mc")}
+	rv, err := c.Multicast(ctx, req)
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	if len(rv) != 1 || string(rv[0].Message.Payload) != "hello" || rv[0].From == nil {
+		t.Errorf("got %+v, want one response", rv)
+	}
+}
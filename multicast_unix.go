@@ -0,0 +1,93 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package coap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// listenGroup returns a socket bound to group, so that it receives
+// only datagrams sent to the group, and joins the group on ifi.
+func listenGroup(ifi *net.Interface, group net.IP, port int) (*net.UDPConn, error) {
+	network := "udp6"
+	if group.To4() != nil {
+		network = "udp4"
+	}
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return control(c, func(fd int) error {
+			return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		})
+	}}
+	host := group.String()
+	if ifi != nil && group.IsLinkLocalMulticast() {
+		host += "%" + ifi.Name
+	}
+	pc, err := lc.ListenPacket(context.Background(), network,
+		net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	c := pc.(*net.UDPConn)
+	if err := joinGroup(c, ifi, group); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func joinGroup(c *net.UDPConn, ifi *net.Interface, group net.IP) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if ip4 := group.To4(); ip4 != nil {
+		mreq := &syscall.IPMreq{}
+		copy(mreq.Multiaddr[:], ip4)
+		if ifi != nil {
+			addr, err := interfaceIPv4(ifi)
+			if err != nil {
+				return err
+			}
+			copy(mreq.Interface[:], addr)
+		}
+		return control(rc, func(fd int) error {
+			return syscall.SetsockoptIPMreq(fd, syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+		})
+	}
+	mreq := &syscall.IPv6Mreq{}
+	copy(mreq.Multiaddr[:], group.To16())
+	if ifi != nil {
+		mreq.Interface = uint32(ifi.Index)
+	}
+	return control(rc, func(fd int) error {
+		return syscall.SetsockoptIPv6Mreq(fd, syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+	})
+}
+
+// interfaceIPv4 returns an IPv4 address of ifi, which identifies it
+// when joining IPv4 groups.
+func interfaceIPv4(ifi *net.Interface) (net.IP, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			return n.IP.To4(), nil
+		}
+	}
+	return nil, errors.New("no IPv4 address on " + ifi.Name)
+}
+
+// control runs f on the file descriptor of c.
+func control(c syscall.RawConn, f func(fd int) error) error {
+	var ferr error
+	if err := c.Control(func(fd uintptr) { ferr = f(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
@@ -0,0 +1,99 @@
+package coap
+
+import (
+	"net"
+)
+
+// Negotiator is a Handler that serves one of several representations
+// of a resource, chosen by the Accept option of the request (RFC 7252
+// section 5.10.4), and checks the Content-Format of request payloads.
+//
+// Requests accepting a format that has no representation are answered
+// with 4.06 Not Acceptable, and requests whose payload is in a format
+// that is not consumed with 4.15 Unsupported Content-Format, whether
+// they are confirmable or not.
+type Negotiator struct {
+	produce []representation
+	consume []MediaType
+}
+
+type representation struct {
+	mt MediaType
+	h  Handler
+}
+
+// NewNegotiator creates an empty Negotiator.
+func NewNegotiator() *Negotiator { return &Negotiator{} }
+
+// Produce registers h as the handler producing the representation in
+// format mt.  Requests without Accept are served by the representation
+// registered first.  Successful responses from h without a
+// Content-Format option are given one.
+func (n *Negotiator) Produce(mt MediaType, h Handler) {
+	for _, r := range n.produce {
+		if r.mt == mt {
+			panic("coap: multiple representations for " + mt.String())
+		}
+	}
+	n.produce = append(n.produce, representation{mt, h})
+}
+
+// ProduceFunc registers a function producing the representation in
+// format mt.
+func (n *Negotiator) ProduceFunc(mt MediaType,
+	f func(l Transport, a net.Addr, m *Message) *Message) {
+	n.Produce(mt, FuncHandler(f))
+}
+
+// Consume adds formats accepted in request payloads.  If Consume is
+// never called, requests may carry no payload.
+func (n *Negotiator) Consume(mts ...MediaType) {
+	n.consume = append(n.consume, mts...)
+}
+
+// accepts reports whether the payload of m is in a consumed format.
+func (n *Negotiator) accepts(m *Message) bool {
+	ct, ok := m.Option(ContentFormat).(MediaType)
+	if !ok {
+		// Without Content-Format, only an empty payload is
+		// acceptable.
+		return len(m.Payload) == 0 && m.Option(ContentFormat) == nil
+	}
+	for _, mt := range n.consume {
+		if mt == ct {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeCOAP selects and serves a representation.
+func (n *Negotiator) ServeCOAP(l Transport, a net.Addr, m *Message) *Message {
+	if !n.accepts(m) {
+		return replyTo(m, UnsupportedContentFormat)
+	}
+	if len(n.produce) == 0 {
+		return replyTo(m, NotAcceptable)
+	}
+
+	r := n.produce[0]
+	if accept, ok := m.Option(Accept).(MediaType); ok {
+		found := false
+		for _, p := range n.produce {
+			if p.mt == accept {
+				r, found = p, true
+				break
+			}
+		}
+		if !found {
+			return replyTo(m, NotAcceptable)
+		}
+	}
+
+	rv := r.h.ServeCOAP(l, a, m)
+	if rv != nil && rv.Code>>5 == 2 && len(rv.Payload) > 0 &&
+		rv.Option(ContentFormat) == nil {
+		rv.SetOption(ContentFormat, r.mt)
+	}
+	return rv
+}
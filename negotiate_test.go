@@ -0,0 +1,66 @@
+package coap
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNegotiator(t *testing.T) {
+	reply := func(payload string) func(l Transport, a net.Addr, m *Message) *Message {
+		return func(l Transport, a net.Addr, m *Message) *Message {
+			return &Message{Type: Acknowledgement, Code: Content, Payload: []byte(payload)}
+		}
+	}
+	n := NewNegotiator()
+	n.ProduceFunc(TextPlain, reply("21.5"))
+	n.ProduceFunc(AppJSON, reply(`{"t":21.5}`))
+	n.Consume(AppJSON)
+
+	tests := []struct {
+		name    string
+		accept  interface{}
+		ct      interface{}
+		payload string
+		typ     COAPType
+		code    COAPCode
+		exp     string
+		expCT   MediaType
+	}{
+		{"default", nil, nil, "", Confirmable, Content, "21.5", TextPlain},
+		{"json", AppJSON, nil, "", Confirmable, Content, `{"t":21.5}`, AppJSON},
+		{"xml", AppXML, nil, "", Confirmable, NotAcceptable, "", 0},
+		{"json body", nil, AppJSON, "{}", Confirmable, Content, "21.5", TextPlain},
+		{"xml body", nil, AppXML, "<a/>", Confirmable, UnsupportedContentFormat, "", 0},
+		{"untyped body", nil, nil, "x", Confirmable, UnsupportedContentFormat, "", 0},
+		{"non xml", AppXML, nil, "", NonConfirmable, NotAcceptable, "", 0},
+		{"non xml body", nil, AppXML, "<a/>", NonConfirmable, UnsupportedContentFormat, "", 0},
+	}
+	for _, test := range tests {
+		req := &Message{Type: test.typ, Code: POST, Token: []byte("n"), Payload: []byte(test.payload)}
+		if test.accept != nil {
+			req.SetOption(Accept, test.accept)
+		}
+		if test.ct != nil {
+			req.SetOption(ContentFormat, test.ct)
+		}
+		// Go through the codec so options have their parsed types.
+		d, _ := req.MarshalBinary()
+		parsed, _ := ParseMessage(d)
+
+		rv := n.ServeCOAP(nil, nil, &parsed)
+		if rv == nil || rv.Code != test.code {
+			t.Errorf("%s: Expected %v, got %v", test.name, test.code, rv)
+			continue
+		}
+		if test.code != Content {
+			if string(rv.Token) != "n" || (rv.Type == NonConfirmable) != (test.typ == NonConfirmable) {
+				t.Errorf("%s: reply does not match request: %v", test.name, rv)
+			}
+			continue
+		}
+		if string(rv.Payload) != test.exp || rv.Option(ContentFormat) != test.expCT {
+			t.Errorf("%s: Expected %q (%v), got %q (%v)", test.name,
+				test.exp, test.expCT, rv.Payload, rv.Option(ContentFormat))
+		}
+	}
+}
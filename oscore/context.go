@@ -0,0 +1,234 @@
+package oscore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"sync"
+
+	"github.com/zltl/go-coap/internal/cbor"
+	"github.com/zltl/go-coap/internal/ccm"
+)
+
+const (
+	// algAESCCM16_64_128 is the COSE identifier of the AEAD
+	// algorithm (RFC 8152 section 10.2).
+	algAESCCM16_64_128 = 10
+
+	keyLen   = 16
+	nonceLen = 13
+	tagLen   = 8
+
+	// maxIDLen is the longest Sender or Recipient ID that fits in
+	// the nonce.
+	maxIDLen = nonceLen - 6
+
+	// maxSequence is the largest Sender Sequence Number; Partial
+	// IVs are at most 5 bytes long.
+	maxSequence = 1<<40 - 1
+
+	replayWindowSize = 32
+)
+
+// Config holds the input parameters of a security context (RFC 8613
+// section 3.2).  The AEAD algorithm is always AES-CCM-16-64-128 and
+// the HKDF algorithm HKDF SHA-256.
+type Config struct {
+	// MasterSecret is the shared secret; it must not be empty.
+	MasterSecret []byte
+	// MasterSalt is optional.
+	MasterSalt []byte
+	// IDContext, if not nil, is mixed into the derived keys and sent
+	// in requests as kid context.
+	IDContext []byte
+
+	// SenderID identifies this endpoint and RecipientID its peer.
+	// Either may be empty, but they must differ and be at most 7
+	// bytes long.
+	SenderID    []byte
+	RecipientID []byte
+
+	// SenderSequence is the first Sender Sequence Number used.
+	// Endpoints that keep a context across reboots must persist
+	// Context.Sequence and resume from a value no lower than it.
+	SenderSequence uint64
+}
+
+// A Context is an OSCORE security context shared with one peer.  It is
+// safe for concurrent use.
+type Context struct {
+	senderID, recipientID, idContext []byte
+	senderKey, recipientKey          []byte
+	commonIV                         []byte
+	sender, recipient                cipher.AEAD
+
+	mu     sync.Mutex
+	seq    uint64
+	replay replayWindow
+}
+
+// NewContext derives a security context from c.
+func NewContext(c Config) (*Context, error) {
+	if len(c.MasterSecret) == 0 {
+		return nil, errors.New("oscore: empty master secret")
+	}
+	if len(c.SenderID) > maxIDLen || len(c.RecipientID) > maxIDLen {
+		return nil, errors.New("oscore: sender or recipient ID too long")
+	}
+	if string(c.SenderID) == string(c.RecipientID) {
+		return nil, errors.New("oscore: sender and recipient ID are equal")
+	}
+	if c.SenderSequence > maxSequence {
+		return nil, ErrSequenceExhausted
+	}
+
+	ctx := &Context{
+		senderID:    append([]byte{}, c.SenderID...),
+		recipientID: append([]byte{}, c.RecipientID...),
+		seq:         c.SenderSequence,
+	}
+	if c.IDContext != nil {
+		ctx.idContext = append([]byte{}, c.IDContext...)
+	}
+
+	var err error
+	derive := func(id []byte, typ string, n int) []byte {
+		if err != nil {
+			return nil
+		}
+		var k []byte
+		k, err = hkdf.Key(sha256.New, c.MasterSecret, c.MasterSalt,
+			string(kdfInfo(id, ctx.idContext, typ, n)), n)
+		return k
+	}
+	ctx.senderKey = derive(ctx.senderID, "Key", keyLen)
+	ctx.recipientKey = derive(ctx.recipientID, "Key", keyLen)
+	ctx.commonIV = derive(nil, "IV", nonceLen)
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx.sender, err = newAEAD(ctx.senderKey); err != nil {
+		return nil, err
+	}
+	if ctx.recipient, err = newAEAD(ctx.recipientKey); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// kdfInfo builds the HKDF info structure (RFC 8613 section 3.2.1).
+func kdfInfo(id, idContext []byte, typ string, n int) []byte {
+	b := cbor.AppendArray(nil, 5)
+	b = cbor.AppendBytes(b, id)
+	if idContext == nil {
+		b = cbor.AppendNull(b)
+	} else {
+		b = cbor.AppendBytes(b, idContext)
+	}
+	b = cbor.AppendUint(b, algAESCCM16_64_128)
+	b = cbor.AppendText(b, typ)
+	return cbor.AppendUint(b, uint64(n))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return ccm.New(b, tagLen, nonceLen)
+}
+
+// SenderID returns the ID of this endpoint.
+func (c *Context) SenderID() []byte { return c.senderID }
+
+// RecipientID returns the ID of the peer.
+func (c *Context) RecipientID() []byte { return c.recipientID }
+
+// IDContext returns the ID Context, or nil if there is none.
+func (c *Context) IDContext() []byte { return c.idContext }
+
+// Sequence returns the next Sender Sequence Number.
+func (c *Context) Sequence() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seq
+}
+
+// nextPIV consumes a Sender Sequence Number and returns it as a
+// Partial IV.
+func (c *Context) nextPIV() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seq > maxSequence {
+		return nil, ErrSequenceExhausted
+	}
+	piv := encodePIV(c.seq)
+	c.seq++
+	return piv, nil
+}
+
+// nonce computes the AEAD nonce for a Partial IV generated by the
+// endpoint with Sender ID id (RFC 8613 section 5.2).
+func (c *Context) nonce(id, piv []byte) []byte {
+	n := make([]byte, nonceLen)
+	n[0] = byte(len(id))
+	copy(n[nonceLen-5-len(id):nonceLen-5], id)
+	copy(n[nonceLen-len(piv):], piv)
+	for i := range n {
+		n[i] ^= c.commonIV[i]
+	}
+	return n
+}
+
+// encodePIV returns a sequence number in network byte order with
+// leading zeroes removed.  Zero is encoded as a single zero byte.
+func encodePIV(seq uint64) []byte {
+	b := []byte{byte(seq >> 32), byte(seq >> 24), byte(seq >> 16),
+		byte(seq >> 8), byte(seq)}
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+func decodePIV(piv []byte) uint64 {
+	var seq uint64
+	for _, b := range piv {
+		seq = seq<<8 | uint64(b)
+	}
+	return seq
+}
+
+// replayWindow tracks the recently received Partial IVs of requests
+// (RFC 8613 section 7.4).
+type replayWindow struct {
+	seen   bool
+	latest uint64
+	mask   uint32 // bit i is set if latest-i has been received
+}
+
+// accept records seq, reporting false if it was already received or
+// is too old to tell.
+func (w *replayWindow) accept(seq uint64) bool {
+	switch {
+	case !w.seen:
+		w.seen, w.latest, w.mask = true, seq, 1
+	case seq > w.latest:
+		if d := seq - w.latest; d < replayWindowSize {
+			w.mask = w.mask<<d | 1
+		} else {
+			w.mask = 1
+		}
+		w.latest = seq
+	default:
+		d := w.latest - seq
+		if d >= replayWindowSize || w.mask&(1<<d) != 0 {
+			return false
+		}
+		w.mask |= 1 << d
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package oscore
+
+import (
+	"errors"
+	"net"
+
+	"github.com/zltl/go-coap"
+)
+
+// Handler returns a handler that verifies OSCORE requests and passes
+// the decrypted requests to h.  contexts returns the security context
+// whose Recipient ID is kid, or nil if there is none.  Responses from
+// h are protected; requests that are unprotected or fail verification
+// are answered with the unprotected errors of RFC 8613 section 8.2.
+func Handler(contexts func(kid, idContext []byte) *Context, h coap.Handler) coap.Handler {
+	return coap.FuncHandler(func(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
+		opt, err := oscoreOption(*m)
+		switch {
+		case errors.Is(err, ErrNotProtected):
+			return errorResponse(m, coap.Unauthorized, "OSCORE required")
+		case err != nil || !opt.hasKid:
+			return errorResponse(m, coap.BadOption, "")
+		}
+		ctx := contexts(opt.kid, opt.kidContext)
+		if ctx == nil {
+			return errorResponse(m, coap.Unauthorized, "Security context not found")
+		}
+
+		req, b, err := ctx.VerifyRequest(*m)
+		switch {
+		case errors.Is(err, ErrReplay):
+			return errorResponse(m, coap.Unauthorized, "Replay detected")
+		case errors.Is(err, ErrDecode):
+			return errorResponse(m, coap.BadOption, "")
+		case err != nil:
+			return errorResponse(m, coap.BadRequest, "Decryption failed")
+		}
+
+		res := h.ServeCOAP(l, a, &req)
+		if res == nil {
+			return nil
+		}
+		rv, err := ctx.ProtectResponse(*res, b)
+		if err != nil {
+			return errorResponse(m, coap.InternalServerError, "")
+		}
+		return &rv
+	})
+}
+
+// errorResponse builds an unprotected error response to m.
+func errorResponse(m *coap.Message, code coap.COAPCode, diag string) *coap.Message {
+	rv := &coap.Message{
+		Type:      coap.NonConfirmable,
+		Code:      code,
+		MessageID: m.MessageID,
+		Token:     m.Token,
+		Payload:   []byte(diag),
+	}
+	if m.IsConfirmable() {
+		rv.Type = coap.Acknowledgement
+	}
+	// Keep caches from serving the error in place of a protected
+	// response.
+	rv.SetOption(coap.MaxAge, 0)
+	return rv
+}
+
+// Client sends OSCORE-protected requests over a connection.
+type Client struct {
+	conn *coap.Conn
+	ctx  *Context
+}
+
+// NewClient returns a client protecting requests on conn with ctx.
+func NewClient(conn *coap.Conn, ctx *Context) *Client {
+	return &Client{conn: conn, ctx: ctx}
+}
+
+// Send protects req, sends it and returns the verified response, if
+// there is one.  An unprotected response, such as an OSCORE error, is
+// returned as is along with ErrNotProtected.
+func (c *Client) Send(req coap.Message) (*coap.Message, error) {
+	out, b, err := c.ctx.ProtectRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.conn.Send(out)
+	if err != nil || res == nil {
+		return res, err
+	}
+	if res.Option(coap.OSCORE) == nil {
+		return res, ErrNotProtected
+	}
+	rv, err := c.ctx.VerifyResponse(*res, b)
+	if err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
@@ -0,0 +1,61 @@
+package oscore
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/zltl/go-coap"
+	"github.com/zltl/go-coap/coaptest"
+)
+
+func TestHandler(t *testing.T) {
+	server, _ := NewContext(swap(vectors[0].cfg))
+	contexts := func(kid, idContext []byte) *Context {
+		if bytes.Equal(kid, server.RecipientID()) {
+			return server
+		}
+		return nil
+	}
+	h := coap.FuncHandler(func(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
+		return &coap.Message{
+			Type:      coap.Acknowledgement,
+			Code:      coap.Content,
+			MessageID: m.MessageID,
+			Token:     m.Token,
+			Payload:   []byte("hello " + m.PathString()),
+		}
+	})
+	s := coaptest.NewServer(Handler(contexts, h))
+	defer s.Close()
+
+	client, _ := NewContext(vectors[0].cfg)
+	c := NewClient(s.Client, client)
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 7, Token: []byte{1}}
+	req.SetPathString("world")
+	res, err := c.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != coap.Content || string(res.Payload) != "hello world" {
+		t.Errorf("got %v %q", res.Code, res.Payload)
+	}
+
+	// Unprotected requests are refused.
+	res, err = s.Client.Send(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != coap.Unauthorized {
+		t.Errorf("unprotected request: got %v", res.Code)
+	}
+
+	// So are requests from unknown peers.
+	cfg := vectors[0].cfg
+	cfg.SenderID = []byte{0x42}
+	stranger, _ := NewContext(cfg)
+	res, err = NewClient(s.Client, stranger).Send(req)
+	if err != ErrNotProtected || res.Code != coap.Unauthorized {
+		t.Errorf("unknown context: got %v, %v", res, err)
+	}
+}
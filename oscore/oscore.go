@@ -0,0 +1,280 @@
+// Package oscore implements Object Security for Constrained RESTful
+// Environments (RFC 8613).
+//
+// OSCORE encrypts the code, payload and most options of a CoAP message
+// end to end, so that they are protected across proxies.  Only
+// AES-CCM-16-64-128 with HKDF SHA-256 is supported.  Class I options
+// and the OSCORE group mode are not supported, and Proxy-Uri must be
+// expressed as Proxy-Scheme and Uri-* options before protection.
+package oscore
+
+import (
+	"errors"
+
+	"github.com/zltl/go-coap"
+	"github.com/zltl/go-coap/internal/cbor"
+)
+
+// Errors.
+var (
+	ErrNotProtected      = errors.New("oscore: message is not protected")
+	ErrDecode            = errors.New("oscore: malformed OSCORE option")
+	ErrDecrypt           = errors.New("oscore: decryption failed")
+	ErrReplay            = errors.New("oscore: replayed request")
+	ErrSequenceExhausted = errors.New("oscore: sender sequence numbers exhausted")
+	ErrProxyURI          = errors.New("oscore: cannot protect Proxy-Uri")
+)
+
+// A Binding ties a response to the request it answers.  It is returned
+// when a request is protected or verified and must be passed along
+// with the response.
+type Binding struct {
+	kid, piv, nonce []byte
+}
+
+// ProtectRequest encrypts req, returning the OSCORE message to send in
+// its place.
+func (c *Context) ProtectRequest(req coap.Message) (coap.Message, *Binding, error) {
+	inner, outer, err := split(req, true)
+	if err != nil {
+		return coap.Message{}, nil, err
+	}
+	piv, err := c.nextPIV()
+	if err != nil {
+		return coap.Message{}, nil, err
+	}
+	b := &Binding{kid: c.senderID, piv: piv, nonce: c.nonce(c.senderID, piv)}
+
+	outer.Code = coap.POST
+	if req.Option(coap.Observe) != nil {
+		outer.Code = coap.FETCH
+	}
+	opt := optionValue{piv: piv, kid: c.senderID, hasKid: true, kidContext: c.idContext}
+	outer.SetOption(coap.OSCORE, opt.marshal())
+	outer.Payload = c.sender.Seal(nil, b.nonce, inner, aad(b.kid, b.piv))
+	return outer, b, nil
+}
+
+// VerifyRequest decrypts a request protected with this context,
+// returning the original request.
+func (c *Context) VerifyRequest(req coap.Message) (coap.Message, *Binding, error) {
+	opt, err := oscoreOption(req)
+	if err != nil {
+		return coap.Message{}, nil, err
+	}
+	if !opt.hasKid || len(opt.piv) == 0 {
+		return coap.Message{}, nil, ErrDecode
+	}
+	b := &Binding{kid: opt.kid, piv: opt.piv, nonce: c.nonce(opt.kid, opt.piv)}
+	pt, err := c.recipient.Open(nil, b.nonce, req.Payload, aad(b.kid, b.piv))
+	if err != nil {
+		return coap.Message{}, nil, ErrDecrypt
+	}
+
+	c.mu.Lock()
+	fresh := c.replay.accept(decodePIV(opt.piv))
+	c.mu.Unlock()
+	if !fresh {
+		return coap.Message{}, nil, ErrReplay
+	}
+
+	rv, err := merge(req, pt)
+	return rv, b, err
+}
+
+// ProtectResponse encrypts the response res to the request bound by b.
+// Observe notifications carry their own Partial IV; other responses
+// reuse the request's nonce.
+func (c *Context) ProtectResponse(res coap.Message, b *Binding) (coap.Message, error) {
+	inner, outer, err := split(res, false)
+	if err != nil {
+		return coap.Message{}, err
+	}
+	var opt optionValue
+	nonce := b.nonce
+	outer.Code = coap.Changed
+	if res.Option(coap.Observe) != nil {
+		if opt.piv, err = c.nextPIV(); err != nil {
+			return coap.Message{}, err
+		}
+		nonce = c.nonce(c.senderID, opt.piv)
+		outer.Code = coap.Content
+	}
+	outer.SetOption(coap.OSCORE, opt.marshal())
+	outer.Payload = c.sender.Seal(nil, nonce, inner, aad(b.kid, b.piv))
+	return outer, nil
+}
+
+// VerifyResponse decrypts the response res to the request bound by b.
+func (c *Context) VerifyResponse(res coap.Message, b *Binding) (coap.Message, error) {
+	opt, err := oscoreOption(res)
+	if err != nil {
+		return coap.Message{}, err
+	}
+	nonce := b.nonce
+	if len(opt.piv) > 0 {
+		nonce = c.nonce(c.recipientID, opt.piv)
+	}
+	pt, err := c.recipient.Open(nil, nonce, res.Payload, aad(b.kid, b.piv))
+	if err != nil {
+		return coap.Message{}, ErrDecrypt
+	}
+	return merge(res, pt)
+}
+
+// outerOnly reports whether option id is sent unencrypted (class U
+// only, RFC 8613 section 4.1).
+func outerOnly(id coap.OptionID, request bool) bool {
+	switch id {
+	case coap.URIHost, coap.URIPort, coap.ProxyScheme, coap.HopLimit:
+		return true
+	case coap.Observe:
+		// Requests carry Observe both inside and outside, so
+		// that proxies can observe on the client's behalf.
+		return !request
+	}
+	return false
+}
+
+// split encodes the plaintext of m and builds the outer message
+// without code, OSCORE option and payload.
+func split(m coap.Message, request bool) ([]byte, coap.Message, error) {
+	inner := coap.Message{Code: m.Code, Payload: m.Payload}
+	outer := coap.Message{Type: m.Type, MessageID: m.MessageID, Token: m.Token}
+	for _, id := range m.OptionIDs() {
+		vals := m.Options(id)
+		if id == coap.OSCORE {
+			continue
+		}
+		if id == coap.ProxyURI {
+			return nil, coap.Message{}, ErrProxyURI
+		}
+		for _, v := range vals {
+			if id == coap.Observe {
+				outer.AddOption(id, v)
+			}
+			if !outerOnly(id, request) {
+				inner.AddOption(id, v)
+			} else if id != coap.Observe {
+				outer.AddOption(id, v)
+			}
+		}
+	}
+
+	// The plaintext is the code followed by options and payload
+	// encoded as in a message without a token.
+	d, err := inner.MarshalBinary()
+	if err != nil {
+		return nil, coap.Message{}, err
+	}
+	return append([]byte{d[1]}, d[4:]...), outer, nil
+}
+
+// merge decodes plaintext pt and combines it with the unprotected
+// fields of the outer message.
+func merge(outer coap.Message, pt []byte) (coap.Message, error) {
+	if len(pt) == 0 {
+		return coap.Message{}, ErrDecrypt
+	}
+	rv, err := coap.ParseMessage(append([]byte{0x40, pt[0], 0, 0}, pt[1:]...))
+	if err != nil {
+		return coap.Message{}, err
+	}
+	rv.Type = outer.Type
+	rv.MessageID = outer.MessageID
+	rv.Token = outer.Token
+	for _, id := range []coap.OptionID{coap.URIHost, coap.URIPort,
+		coap.ProxyScheme, coap.HopLimit, coap.Observe} {
+		if rv.Option(id) != nil {
+			continue
+		}
+		for _, v := range outer.Options(id) {
+			rv.AddOption(id, v)
+		}
+	}
+	return rv, nil
+}
+
+// aad builds the additional authenticated data: the COSE Enc_structure
+// with external_aad (RFC 8613 section 5.4).
+func aad(kid, piv []byte) []byte {
+	ext := cbor.AppendArray(nil, 5)
+	ext = cbor.AppendUint(ext, 1) // oscore_version
+	ext = cbor.AppendArray(ext, 1)
+	ext = cbor.AppendUint(ext, algAESCCM16_64_128)
+	ext = cbor.AppendBytes(ext, kid)
+	ext = cbor.AppendBytes(ext, piv)
+	ext = cbor.AppendBytes(ext, nil) // no class I options
+
+	b := cbor.AppendArray(nil, 3)
+	b = cbor.AppendText(b, "Encrypt0")
+	b = cbor.AppendBytes(b, nil)
+	return cbor.AppendBytes(b, ext)
+}
+
+// optionValue is the decoded value of the OSCORE option (RFC 8613
+// section 6.1).
+type optionValue struct {
+	piv        []byte
+	kidContext []byte // present if not nil
+	kid        []byte
+	hasKid     bool
+}
+
+const (
+	flagKid        = 0x08
+	flagKidContext = 0x10
+	flagsReserved  = 0xe0
+)
+
+func (v optionValue) marshal() []byte {
+	if len(v.piv) == 0 && !v.hasKid && v.kidContext == nil {
+		return []byte{}
+	}
+	b := []byte{byte(len(v.piv))}
+	b = append(b, v.piv...)
+	if v.kidContext != nil {
+		b[0] |= flagKidContext
+		b = append(b, byte(len(v.kidContext)))
+		b = append(b, v.kidContext...)
+	}
+	if v.hasKid {
+		b[0] |= flagKid
+		b = append(b, v.kid...)
+	}
+	return b
+}
+
+func parseOptionValue(b []byte) (optionValue, error) {
+	var v optionValue
+	if len(b) == 0 {
+		return v, nil
+	}
+	flags := b[0]
+	b = b[1:]
+	n := int(flags & 0x07)
+	if flags&flagsReserved != 0 || n > 5 || len(b) < n {
+		return v, ErrDecode
+	}
+	v.piv, b = b[:n], b[n:]
+	if flags&flagKidContext != 0 {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return v, ErrDecode
+		}
+		v.kidContext, b = b[1:1+int(b[0])], b[1+int(b[0]):]
+	}
+	if flags&flagKid != 0 {
+		v.kid, v.hasKid = b, true
+	} else if len(b) > 0 {
+		return v, ErrDecode
+	}
+	return v, nil
+}
+
+func oscoreOption(m coap.Message) (optionValue, error) {
+	b, ok := m.Option(coap.OSCORE).([]byte)
+	if !ok {
+		return optionValue{}, ErrNotProtected
+	}
+	return parseOptionValue(b)
+}
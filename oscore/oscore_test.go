@@ -0,0 +1,289 @@
+package oscore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/zltl/go-coap"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Security contexts from RFC 8613 Appendix C.1 to C.3, seen from the
+// client.
+var vectors = []struct {
+	name                         string
+	cfg                          Config
+	senderKey, recipientKey, civ string
+}{
+	{
+		name: "C.1",
+		cfg: Config{
+			MasterSecret: unhex("0102030405060708090a0b0c0d0e0f10"),
+			MasterSalt:   unhex("9e7ca92223786340"),
+			SenderID:     []byte{},
+			RecipientID:  []byte{0x01},
+		},
+		senderKey:    "f0910ed7295e6ad4b54fc793154302ff",
+		recipientKey: "ffb14e093c94c9cac9471648b4f98710",
+		civ:          "4622d4dd6d944168eefb54987c",
+	},
+	{
+		name: "C.2",
+		cfg: Config{
+			MasterSecret: unhex("0102030405060708090a0b0c0d0e0f10"),
+			SenderID:     []byte{0x00},
+			RecipientID:  []byte{0x01},
+		},
+		senderKey:    "321b26943253c7ffb6003b0b64d74041",
+		recipientKey: "e57b5635815177cd679ab4bcec9d7dda",
+		civ:          "be35ae297d2dace910c52e99f9",
+	},
+	{
+		name: "C.3",
+		cfg: Config{
+			MasterSecret: unhex("0102030405060708090a0b0c0d0e0f10"),
+			MasterSalt:   unhex("9e7ca92223786340"),
+			IDContext:    unhex("37cbf3210017a2d3"),
+			SenderID:     []byte{},
+			RecipientID:  []byte{0x01},
+		},
+		senderKey:    "af2a1300a5e95788b356336eeecd2b92",
+		recipientKey: "e39a0c7c77b43f03b4b39ab9a268699f",
+		civ:          "2ca58fb85ff1b81c0b7181b85e",
+	},
+}
+
+func TestDeriveContext(t *testing.T) {
+	for _, v := range vectors {
+		c, err := NewContext(v.cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		if got := hex.EncodeToString(c.senderKey); got != v.senderKey {
+			t.Errorf("%s: sender key = %s, want %s", v.name, got, v.senderKey)
+		}
+		if got := hex.EncodeToString(c.recipientKey); got != v.recipientKey {
+			t.Errorf("%s: recipient key = %s, want %s", v.name, got, v.recipientKey)
+		}
+		if got := hex.EncodeToString(c.commonIV); got != v.civ {
+			t.Errorf("%s: common IV = %s, want %s", v.name, got, v.civ)
+		}
+	}
+}
+
+func TestNonce(t *testing.T) {
+	c, err := NewContext(vectors[0].cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.nonce(c.senderID, encodePIV(0)); !bytes.Equal(got, unhex("4622d4dd6d944168eefb54987c")) {
+		t.Errorf("sender nonce = %x", got)
+	}
+	if got := c.nonce(c.recipientID, encodePIV(0)); !bytes.Equal(got, unhex("4722d4dd6d944169eefb54987c")) {
+		t.Errorf("recipient nonce = %x", got)
+	}
+}
+
+// swap returns the server's view of a client context.
+func swap(c Config) Config {
+	c.SenderID, c.RecipientID = c.RecipientID, c.SenderID
+	return c
+}
+
+// RFC 8613 Appendix C.4 and C.7: a GET protected by the client and the
+// server's response.
+func TestProtectVectors(t *testing.T) {
+	cfg := vectors[0].cfg
+	cfg.SenderSequence = 20
+	client, err := NewContext(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewContext(swap(vectors[0].cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := coap.ParseMessage(unhex("44015d1f00003974396c6f63616c686f737483747631"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := client.ProtectRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := out.MarshalBinary()
+	exp := unhex("44025d1f00003974396c6f63616c686f7374620914ff612f1092f1776f1c1668b3825e")
+	if !bytes.Equal(d, exp) {
+		t.Fatalf("protected request\n got %x\nwant %x", d, exp)
+	}
+
+	in, b, err := server.VerifyRequest(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Code != coap.GET || in.PathString() != "tv1" ||
+		in.Option(coap.URIHost) != "localhost" {
+		t.Errorf("verified request = %v %q %v", in.Code, in.PathString(), in.Option(coap.URIHost))
+	}
+
+	res, err := coap.ParseMessage(unhex("64455d1f00003974ff48656c6c6f20576f726c6421"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outRes, err := server.ProtectResponse(res, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ = outRes.MarshalBinary()
+	exp = unhex("64445d1f0000397490ffdbaad1e9a7e7b2a813d3c31524378303cdafae119106")
+	if !bytes.Equal(d, exp) {
+		t.Fatalf("protected response\n got %x\nwant %x", d, exp)
+	}
+}
+
+// RFC 8613 Appendix C.5: a request with a non-empty Sender ID.
+func TestProtectRequestSenderID(t *testing.T) {
+	cfg := vectors[1].cfg
+	cfg.SenderSequence = 20
+	client, err := NewContext(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := coap.ParseMessage(unhex("44015d1f00003974396c6f63616c686f737483747631"))
+	out, _, err := client.ProtectRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, _ := out.MarshalBinary()
+	exp := unhex("44025d1f00003974396c6f63616c686f737463091400ff4ed339a5a379b0b8bc731fffb0")
+	if !bytes.Equal(d, exp) {
+		t.Fatalf("protected request\n got %x\nwant %x", d, exp)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	client, _ := NewContext(vectors[0].cfg)
+	server, _ := NewContext(swap(vectors[0].cfg))
+
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	req.SetPathString("a")
+	out, _, err := client.ProtectRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := server.VerifyRequest(out); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := server.VerifyRequest(out); err != ErrReplay {
+		t.Errorf("second delivery: got %v, want ErrReplay", err)
+	}
+
+	out.Payload[0] ^= 1
+	if _, _, err := server.VerifyRequest(out); err != ErrDecrypt {
+		t.Errorf("tampered request: got %v, want ErrDecrypt", err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, seq := range []uint64{5, 3, 6, 40} {
+		if !w.accept(seq) {
+			t.Errorf("%d rejected", seq)
+		}
+	}
+	for _, seq := range []uint64{5, 6, 8, 40} {
+		if w.accept(seq) && seq != 8 {
+			t.Errorf("%d accepted twice", seq)
+		}
+	}
+	if w.accept(3) {
+		t.Errorf("3 accepted outside window")
+	}
+}
+
+func TestObserve(t *testing.T) {
+	client, _ := NewContext(vectors[0].cfg)
+	server, _ := NewContext(swap(vectors[0].cfg))
+
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	req.SetOption(coap.Observe, 0)
+	req.SetPathString("temp")
+	out, cb, err := client.ProtectRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Code != coap.FETCH || out.Option(coap.Observe) == nil {
+		t.Fatalf("outer request = %v, Observe %v", out.Code, out.Option(coap.Observe))
+	}
+	_, sb, err := server.VerifyRequest(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		n := coap.Message{Type: coap.NonConfirmable, Code: coap.Content,
+			MessageID: uint16(i), Payload: []byte{byte(i)}}
+		n.SetOption(coap.Observe, i)
+		outN, err := server.ProtectResponse(n, sb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, _ := outN.MarshalBinary()
+		if outN, err = coap.ParseMessage(d); err != nil {
+			t.Fatal(err)
+		}
+		if outN.Code != coap.Content || outN.Option(coap.Observe) == nil {
+			t.Fatalf("outer notification = %v, Observe %v", outN.Code, outN.Option(coap.Observe))
+		}
+		in, err := client.VerifyResponse(outN, cb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in.Code != coap.Content || !bytes.Equal(in.Payload, []byte{byte(i)}) ||
+			in.Option(coap.Observe) != uint32(i) {
+			t.Errorf("notification %d = %v %x %v", i, in.Code, in.Payload, in.Option(coap.Observe))
+		}
+	}
+}
+
+func TestProxyURI(t *testing.T) {
+	client, _ := NewContext(vectors[0].cfg)
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET}
+	req.SetOption(coap.ProxyURI, "coap://example.com/")
+	if _, _, err := client.ProtectRequest(req); err != ErrProxyURI {
+		t.Errorf("got %v, want ErrProxyURI", err)
+	}
+}
+
+func TestHopLimit(t *testing.T) {
+	client, _ := NewContext(vectors[0].cfg)
+	server, _ := NewContext(swap(vectors[0].cfg))
+
+	req := coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 1}
+	req.SetOption(coap.HopLimit, uint32(3))
+	out, _, err := client.ProtectRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Proxies on the way decrement the outer option.
+	if out.Option(coap.HopLimit) != uint32(3) {
+		t.Fatalf("outer Hop-Limit = %v", out.Option(coap.HopLimit))
+	}
+	out.SetOption(coap.HopLimit, uint32(2))
+	in, _, err := server.VerifyRequest(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Option(coap.HopLimit) != uint32(2) {
+		t.Errorf("Hop-Limit = %v, want 2", in.Option(coap.HopLimit))
+	}
+}
@@ -0,0 +1,254 @@
+package coap
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrUnsupportedScheme is returned by Proxy.Dial for URI schemes the
+// proxy cannot forward to.
+var ErrUnsupportedScheme = errors.New("unsupported URI scheme")
+
+// DefaultHopLimit is the Hop-Limit proxies insert into requests that
+// do not carry one (RFC 8768).
+const DefaultHopLimit = 16
+
+// NextHopLimit returns the Hop-Limit for forwarding m: one less than
+// its own, or DefaultHopLimit if it has none.  It reports false if the
+// limit is reached, and m must be answered with 5.08 Hop Limit Reached
+// instead of being forwarded.
+func NextHopLimit(m *Message) (uint32, bool) {
+	n, ok := m.Option(HopLimit).(uint32)
+	if !ok {
+		return DefaultHopLimit, true
+	}
+	return n - 1, n > 1
+}
+
+// Proxy is a CoAP-to-CoAP forward proxy (RFC 7252 section 5.7.2).
+// Requests carrying Proxy-Uri, or Proxy-Scheme with the Uri-* options,
+// are forwarded to the origin server and its response relayed.
+//
+// Requests for schemes the proxy cannot handle are answered with 5.05
+// Proxying Not Supported, origin servers that cannot be reached with
+// 5.02 Bad Gateway and those that do not answer in time with 5.04
+// Gateway Timeout.  The Hop-Limit of forwarded requests is decremented
+// to detect forwarding loops.
+type Proxy struct {
+	// Dial connects to the origin server at addr, a host and port,
+	// for the given URI scheme.  It returns ErrUnsupportedScheme for
+	// schemes it does not handle.  If nil, "coap" URIs are reached
+	// over UDP.
+	Dial func(scheme, addr string) (*Conn, error)
+
+	// Cache, if not nil, holds responses from origin servers.
+	Cache *Cache
+
+	// Next serves requests that are not proxy requests.  If nil,
+	// they are answered with 4.04 Not Found.
+	Next Handler
+
+	msgID uint32
+}
+
+func dialOrigin(scheme, addr string) (*Conn, error) {
+	if scheme != "coap" {
+		return nil, ErrUnsupportedScheme
+	}
+	return Dial("udp", addr)
+}
+
+// ProxyTarget returns the URI a proxy request is for, built from
+// Proxy-Uri or from Proxy-Scheme and the Uri-* options, or nil if m is
+// not a proxy request.  Proxy-Uri takes precedence.  Proxy-Scheme
+// requests without Uri-Host are an error, as the destination address
+// they default to is not known from m alone.
+func (m Message) ProxyTarget() (*url.URL, error) {
+	return m.proxyTarget(nil, 0)
+}
+
+// proxyTarget is ProxyTarget for a request sent to port destPort of
+// dest, which stand in for a missing Uri-Host and Uri-Port if not nil
+// and not zero (RFC 7252 section 6.5).
+func (m Message) proxyTarget(dest net.IP, destPort int) (*url.URL, error) {
+	if s, ok := m.Option(ProxyURI).(string); ok {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return nil, errors.New("Proxy-Uri is not an absolute URI")
+		}
+		return u, nil
+	}
+	scheme, ok := m.Option(ProxyScheme).(string)
+	if !ok {
+		return nil, nil
+	}
+	host, ok := m.Option(URIHost).(string)
+	if !ok && dest == nil {
+		return nil, errors.New("Proxy-Scheme without Uri-Host")
+	} else if !ok {
+		host = dest.String()
+	}
+	if port, ok := m.Option(URIPort).(uint32); ok {
+		host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	} else if destPort != 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(destPort))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u := &url.URL{Scheme: scheme, Host: host, Path: "/" + m.PathString()}
+	var segs, q []string
+	for _, s := range m.Path() {
+		segs = append(segs, url.PathEscape(s))
+	}
+	u.RawPath = "/" + strings.Join(segs, "/")
+	for _, s := range m.optionStrings(URIQuery) {
+		q = append(q, strings.ReplaceAll(url.QueryEscape(s), "+", "%20"))
+	}
+	u.RawQuery = strings.Join(q, "&")
+	return u, nil
+}
+
+// unescapeAll splits s at sep and percent-decodes each part
+// (RFC 7252 section 6.4).
+func unescapeAll(s, sep string) []string {
+	var rv []string
+	for _, p := range strings.Split(s, sep) {
+		if v, err := url.PathUnescape(p); err == nil {
+			p = v
+		}
+		rv = append(rv, p)
+	}
+	return rv
+}
+
+// destination returns the IP address and port requests received on l
+// were sent to.  The address is nil and the port zero if not known.
+func destination(l Transport) (net.IP, int) {
+	if l == nil {
+		return nil, 0
+	}
+	var ip net.IP
+	var port int
+	switch a := l.LocalAddr().(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip.IsUnspecified() {
+		ip = nil
+	}
+	return ip, port
+}
+
+// ServeCOAP forwards a proxy request.  Proxy-Scheme requests without
+// Uri-Host are for the address l listens on, if it is bound to one,
+// and those without Uri-Port for its port.
+func (p *Proxy) ServeCOAP(l Transport, a net.Addr, m *Message) *Message {
+	u, err := m.proxyTarget(destination(l))
+	switch {
+	case err != nil:
+		return errorReply(m, BadOption)
+	case u == nil && p.Next != nil:
+		return p.Next.ServeCOAP(l, a, m)
+	case u == nil:
+		return errorReply(m, NotFound)
+	}
+
+	hops, ok := NextHopLimit(m)
+	if !ok {
+		return errorReply(m, HopLimitReached)
+	}
+
+	dial := p.Dial
+	if dial == nil {
+		dial = dialOrigin
+	}
+	port := u.Port()
+	if port == "" {
+		port = strconv.Itoa(DefaultPort)
+	}
+	conn, err := dial(u.Scheme, net.JoinHostPort(u.Hostname(), port))
+	if errors.Is(err, ErrUnsupportedScheme) {
+		return errorReply(m, ProxyingNotSupported)
+	} else if err != nil {
+		return errorReply(m, BadGateway)
+	}
+	defer conn.Close()
+	conn.SetCache(p.Cache)
+
+	req := p.forward(m, u)
+	req.SetOption(HopLimit, hops)
+	res, err := conn.Send(req)
+	if err != nil || res == nil {
+		return gatewayError(m, err)
+	}
+
+	res.MessageID = m.MessageID
+	res.Token = m.Token
+	res.Type = NonConfirmable
+	if m.IsConfirmable() {
+		res.Type = Acknowledgement
+	}
+	return res
+}
+
+// gatewayError answers m after a failed exchange with an upstream
+// server: 5.04 Gateway Timeout if it did not answer in time, and 5.02
+// Bad Gateway otherwise.
+func gatewayError(m *Message, err error) *Message {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return errorReply(m, GatewayTimeout)
+	}
+	return errorReply(m, BadGateway)
+}
+
+// forward builds the request to the origin server for u from the proxy
+// request m.
+func (p *Proxy) forward(m *Message, u *url.URL) Message {
+	req := Message{
+		Type:      Confirmable,
+		Code:      m.Code,
+		MessageID: uint16(atomic.AddUint32(&p.msgID, 1)),
+		Token:     newToken(),
+		Payload:   m.Payload,
+	}
+	for _, o := range m.opts {
+		switch o.ID {
+		case ProxyURI, ProxyScheme, URIHost, URIPort, URIPath, URIQuery:
+		default:
+			req.opts = append(req.opts, o)
+		}
+	}
+
+	if net.ParseIP(u.Hostname()) == nil {
+		req.SetOption(URIHost, u.Hostname())
+	}
+	if path := strings.TrimPrefix(u.EscapedPath(), "/"); path != "" {
+		req.SetPath(unescapeAll(path, "/"))
+	}
+	if u.RawQuery != "" {
+		req.SetOption(URIQuery, unescapeAll(u.RawQuery, "&"))
+	}
+	return req
+}
+
+// newToken returns a random token for a request of the proxy's own, so
+// that responses cannot be spoofed by guessing it (RFC 7252 section
+// 5.3.1).
+func newToken() []byte {
+	t := make([]byte, 8)
+	if _, err := rand.Read(t); err != nil {
+		panic(err)
+	}
+	return t
+}
@@ -0,0 +1,247 @@
+package coap
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// proxyTest runs origin servers over pipes for a Proxy.
+type proxyTest struct {
+	mu    sync.Mutex
+	addrs []string
+	seen  []Message
+	pipes []Transport
+}
+
+func (pt *proxyTest) dial(origin Handler) func(scheme, addr string) (*Conn, error) {
+	return func(scheme, addr string) (*Conn, error) {
+		if scheme != "coap" {
+			return nil, ErrUnsupportedScheme
+		}
+		srv, cli := Pipe()
+		pt.mu.Lock()
+		pt.addrs = append(pt.addrs, addr)
+		pt.pipes = append(pt.pipes, srv)
+		pt.mu.Unlock()
+		if origin != nil {
+			go Serve(srv, FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+				pt.mu.Lock()
+				pt.seen = append(pt.seen, *m)
+				pt.mu.Unlock()
+				return origin.ServeCOAP(l, a, m)
+			}))
+		}
+		return NewConn(cli, srv.LocalAddr()), nil
+	}
+}
+
+func (pt *proxyTest) close() {
+	for _, p := range pt.pipes {
+		p.Close()
+	}
+}
+
+var echoOrigin = FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+	rv := &Message{
+		Type:      Acknowledgement,
+		Code:      Content,
+		MessageID: m.MessageID,
+		Token:     m.Token,
+		Payload:   []byte(m.PathString() + "?" + m.Query().Encode()),
+	}
+	rv.SetOption(MaxAge, uint32(30))
+	return rv
+})
+
+func proxyRequest(opts ...interface{}) *Message {
+	m := &Message{Type: Confirmable, Code: GET, MessageID: 77, Token: []byte("tok")}
+	for i := 0; i < len(opts); i += 2 {
+		m.AddOption(opts[i].(OptionID), opts[i+1])
+	}
+	return m
+}
+
+func TestProxyURI(t *testing.T) {
+	pt := &proxyTest{}
+	defer pt.close()
+	p := &Proxy{Dial: pt.dial(echoOrigin)}
+
+	m := proxyRequest(ProxyURI, "coap://sensor.example:5684/a/b%2Fc?x=1&y%202", Accept, AppJSON)
+	rv := p.ServeCOAP(nil, nil, m)
+	if rv == nil || rv.Code != Content || rv.MessageID != 77 || string(rv.Token) != "tok" ||
+		rv.Type != Acknowledgement {
+		t.Fatalf("got %v", rv)
+	}
+	if pt.addrs[0] != "sensor.example:5684" {
+		t.Errorf("dialed %q", pt.addrs[0])
+	}
+	req := pt.seen[0]
+	if got := req.Path(); len(got) != 2 || got[0] != "a" || got[1] != "b/c" {
+		t.Errorf("forwarded path %q", got)
+	}
+	if got := req.optionStrings(URIQuery); len(got) != 2 || got[0] != "x=1" || got[1] != "y 2" {
+		t.Errorf("forwarded query %q", got)
+	}
+	if req.Option(URIHost) != "sensor.example" || req.Option(ProxyURI) != nil ||
+		req.Option(Accept) != AppJSON {
+		t.Errorf("forwarded options %v", req.opts)
+	}
+}
+
+func TestProxyScheme(t *testing.T) {
+	pt := &proxyTest{}
+	defer pt.close()
+	p := &Proxy{Dial: pt.dial(echoOrigin)}
+
+	m := proxyRequest(ProxyScheme, "coap", URIHost, "2001:db8::1", URIPath, "temp")
+	if rv := p.ServeCOAP(nil, nil, m); rv == nil || string(rv.Payload) != "temp?" {
+		t.Fatalf("got %v", rv)
+	}
+	if pt.addrs[0] != "[2001:db8::1]:5683" {
+		t.Errorf("dialed %q", pt.addrs[0])
+	}
+	if pt.seen[0].Option(URIHost) != nil {
+		t.Errorf("Uri-Host sent for an IP literal")
+	}
+	if tok := pt.seen[0].Token; len(tok) != 8 {
+		t.Errorf("forwarded token %x", tok)
+	}
+}
+
+// boundTransport is a Transport listening on addr.
+type boundTransport struct {
+	Transport
+	addr net.Addr
+}
+
+func (t boundTransport) LocalAddr() net.Addr { return t.addr }
+
+func TestProxySchemeDestination(t *testing.T) {
+	pt := &proxyTest{}
+	defer pt.close()
+	p := &Proxy{Dial: pt.dial(echoOrigin)}
+
+	l := boundTransport{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.7"), Port: 5683}}
+	m := proxyRequest(ProxyScheme, "coap", URIPort, uint32(61616), URIPath, "temp")
+	if rv := p.ServeCOAP(l, nil, m); rv == nil || rv.Code != Content {
+		t.Fatalf("got %v", rv)
+	}
+	if pt.addrs[0] != "192.0.2.7:61616" {
+		t.Errorf("dialed %q", pt.addrs[0])
+	}
+
+	// Without Uri-Port, the port the proxy listens on is used.
+	l.addr = &net.UDPAddr{IP: net.ParseIP("2001:db8::7"), Port: 61617}
+	m = proxyRequest(ProxyScheme, "coap", URIPath, "temp")
+	if rv := p.ServeCOAP(l, nil, m); rv == nil || rv.Code != Content {
+		t.Fatalf("got %v", rv)
+	}
+	m = proxyRequest(ProxyScheme, "coap", URIHost, "sensor.example", URIPath, "temp")
+	if rv := p.ServeCOAP(l, nil, m); rv == nil || rv.Code != Content {
+		t.Fatalf("got %v", rv)
+	}
+	if pt.addrs[1] != "[2001:db8::7]:61617" || pt.addrs[2] != "sensor.example:61617" {
+		t.Errorf("dialed %q", pt.addrs[1:])
+	}
+
+	l.addr = &net.UDPAddr{IP: net.IPv4zero, Port: 5683}
+	m = proxyRequest(ProxyScheme, "coap", URIPath, "temp")
+	if rv := p.ServeCOAP(l, nil, m); rv == nil || rv.Code != BadOption {
+		t.Errorf("unbound listener: got %v", rv)
+	}
+}
+
+func TestProxyErrors(t *testing.T) {
+	pt := &proxyTest{}
+	defer pt.close()
+	p := &Proxy{Dial: pt.dial(echoOrigin)}
+
+	tests := []struct {
+		m    *Message
+		want COAPCode
+	}{
+		{proxyRequest(ProxyURI, "http://example.com/"), ProxyingNotSupported},
+		{proxyRequest(ProxyURI, "/relative"), BadOption},
+		{proxyRequest(ProxyScheme, "coap"), BadOption},
+		{proxyRequest(URIPath, "local"), NotFound},
+	}
+	for _, test := range tests {
+		if rv := p.ServeCOAP(nil, nil, test.m); rv == nil || rv.Code != test.want {
+			t.Errorf("%v: got %v, want %v", test.m.opts, rv, test.want)
+		}
+	}
+
+	p.Next = FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		return errorReply(m, Content)
+	})
+	if rv := p.ServeCOAP(nil, nil, proxyRequest(URIPath, "local")); rv.Code != Content {
+		t.Errorf("Next not used: %v", rv)
+	}
+}
+
+func TestProxyGatewayTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the response timeout")
+	}
+	pt := &proxyTest{}
+	defer pt.close()
+	p := &Proxy{Dial: pt.dial(nil)}
+
+	rv := p.ServeCOAP(nil, nil, proxyRequest(ProxyURI, "coap://silent.example/"))
+	if rv == nil || rv.Code != GatewayTimeout {
+		t.Errorf("got %v, want 5.04", rv)
+	}
+}
+
+func TestProxyCache(t *testing.T) {
+	pt := &proxyTest{}
+	defer pt.close()
+	p := &Proxy{Dial: pt.dial(echoOrigin), Cache: NewCache(NewMemoryCacheStore(1 << 16))}
+
+	for i := 0; i < 3; i++ {
+		rv := p.ServeCOAP(nil, nil, proxyRequest(ProxyURI, "coap://h.example/r"))
+		if rv == nil || string(rv.Payload) != "r?" || rv.MessageID != 77 {
+			t.Fatalf("%d: got %v", i, rv)
+		}
+	}
+	if len(pt.seen) != 1 {
+		t.Errorf("origin saw %d requests, want 1", len(pt.seen))
+	}
+}
+
+func TestProxyHopLimit(t *testing.T) {
+	pt := &proxyTest{}
+	defer pt.close()
+	p := &Proxy{Dial: pt.dial(echoOrigin)}
+
+	tests := []struct {
+		hops interface{}
+		want COAPCode
+		sent interface{}
+	}{
+		{nil, Content, uint32(DefaultHopLimit)},
+		{uint32(5), Content, uint32(4)},
+		{uint32(2), Content, uint32(1)},
+		{uint32(1), HopLimitReached, nil},
+	}
+	for i, test := range tests {
+		m := proxyRequest(ProxyURI, "coap://sensor.example/")
+		if test.hops != nil {
+			m.SetOption(HopLimit, test.hops)
+		}
+		n := len(pt.seen)
+		rv := p.ServeCOAP(nil, nil, m)
+		if rv == nil || rv.Code != test.want {
+			t.Errorf("%d: got %v, want %v", i, rv, test.want)
+			continue
+		}
+		if test.sent == nil {
+			if len(pt.seen) != n {
+				t.Errorf("%d: forwarded", i)
+			}
+		} else if got := pt.seen[n].Option(HopLimit); got != test.sent {
+			t.Errorf("%d: forwarded Hop-Limit %v, want %v", i, got, test.sent)
+		}
+	}
+}
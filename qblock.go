@@ -0,0 +1,719 @@
+package coap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Congestion control defaults for Q-Block transfers (RFC 9177 section
+// 7.2).
+const (
+	DefaultMaxPayloads       = 10
+	DefaultNonTimeout        = DefaultAckTimeout * time.Second
+	DefaultNonReceiveTimeout = 4 * DefaultNonTimeout
+	DefaultNonMaxRetransmit  = 4
+	DefaultNonPartialTimeout = blockLifetime
+)
+
+// ErrQBlockIncomplete is returned by Conn.SendQBlock when the peer
+// stops answering before a transfer completes.
+var ErrQBlockIncomplete = errors.New("Q-Block transfer incomplete")
+
+// QBlockParams are the congestion control parameters of Q-Block
+// transfers.  Zero fields take the defaults.
+type QBlockParams struct {
+	// MaxPayloads is the number of blocks sent in one burst.
+	MaxPayloads int
+	// NonTimeout is the pause after a burst before the next one is
+	// sent unprompted.  It is randomized by ACK_RANDOM_FACTOR, as
+	// NON_TIMEOUT_RANDOM.
+	NonTimeout time.Duration
+	// NonReceiveTimeout is how long a receiver waits for missing
+	// blocks before asking for them.
+	NonReceiveTimeout time.Duration
+	// NonMaxRetransmit is how many times in a row missing blocks
+	// are asked for before a transfer is abandoned.
+	NonMaxRetransmit int
+	// NonPartialTimeout is how long partial bodies are kept.
+	NonPartialTimeout time.Duration
+}
+
+func (p *QBlockParams) orDefaults() QBlockParams {
+	var rv QBlockParams
+	if p != nil {
+		rv = *p
+	}
+	if rv.MaxPayloads <= 0 {
+		rv.MaxPayloads = DefaultMaxPayloads
+	}
+	if rv.NonTimeout <= 0 {
+		rv.NonTimeout = DefaultNonTimeout
+	}
+	if rv.NonReceiveTimeout <= 0 {
+		rv.NonReceiveTimeout = DefaultNonReceiveTimeout
+	}
+	if rv.NonMaxRetransmit <= 0 {
+		rv.NonMaxRetransmit = DefaultNonMaxRetransmit
+	}
+	if rv.NonPartialTimeout <= 0 {
+		rv.NonPartialTimeout = DefaultNonPartialTimeout
+	}
+	return rv
+}
+
+// nonTimeoutRandom returns NON_TIMEOUT_RANDOM, a random duration
+// between NonTimeout and NonTimeout times ACK_RANDOM_FACTOR.
+func (p QBlockParams) nonTimeoutRandom() time.Duration {
+	spread := int64(float64(p.NonTimeout) * (DefaultAckRandomFactor - 1))
+	return p.NonTimeout + time.Duration(rand.Int63n(spread+1))
+}
+
+// endOfSet reports whether block num is the last of a MAX_PAYLOADS set.
+func (p QBlockParams) endOfSet(num uint32) bool {
+	return (num+1)%uint32(p.MaxPayloads) == 0
+}
+
+// encodeMissingBlocks encodes block numbers as a CBOR sequence of
+// unsigned integers (application/missing-blocks+cbor-seq).
+func encodeMissingBlocks(nums []uint32) []byte {
+	var b []byte
+	for _, n := range nums {
+		switch {
+		case n < 24:
+			b = append(b, byte(n))
+		case n < 1<<8:
+			b = append(b, 0x18, byte(n))
+		case n < 1<<16:
+			b = binary.BigEndian.AppendUint16(append(b, 0x19), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0x1a), n)
+		}
+	}
+	return b
+}
+
+func decodeMissingBlocks(b []byte) ([]uint32, error) {
+	var rv []uint32
+	for len(b) > 0 {
+		var n, l uint32
+		switch ai := b[0]; {
+		case ai < 24:
+			n, l = uint32(ai), 1
+		case ai == 0x18 && len(b) >= 2:
+			n, l = uint32(b[1]), 2
+		case ai == 0x19 && len(b) >= 3:
+			n, l = uint32(binary.BigEndian.Uint16(b[1:])), 3
+		case ai == 0x1a && len(b) >= 5:
+			n, l = binary.BigEndian.Uint32(b[1:]), 5
+		default:
+			return nil, errors.New("invalid missing blocks list")
+		}
+		rv = append(rv, n)
+		b = b[l:]
+	}
+	return rv, nil
+}
+
+// missingBlocks returns up to max numbers of blocks absent from blocks,
+// below last or, if last is negative, below the highest received.
+func missingBlocks(blocks map[uint32][]byte, last int64, max int) []uint32 {
+	end := last
+	if end < 0 {
+		for n := range blocks {
+			if int64(n) > end {
+				end = int64(n)
+			}
+		}
+	}
+	var rv []uint32
+	for n := uint32(0); int64(n) < end && len(rv) < max; n++ {
+		if _, ok := blocks[n]; !ok {
+			rv = append(rv, n)
+		}
+	}
+	return rv
+}
+
+func joinBlocks(blocks map[uint32][]byte, last int64) []byte {
+	var body []byte
+	for n := uint32(0); int64(n) <= last; n++ {
+		body = append(body, blocks[n]...)
+	}
+	return body
+}
+
+// QBlock returns middleware for robust block-wise transfers with the
+// Q-Block1 and Q-Block2 options (RFC 9177), meant for non-confirmable
+// traffic over lossy links.
+//
+// Request bodies sent with Q-Block1 are reassembled for the wrapped
+// handler, as by AssembleBlock1, except that blocks may arrive in any
+// order.  Each complete MAX_PAYLOADS set is answered with 2.31
+// Continue; when blocks are still missing NonReceiveTimeout after the
+// last one arrived, the client is sent 4.08 Request Entity Incomplete
+// listing them.  Bodies over maxSize get 4.13 Request Entity Too Large.
+//
+// Responses to requests carrying Q-Block2 that do not fit in one block
+// of the requested size are sent as the first block, followed by the
+// rest in non-confirmable bursts of MaxPayloads, pausing NonTimeout
+// between bursts unless the client asks for the next one.  The response
+// is kept for NonPartialTimeout so that the client can ask for missing
+// blocks by repeating the request with its ETag and a Q-Block2 option
+// for each.
+func QBlock(maxSize int, params *QBlockParams) Middleware {
+	p := params.orDefaults()
+	return func(h Handler) Handler {
+		return &qblockHandler{
+			h:         h,
+			maxSize:   maxSize,
+			p:         p,
+			bodies:    map[string]*qblockBody{},
+			responses: map[string]*qblockResponse{},
+		}
+	}
+}
+
+type qblockHandler struct {
+	h       Handler
+	maxSize int
+	p       QBlockParams
+	msgID   uint32
+
+	mu        sync.Mutex
+	bodies    map[string]*qblockBody     // Q-Block1 request bodies
+	responses map[string]*qblockResponse // Q-Block2 response bodies
+}
+
+// A qblockBody is a request body being received.
+type qblockBody struct {
+	blocks  map[uint32][]byte
+	szx     uint32
+	last    int64 // number of the last block, or -1 until it arrives
+	req     Message
+	timer   *time.Timer
+	retries int
+	expires time.Time
+}
+
+// stop cancels the request for missing blocks, if one is scheduled.
+func (b *qblockBody) stop() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
+
+// A qblockResponse is a response body being sent.
+type qblockResponse struct {
+	res     Message // without payload
+	body    []byte
+	szx     uint32
+	next    chan struct{}
+	expires time.Time
+}
+
+func (s *qblockHandler) ServeCOAP(l Transport, a net.Addr, m *Message) *Message {
+	if m.Code == Empty || m.Code >= Created {
+		return s.h.ServeCOAP(l, a, m)
+	}
+	if opt, ok := m.Option(QBlock1).(uint32); ok {
+		return s.block1(l, a, m, opt)
+	}
+	if m.Option(QBlock2) != nil {
+		return s.block2(l, a, m)
+	}
+	return s.h.ServeCOAP(l, a, m)
+}
+
+func (s *qblockHandler) nextID() uint16 {
+	return uint16(atomic.AddUint32(&s.msgID, 1))
+}
+
+// prune drops expired bodies.  s.mu must be held.
+func (s *qblockHandler) prune(now time.Time) {
+	for k, b := range s.bodies {
+		if now.After(b.expires) {
+			b.stop()
+			delete(s.bodies, k)
+		}
+	}
+	for k, r := range s.responses {
+		if now.After(r.expires) {
+			delete(s.responses, k)
+		}
+	}
+}
+
+func (s *qblockHandler) block1(l Transport, a net.Addr, m *Message, opt uint32) *Message {
+	num, more, szx := DecodeBlock(opt)
+	if szx == 7 || (more == 1 && len(m.Payload) != BlockSize(szx)) {
+		return replyTo(m, BadRequest)
+	}
+	if size, ok := m.Option(Size1).(uint32); ok && int64(size) > int64(s.maxSize) {
+		return tooLarge(m, s.maxSize)
+	}
+
+	key := blockBodyKey(a, m, QBlock1)
+	now := time.Now()
+	s.mu.Lock()
+	s.prune(now)
+	b := s.bodies[key]
+	if int64(num)*int64(BlockSize(szx))+int64(len(m.Payload)) > int64(s.maxSize) {
+		if b != nil {
+			b.stop()
+			delete(s.bodies, key)
+		}
+		s.mu.Unlock()
+		return tooLarge(m, s.maxSize)
+	}
+	if b == nil || b.szx != szx {
+		if b != nil {
+			b.stop()
+		}
+		b = &qblockBody{blocks: map[uint32][]byte{}, szx: szx, last: -1}
+		s.bodies[key] = b
+	}
+	b.blocks[num] = m.Payload
+	if more == 0 {
+		b.last = int64(num)
+	}
+	b.req = *m
+	b.retries = 0
+	b.expires = now.Add(s.p.NonPartialTimeout)
+	missing := missingBlocks(b.blocks, b.last, 1)
+
+	if b.last >= 0 && len(missing) == 0 {
+		b.stop()
+		delete(s.bodies, key)
+		s.mu.Unlock()
+
+		req := *m
+		req.opts = m.opts.Minus(QBlock1)
+		req.Payload = joinBlocks(b.blocks, b.last)
+		rv := s.h.ServeCOAP(l, a, &req)
+		if rv != nil {
+			rv.SetOption(QBlock1, EncodeBlock(uint32(b.last), 0, szx))
+		}
+		return rv
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(s.p.NonReceiveTimeout, func() { s.incomplete(l, a, key, b) })
+	} else {
+		b.timer.Reset(s.p.NonReceiveTimeout)
+	}
+	s.mu.Unlock()
+
+	switch {
+	case s.p.endOfSet(num) && len(missing) == 0:
+		rv := replyTo(m, Continue)
+		rv.SetOption(QBlock1, opt)
+		return rv
+	case m.IsConfirmable():
+		return &Message{Type: Acknowledgement, MessageID: m.MessageID}
+	}
+	return nil
+}
+
+// incomplete asks the client at a for the blocks missing from the body
+// with key, giving up after NonMaxRetransmit attempts.
+func (s *qblockHandler) incomplete(l Transport, a net.Addr, key string, b *qblockBody) {
+	s.mu.Lock()
+	if s.bodies[key] != b {
+		s.mu.Unlock()
+		return
+	}
+	b.retries++
+	if b.retries > s.p.NonMaxRetransmit {
+		delete(s.bodies, key)
+		s.mu.Unlock()
+		return
+	}
+	missing := missingBlocks(b.blocks, b.last, s.p.MaxPayloads)
+	if b.last < 0 && len(missing) < s.p.MaxPayloads {
+		// The blocks after the highest received may be missing
+		// too.
+		var high uint32
+		for n := range b.blocks {
+			if n > high {
+				high = n
+			}
+		}
+		missing = append(missing, high+1)
+	}
+	token := b.req.Token
+	b.timer.Reset(s.p.NonReceiveTimeout)
+	s.mu.Unlock()
+
+	rv := Message{
+		Type:      NonConfirmable,
+		Code:      RequestEntityIncomplete,
+		MessageID: s.nextID(),
+		Token:     token,
+		Payload:   encodeMissingBlocks(missing),
+	}
+	rv.SetOption(ContentFormat, AppMissingBlocks)
+	Transmit(l, a, rv)
+}
+
+func (s *qblockHandler) block2(l Transport, a net.Addr, m *Message) *Message {
+	var nums []uint32
+	var more, szx uint32
+	for _, v := range m.Options(QBlock2) {
+		var num uint32
+		num, more, szx = DecodeBlock(v.(uint32))
+		nums = append(nums, num)
+	}
+	if szx == 7 {
+		return replyTo(m, BadRequest)
+	}
+
+	key := a.String() + "\x00" + CacheKey(Message{Code: m.Code, Payload: m.Payload,
+		opts: m.opts.Minus(QBlock2).Minus(ETag)})
+	etag := optionBytes(*m, ETag)
+	s.mu.Lock()
+	s.prune(time.Now())
+	r := s.responses[key]
+	s.mu.Unlock()
+	if r == nil || etag == nil || !bytes.Equal(etag, optionBytes(r.res, ETag)) {
+		return s.respond(l, a, m, key, szx)
+	}
+
+	if len(nums) == 1 && more == 1 {
+		// The client has the previous burst and asks for the
+		// next.
+		select {
+		case r.next <- struct{}{}:
+		default:
+		}
+		if m.IsConfirmable() {
+			return &Message{Type: Acknowledgement, MessageID: m.MessageID}
+		}
+		return nil
+	}
+	for _, n := range nums[1:] {
+		if int64(n)*int64(BlockSize(r.szx)) < int64(len(r.body)) {
+			out := r.block(n)
+			out.Type = NonConfirmable
+			out.MessageID = s.nextID()
+			out.Token = m.Token
+			Transmit(l, a, out)
+		}
+	}
+	if int64(nums[0])*int64(BlockSize(r.szx)) >= int64(len(r.body)) {
+		return replyTo(m, BadOption)
+	}
+	rv := r.block(nums[0])
+	rv.MessageID = m.MessageID
+	rv.Token = m.Token
+	rv.Type = NonConfirmable
+	if m.IsConfirmable() {
+		rv.Type = Acknowledgement
+	}
+	return &rv
+}
+
+// respond serves m and, if the response does not fit in one block,
+// sends it block-wise.
+func (s *qblockHandler) respond(l Transport, a net.Addr, m *Message, key string, szx uint32) *Message {
+	req := *m
+	req.opts = m.opts.Minus(QBlock2)
+	rv := s.h.ServeCOAP(l, a, &req)
+	if rv == nil || rv.Code>>5 != 2 || len(rv.Payload) <= BlockSize(szx) {
+		return rv
+	}
+
+	r := &qblockResponse{
+		res:     *rv,
+		body:    rv.Payload,
+		szx:     szx,
+		next:    make(chan struct{}, 1),
+		expires: time.Now().Add(s.p.NonPartialTimeout),
+	}
+	r.res.opts = rv.opts.Minus(QBlock2)
+	r.res.Payload = nil
+	if r.res.Option(ETag) == nil {
+		sum := sha256.Sum256(r.body)
+		r.res.SetOption(ETag, sum[:8])
+	}
+	r.res.SetOption(Size2, uint32(len(r.body)))
+	s.mu.Lock()
+	s.responses[key] = r
+	s.mu.Unlock()
+
+	go s.burst(l, a, r, m.Token)
+	first := r.block(0)
+	return &first
+}
+
+// burst sends the blocks of r after the first to the client at a.
+func (s *qblockHandler) burst(l Transport, a net.Addr, r *qblockResponse, token []byte) {
+	size := BlockSize(r.szx)
+	for num := uint32(1); int(num)*size < len(r.body); num++ {
+		out := r.block(num)
+		out.Type = NonConfirmable
+		out.MessageID = s.nextID()
+		out.Token = token
+		if Transmit(l, a, out) != nil {
+			return
+		}
+		if s.p.endOfSet(num) {
+			select {
+			case <-r.next:
+			case <-time.After(s.p.nonTimeoutRandom()):
+			}
+		}
+	}
+}
+
+// block returns block num of the response.
+func (r *qblockResponse) block(num uint32) Message {
+	size := BlockSize(r.szx)
+	start := int(num) * size
+	end := start + size
+	var more uint32 = 1
+	if end >= len(r.body) {
+		end, more = len(r.body), 0
+	}
+	rv := r.res
+	rv.opts = r.res.opts.Minus(QBlock2)
+	rv.SetOption(QBlock2, EncodeBlock(num, more, r.szx))
+	rv.Payload = r.body[start:end]
+	return rv
+}
+
+// SendQBlock sends req with the Q-Block options (RFC 9177) and returns
+// the response, reassembled if it came block-wise.  A payload larger
+// than a block of size exponent szx is sent as a Q-Block1 body in
+// bursts of MaxPayloads, resending the blocks the server reports
+// missing; otherwise the request asks for a Q-Block2 response, and
+// missing response blocks are asked for.  All messages are sent
+// non-confirmable with consecutive message IDs starting at
+// req.MessageID.
+func (c *Conn) SendQBlock(req Message, szx uint32, params *QBlockParams) (*Message, error) {
+	p := params.orDefaults()
+	req.Type = NonConfirmable
+	if len(req.Payload) > BlockSize(szx) {
+		return c.sendQBlock1(req, szx, p)
+	}
+	req.opts = req.opts.Minus(QBlock2)
+	req.SetOption(QBlock2, EncodeBlock(0, 0, szx))
+	if err := Transmit(c.conn, c.addr, req); err != nil {
+		return nil, err
+	}
+	rv, err := c.receiveResponse(req.Token, time.Now().Add(p.NonReceiveTimeout))
+	if err != nil || rv == nil {
+		if err == nil {
+			err = ErrQBlockIncomplete
+		}
+		return nil, err
+	}
+	if _, ok := rv.Option(QBlock2).(uint32); !ok {
+		return rv, nil
+	}
+	return c.receiveQBlock2(req, rv, p)
+}
+
+func (c *Conn) sendQBlock1(req Message, szx uint32, p QBlockParams) (*Message, error) {
+	body := req.Payload
+	size := BlockSize(szx)
+	n := uint32((len(body) + size - 1) / size)
+	id := req.MessageID
+	send := func(num uint32) error {
+		m := req
+		m.MessageID = id
+		id++
+		m.opts = req.opts.Minus(QBlock1).Minus(Size1)
+		var more uint32
+		end := int(num+1) * size
+		if end < len(body) {
+			more = 1
+		} else {
+			end = len(body)
+		}
+		m.SetOption(QBlock1, EncodeBlock(num, more, szx))
+		m.SetOption(Size1, uint32(len(body)))
+		m.Payload = body[int(num)*size : end]
+		return Transmit(c.conn, c.addr, m)
+	}
+
+	var next uint32 // first block not yet sent
+	var missing []uint32
+	retries := 0
+	for {
+		switch {
+		case len(missing) > 0:
+			for _, num := range missing {
+				if err := send(num); err != nil {
+					return nil, err
+				}
+			}
+			missing = nil
+		case next < n:
+			for end := next - next%uint32(p.MaxPayloads) + uint32(p.MaxPayloads); next < n && next < end; next++ {
+				if err := send(next); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		wait := p.nonTimeoutRandom()
+		if next == n {
+			wait += p.NonReceiveTimeout
+		}
+		rv, err := c.receiveResponse(req.Token, time.Now().Add(wait))
+		switch {
+		case err != nil:
+			return nil, err
+		case rv == nil && next < n:
+			// Carry on with the next burst.
+		case rv == nil:
+			retries++
+			if retries > p.NonMaxRetransmit {
+				return nil, ErrQBlockIncomplete
+			}
+			// Prompt the server for the state of the body.
+			missing = []uint32{n - 1}
+		case rv.Code == Continue:
+			retries = 0
+		case rv.Code == RequestEntityIncomplete && rv.Option(ContentFormat) == AppMissingBlocks:
+			retries++
+			if retries > p.NonMaxRetransmit {
+				return nil, ErrQBlockIncomplete
+			}
+			nums, err := decodeMissingBlocks(rv.Payload)
+			if err != nil {
+				return nil, err
+			}
+			for _, num := range nums {
+				if num < next {
+					missing = append(missing, num)
+				}
+			}
+		default:
+			return rv, nil
+		}
+	}
+}
+
+// receiveQBlock2 collects the blocks of a response whose first block
+// is first, asking for missing ones.
+func (c *Conn) receiveQBlock2(req Message, first *Message, p QBlockParams) (*Message, error) {
+	id := req.MessageID + 1
+	request := func(etag []byte, opts ...uint32) error {
+		m := req
+		m.MessageID = id
+		id++
+		m.opts = req.opts.Minus(QBlock2).Minus(ETag)
+		m.SetOption(ETag, etag)
+		for _, o := range opts {
+			m.AddOption(QBlock2, o)
+		}
+		return Transmit(c.conn, c.addr, m)
+	}
+
+	var (
+		res    Message
+		etag   []byte
+		szx    uint32
+		blocks map[uint32][]byte
+		last   int64
+	)
+	retries := 0
+	for m := first; ; {
+		if m != nil {
+			opt, ok := m.Option(QBlock2).(uint32)
+			if !ok {
+				return m, nil
+			}
+			num, more, bszx := DecodeBlock(opt)
+			if blocks == nil || !bytes.Equal(optionBytes(*m, ETag), etag) {
+				// The representation changed; start over.
+				res, etag, szx = *m, optionBytes(*m, ETag), bszx
+				blocks, last = map[uint32][]byte{}, -1
+			}
+			if bszx == szx {
+				blocks[num] = m.Payload
+				if more == 0 {
+					last = int64(num)
+				}
+			}
+			retries = 0
+
+			if last >= 0 && len(missingBlocks(blocks, last, 1)) == 0 {
+				res.opts = res.opts.Minus(QBlock2)
+				res.Payload = joinBlocks(blocks, last)
+				return &res, nil
+			}
+			if more == 1 && p.endOfSet(num) && len(missingBlocks(blocks, int64(num)+1, 1)) == 0 {
+				if err := request(etag, EncodeBlock(num+1, 1, szx)); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		var err error
+		m, err = c.receiveResponse(req.Token, time.Now().Add(p.NonReceiveTimeout))
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			continue
+		}
+		retries++
+		if retries > p.NonMaxRetransmit {
+			return nil, ErrQBlockIncomplete
+		}
+		missing := missingBlocks(blocks, last, p.MaxPayloads)
+		if last < 0 && len(missing) < p.MaxPayloads {
+			var high uint32
+			for n := range blocks {
+				if n > high {
+					high = n
+				}
+			}
+			missing = append(missing, high+1)
+		}
+		sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+		var opts []uint32
+		for _, n := range missing {
+			opts = append(opts, EncodeBlock(n, 0, szx))
+		}
+		if err := request(etag, opts...); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// receiveResponse returns the next response from the peer with token,
+// or nil if none arrives before deadline.  Confirmable responses are
+// acknowledged.
+func (c *Conn) receiveResponse(token []byte, deadline time.Time) (*Message, error) {
+	for {
+		c.conn.SetReadDeadline(deadline)
+		n, from, err := c.conn.ReadFrom(c.buf)
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if from != nil && from.String() != c.addr.String() {
+			continue
+		}
+		m, err := ParseMessage(append([]byte(nil), c.buf[:n]...))
+		if err != nil || !bytes.Equal(m.Token, token) || m.Code < Created {
+			continue
+		}
+		if m.IsConfirmable() {
+			Transmit(c.conn, c.addr, Message{Type: Acknowledgement, MessageID: m.MessageID})
+		}
+		return &m, nil
+	}
+}
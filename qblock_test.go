@@ -0,0 +1,196 @@
+package coap
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyTransport drops the first transmission of the blocks in drop,
+// numbered by option opt.
+type lossyTransport struct {
+	Transport
+	opt OptionID
+
+	mu      sync.Mutex
+	drop    map[uint32]bool
+	dropped []uint32
+}
+
+func (t *lossyTransport) WriteTo(b []byte, a net.Addr) (int, error) {
+	if m, err := ParseMessage(b); err == nil {
+		if v, ok := m.Option(t.opt).(uint32); ok {
+			num, _, _ := DecodeBlock(v)
+			t.mu.Lock()
+			drop := t.drop[num]
+			delete(t.drop, num)
+			if drop {
+				t.dropped = append(t.dropped, num)
+			}
+			t.mu.Unlock()
+			if drop {
+				return len(b), nil
+			}
+		}
+	}
+	return t.Transport.WriteTo(b, a)
+}
+
+var testQBlockParams = &QBlockParams{
+	MaxPayloads:       10,
+	NonTimeout:        10 * time.Millisecond,
+	NonReceiveTimeout: 40 * time.Millisecond,
+}
+
+func testBody(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestMissingBlocks(t *testing.T) {
+	nums := []uint32{0, 23, 24, 255, 256, 65535, 70000}
+	b := encodeMissingBlocks(nums)
+	if b[0] != 0 || b[1] != 23 || b[2] != 0x18 || b[3] != 24 {
+		t.Errorf("encoded %x", b)
+	}
+	got, err := decodeMissingBlocks(b)
+	if err != nil || !reflect.DeepEqual(got, nums) {
+		t.Errorf("decoded %v, %v", got, err)
+	}
+	if _, err := decodeMissingBlocks([]byte{0x19, 1}); err == nil {
+		t.Errorf("truncated list decoded")
+	}
+}
+
+func TestQBlock1(t *testing.T) {
+	srv, cli := Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	var got []byte
+	var calls int
+	var mu sync.Mutex
+	go Serve(srv, QBlock(4096, testQBlockParams)(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		mu.Lock()
+		got = m.Payload
+		calls++
+		mu.Unlock()
+		return &Message{Type: NonConfirmable, Code: Changed, MessageID: m.MessageID, Token: m.Token}
+	})))
+	lossy := &lossyTransport{Transport: cli, opt: QBlock1, drop: map[uint32]bool{3: true, 12: true, 29: true}}
+	c := NewConn(lossy, srv.LocalAddr())
+
+	body := testBody(30*16 - 5)
+	req := Message{Code: PUT, MessageID: 100, Token: []byte("q1"), Payload: body}
+	req.SetPathString("fw")
+	rv, err := c.SendQBlock(req, 0, testQBlockParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv.Code != Changed || rv.Option(QBlock1) != EncodeBlock(29, 0, 0) {
+		t.Fatalf("got %v", rv)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 || !bytes.Equal(got, body) {
+		t.Errorf("handler called %d times with %d bytes", calls, len(got))
+	}
+	if len(lossy.dropped) != 3 {
+		t.Errorf("dropped %v", lossy.dropped)
+	}
+}
+
+func TestQBlock1SingleBlock(t *testing.T) {
+	var got []byte
+	h := QBlock(1<<16, nil)(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		got = m.Payload
+		return &Message{Type: NonConfirmable, Code: Changed, MessageID: m.MessageID}
+	}))
+	m := &Message{Type: NonConfirmable, Code: POST, Payload: []byte("whole")}
+	m.SetOption(QBlock1, EncodeBlock(0, 0, 6))
+	if rv := h.ServeCOAP(nil, testAddr("a"), m); rv == nil || rv.Code != Changed || string(got) != "whole" {
+		t.Errorf("got %v, body %q", rv, got)
+	}
+}
+
+func TestQBlock1LastFirst(t *testing.T) {
+	var got []byte
+	h := QBlock(1<<16, testQBlockParams)(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		got = m.Payload
+		return &Message{Type: NonConfirmable, Code: Changed, MessageID: m.MessageID}
+	}))
+	block := func(num, more uint32, payload []byte) *Message {
+		m := &Message{Type: NonConfirmable, Code: PUT, Payload: payload}
+		m.SetOption(QBlock1, EncodeBlock(num, more, 0))
+		return m
+	}
+	body := testBody(2*16 + 4)
+	for _, m := range []*Message{block(2, 0, body[32:]), block(0, 1, body[:16])} {
+		if rv := h.ServeCOAP(nil, testAddr("a"), m); rv != nil {
+			t.Fatalf("incomplete body: got %v", rv)
+		}
+	}
+	if rv := h.ServeCOAP(nil, testAddr("a"), block(1, 1, body[16:32])); rv == nil || rv.Code != Changed ||
+		rv.Option(QBlock1) != EncodeBlock(2, 0, 0) || !bytes.Equal(got, body) {
+		t.Errorf("got %v, body %x", rv, got)
+	}
+
+	// A one-block body whose only block is also the last.
+	if rv := h.ServeCOAP(nil, testAddr("b"), block(0, 0, []byte("x"))); rv == nil || string(got) != "x" {
+		t.Errorf("single block: got %v", rv)
+	}
+}
+
+func TestQBlock1TooLarge(t *testing.T) {
+	h := QBlock(64, testQBlockParams)(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		t.Error("handler called")
+		return nil
+	}))
+	m := &Message{Type: NonConfirmable, Code: PUT, Payload: testBody(16)}
+	m.SetOption(QBlock1, EncodeBlock(4, 1, 0))
+	if rv := h.ServeCOAP(nil, testAddr("a"), m); rv == nil || rv.Code != RequestEntityTooLarge {
+		t.Errorf("got %v", rv)
+	}
+}
+
+func TestQBlock2(t *testing.T) {
+	srv, cli := Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	body := testBody(25*16 + 3)
+	lossy := &lossyTransport{Transport: srv, opt: QBlock2, drop: map[uint32]bool{4: true, 9: true, 25: true}}
+	go Serve(lossy, QBlock(4096, testQBlockParams)(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		if m.Option(QBlock2) != nil {
+			t.Error("handler saw Q-Block2")
+		}
+		rv := &Message{Type: NonConfirmable, Code: Content, MessageID: m.MessageID, Token: m.Token, Payload: body}
+		rv.SetOption(ContentFormat, AppOctets)
+		return rv
+	})))
+	c := NewConn(cli, srv.LocalAddr())
+
+	req := Message{Code: GET, MessageID: 200, Token: []byte("q2")}
+	req.SetPathString("log")
+	rv, err := c.SendQBlock(req, 0, testQBlockParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv.Code != Content || !bytes.Equal(rv.Payload, body) || rv.Option(QBlock2) != nil ||
+		rv.Option(ETag) == nil || rv.Option(Size2) != uint32(len(body)) || rv.Option(ContentFormat) != AppOctets {
+		t.Errorf("got %v, %d bytes", rv, len(rv.Payload))
+	}
+	if len(lossy.dropped) != 3 {
+		t.Errorf("dropped %v", lossy.dropped)
+	}
+
+	// Small responses come whole.
+	body = []byte("short")
+	if rv, err := c.SendQBlock(req, 0, testQBlockParams); err != nil || string(rv.Payload) != "short" {
+		t.Errorf("got %v, %v", rv, err)
+	}
+}
@@ -0,0 +1,396 @@
+package coap
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultConfirmInterval is how often ReverseProxy sends notifications
+// confirmable by default (RFC 7641 section 4.5).
+const DefaultConfirmInterval = 24 * time.Hour
+
+// ReverseProxy is a Handler forwarding requests to backend CoAP
+// servers, so that one endpoint can front several of them.
+//
+// Each request is forwarded on its own, so block-wise transfers pass
+// through end to end.  The requests of one client reach a backend from
+// one endpoint of the proxy, kept for EXCHANGE_LIFETIME after its last
+// use, so that the backend sees the blocks of a transfer come from the
+// same endpoint.
+//
+// Observations are relayed: notifications from the backend are sent on
+// to the client until it cancels the observation or the backend ends
+// it.  The first notification after each ConfirmInterval is sent
+// confirmable, and the observation ends if the client rejects a
+// notification or does not acknowledge a confirmable one.
+//
+// Backends that cannot be reached are reported with 5.02 Bad Gateway,
+// and those that do not answer in time with 5.04 Gateway Timeout.  The
+// Hop-Limit of forwarded requests is decremented as by Proxy.
+type ReverseProxy struct {
+	// Director modifies req, the request to forward, and returns the
+	// address of the backend to send it to, or "" if none serves it;
+	// such requests are answered with 4.04 Not Found.  Uri-Host and
+	// Uri-Port, which name the proxy, are removed beforehand.
+	Director func(req *Message) string
+
+	// LocationPrefix, if not empty, is prepended to the Location-Path
+	// of responses, for backends whose resources the proxy serves
+	// under a prefix.
+	LocationPrefix string
+
+	// Dial connects to a backend.  If nil, backends are reached over
+	// UDP.
+	Dial func(addr string) (*Conn, error)
+
+	// ConfirmInterval is how often notifications are sent
+	// confirmable to check that the client is still interested.  If
+	// zero, DefaultConfirmInterval is used.
+	ConfirmInterval time.Duration
+
+	msgID uint32
+
+	mu           sync.Mutex
+	conns        map[string]*backendConn // by client and backend address
+	observations map[string]*observation // by client address and token
+}
+
+// A backendConn is a connection to a backend for the requests of one
+// client.
+type backendConn struct {
+	conn *Conn
+	mu   sync.Mutex // serializes exchanges
+
+	// Guarded by ReverseProxy.mu.
+	users   int
+	expires time.Time
+	timer   *time.Timer
+}
+
+// An observation is a relayed observation of a backend resource.
+type observation struct {
+	conn  *Conn
+	req   Message // registration sent to the backend
+	done  chan struct{}
+	acked chan struct{}
+
+	mid uint16 // of the last notification, guarded by ReverseProxy.mu
+}
+
+// NewReverseProxy returns a ReverseProxy forwarding every request to
+// the backend at addr, for mounting at prefix with ServeMux.Mount.
+func NewReverseProxy(addr, prefix string) *ReverseProxy {
+	return &ReverseProxy{
+		Director:       func(*Message) string { return addr },
+		LocationPrefix: prefix,
+	}
+}
+
+// ServeCOAP forwards a request.  Acknowledgements and resets are
+// passed to ServeAck.
+func (p *ReverseProxy) ServeCOAP(l Transport, a net.Addr, m *Message) *Message {
+	if m.Type == Acknowledgement || m.Type == Reset {
+		p.ServeAck(a, m)
+		return nil
+	}
+	hops, ok := NextHopLimit(m)
+	if !ok {
+		return errorReply(m, HopLimitReached)
+	}
+	req := *m
+	req.Type = Confirmable
+	req.MessageID = uint16(atomic.AddUint32(&p.msgID, 1))
+	req.Token = newToken()
+	req.opts = req.opts.Minus(URIHost).Minus(URIPort)
+	req.SetOption(HopLimit, hops)
+	backend := p.Director(&req)
+	if backend == "" {
+		return errorReply(m, NotFound)
+	}
+
+	key := a.String() + "\x00" + string(m.Token)
+	if obs, ok := m.Option(Observe).(uint32); ok && (m.Code == GET || m.Code == FETCH) {
+		// Registering again with the same token replaces the
+		// observation.
+		p.cancel(key)
+		if obs == 0 {
+			return p.observe(l, a, m, req, backend, key)
+		}
+	}
+
+	ckey := a.String() + "\x00" + backend
+	c, err := p.backend(ckey, backend)
+	if err != nil {
+		return errorReply(m, BadGateway)
+	}
+	c.mu.Lock()
+	res, err := c.conn.Send(req)
+	c.mu.Unlock()
+	p.release(ckey, c, err)
+	if err != nil || res == nil {
+		return gatewayError(m, err)
+	}
+	return p.response(m, res)
+}
+
+// backend returns the connection to the backend at addr with key,
+// dialing it if there is none.  It must be released after use.
+func (p *ReverseProxy) backend(key, addr string) (*backendConn, error) {
+	p.mu.Lock()
+	c := p.conns[key]
+	if c == nil {
+		p.mu.Unlock()
+		conn, err := p.dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		if c = p.conns[key]; c != nil {
+			conn.Close()
+		} else {
+			c = &backendConn{conn: conn}
+			if p.conns == nil {
+				p.conns = map[string]*backendConn{}
+			}
+			p.conns[key] = c
+		}
+	}
+	c.users++
+	p.mu.Unlock()
+	return c, nil
+}
+
+// release ends a use of the connection c with key that failed with
+// err.  Connections are closed after errors, as late responses could be
+// taken for those to later requests, and when unused for blockLifetime.
+func (p *ReverseProxy) release(key string, c *backendConn, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c.users--
+	if err != nil && p.conns[key] == c {
+		delete(p.conns, key)
+	}
+	if p.conns[key] != c {
+		if c.users == 0 {
+			c.conn.Close()
+		}
+		return
+	}
+	c.expires = time.Now().Add(blockLifetime)
+	if c.timer == nil {
+		c.timer = time.AfterFunc(blockLifetime, func() { p.expire(key, c) })
+	} else {
+		c.timer.Reset(blockLifetime)
+	}
+}
+
+// expire closes the connection c with key if it has not been used for
+// blockLifetime.
+func (p *ReverseProxy) expire(key string, c *backendConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[key] == c && c.users == 0 && !time.Now().Before(c.expires) {
+		delete(p.conns, key)
+		c.conn.Close()
+	}
+}
+
+func (p *ReverseProxy) dial(addr string) (*Conn, error) {
+	if p.Dial != nil {
+		return p.Dial(addr)
+	}
+	return Dial("udp", addr)
+}
+
+// response returns the backend response res as the response to m.
+func (p *ReverseProxy) response(m, res *Message) *Message {
+	rv := *res
+	rv.MessageID = m.MessageID
+	rv.Token = m.Token
+	rv.Type = NonConfirmable
+	if m.IsConfirmable() {
+		rv.Type = Acknowledgement
+	}
+	if path := rv.optionStrings(LocationPath); len(path) > 0 && p.LocationPrefix != "" {
+		prefix := strings.Split(strings.Trim(p.LocationPrefix, "/"), "/")
+		rv.SetOption(LocationPath, append(prefix, path...))
+	}
+	return &rv
+}
+
+// observe registers an observation with the backend, relaying its
+// notifications to the client at a if it succeeds.
+func (p *ReverseProxy) observe(l Transport, a net.Addr, m *Message, req Message, backend, key string) *Message {
+	conn, err := p.dial(backend)
+	if err != nil {
+		return errorReply(m, BadGateway)
+	}
+	res, err := conn.Send(req)
+	if err != nil || res == nil {
+		conn.Close()
+		return gatewayError(m, err)
+	}
+	if res.Option(Observe) == nil || res.Code>>5 != 2 {
+		conn.Close()
+		return p.response(m, res)
+	}
+
+	o := &observation{conn: conn, req: req, done: make(chan struct{}), acked: make(chan struct{}, 1)}
+	p.mu.Lock()
+	if p.observations == nil {
+		p.observations = map[string]*observation{}
+	}
+	p.observations[key] = o
+	p.mu.Unlock()
+	go p.relay(l, a, *m, key, o)
+	return p.response(m, res)
+}
+
+// relay sends the notifications of o to the client at a until the
+// observation ends.
+func (p *ReverseProxy) relay(l Transport, a net.Addr, m Message, key string, o *observation) {
+	defer p.remove(key, o)
+	interval := p.ConfirmInterval
+	if interval <= 0 {
+		interval = DefaultConfirmInterval
+	}
+	confirmed := time.Now()
+	for {
+		n, err := o.conn.Receive()
+		select {
+		case <-o.done:
+			return
+		default:
+		}
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			continue
+		} else if err != nil {
+			return
+		}
+
+		if n.IsConfirmable() {
+			o.conn.Send(Message{Type: Acknowledgement, MessageID: n.MessageID})
+		}
+		if !bytes.Equal(n.Token, o.req.Token) || n.Code < Created {
+			continue
+		}
+		out := p.response(&m, n)
+		out.Type = NonConfirmable
+		if time.Since(confirmed) >= interval {
+			out.Type = Confirmable
+		}
+		out.MessageID = uint16(atomic.AddUint32(&p.msgID, 1))
+		p.mu.Lock()
+		o.mid = out.MessageID
+		p.mu.Unlock()
+		if !p.notify(l, a, *out, o) {
+			p.mu.Lock()
+			current := p.observations[key] == o
+			p.mu.Unlock()
+			if current {
+				p.cancel(key)
+			}
+			return
+		}
+		if out.IsConfirmable() {
+			confirmed = time.Now()
+		}
+		if n.Option(Observe) == nil || n.Code>>5 != 2 {
+			return
+		}
+	}
+}
+
+// notify sends the notification n of o to the client at a.  It reports
+// false if sending fails or a confirmable notification is not
+// acknowledged after MaxRetransmit retransmissions.
+func (p *ReverseProxy) notify(l Transport, a net.Addr, n Message, o *observation) bool {
+	select {
+	case <-o.acked:
+	default:
+	}
+	timeout := ResponseTimeout
+	for i := 0; i <= MaxRetransmit; i++ {
+		if Transmit(l, a, n) != nil {
+			return false
+		}
+		if !n.IsConfirmable() {
+			return true
+		}
+		t := time.NewTimer(timeout)
+		select {
+		case <-o.acked:
+			t.Stop()
+			return true
+		case <-o.done:
+			t.Stop()
+			return true
+		case <-t.C:
+		}
+		timeout *= 2
+	}
+	return false
+}
+
+// ServeAck takes the acknowledgement or reset m of a notification sent
+// to the client at a.  A reset ends the observation (RFC 7641 section
+// 3.6).
+func (p *ReverseProxy) ServeAck(a net.Addr, m *Message) {
+	prefix := a.String() + "\x00"
+	p.mu.Lock()
+	var key string
+	var o *observation
+	for k, v := range p.observations {
+		if strings.HasPrefix(k, prefix) && v.mid == m.MessageID {
+			key, o = k, v
+			break
+		}
+	}
+	p.mu.Unlock()
+	if o == nil {
+		return
+	}
+	if m.Type == Reset {
+		p.cancel(key)
+		return
+	}
+	select {
+	case o.acked <- struct{}{}:
+	default:
+	}
+}
+
+// cancel ends the observation with key, deregistering it from the
+// backend.
+func (p *ReverseProxy) cancel(key string) {
+	p.mu.Lock()
+	o := p.observations[key]
+	delete(p.observations, key)
+	p.mu.Unlock()
+	if o == nil {
+		return
+	}
+	close(o.done)
+	dereg := o.req
+	dereg.Type = NonConfirmable
+	dereg.MessageID = uint16(atomic.AddUint32(&p.msgID, 1))
+	dereg.SetOption(Observe, uint32(1))
+	o.conn.Send(dereg)
+	o.conn.Close()
+}
+
+// remove forgets an observation that has ended.
+func (p *ReverseProxy) remove(key string, o *observation) {
+	p.mu.Lock()
+	if p.observations[key] == o {
+		delete(p.observations, key)
+	}
+	p.mu.Unlock()
+	o.conn.Close()
+}
@@ -0,0 +1,334 @@
+package coap
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReverseProxy(t *testing.T) {
+	pt := &proxyTest{}
+	defer pt.close()
+	d := pt.dial(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		rv := &Message{Type: Acknowledgement, Code: Created, MessageID: m.MessageID,
+			Token: m.Token, Payload: []byte(m.PathString())}
+		rv.SetOption(LocationPath, []string{"items", "7"})
+		return rv
+	}))
+	rp := NewReverseProxy("backend:5683", "/sensors")
+	rp.Dial = func(addr string) (*Conn, error) { return d("coap", addr) }
+
+	m := &Message{Type: Confirmable, Code: POST, MessageID: 3, Token: []byte("x")}
+	m.SetPathString("/items")
+	m.SetOption(URIHost, "public.example")
+	m.SetOption(Block1, uint32(0x0e))
+	rv := rp.ServeCOAP(nil, PipeAddr("client"), m)
+	if rv.Code != Created || rv.MessageID != 3 || string(rv.Token) != "x" || string(rv.Payload) != "items" {
+		t.Fatalf("got %v", rv)
+	}
+	if got := rv.optionStrings(LocationPath); len(got) != 3 || got[0] != "sensors" || got[2] != "7" {
+		t.Errorf("Location-Path %q", got)
+	}
+	req := pt.seen[0]
+	if pt.addrs[0] != "backend:5683" || req.Option(URIHost) != nil || req.Option(Block1) != uint32(0x0e) ||
+		req.Option(HopLimit) != uint32(DefaultHopLimit) {
+		t.Errorf("forwarded to %s: %v", pt.addrs[0], req.opts)
+	}
+
+	m.SetOption(HopLimit, uint32(1))
+	if rv := rp.ServeCOAP(nil, PipeAddr("client"), m); rv.Code != HopLimitReached || len(pt.seen) != 1 {
+		t.Errorf("hop limit reached: %v", rv)
+	}
+	m.RemoveOption(HopLimit)
+
+	rp.Director = func(*Message) string { return "" }
+	if rv := rp.ServeCOAP(nil, PipeAddr("client"), m); rv.Code != NotFound {
+		t.Errorf("no backend: %v", rv)
+	}
+	rp.Director = func(*Message) string { return "down:5683" }
+	rp.Dial = func(string) (*Conn, error) { return nil, errors.New("unreachable") }
+	if rv := rp.ServeCOAP(nil, PipeAddr("client"), m); rv.Code != BadGateway {
+		t.Errorf("dial failure: %v", rv)
+	}
+}
+
+func TestReverseProxyObserve(t *testing.T) {
+	type registration struct {
+		l     Transport
+		a     net.Addr
+		token []byte
+		obs   uint32
+	}
+	regs := make(chan registration, 4)
+	pt := &proxyTest{}
+	defer pt.close()
+	d := pt.dial(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		if m.Code != GET {
+			return nil
+		}
+		obs, _ := m.Option(Observe).(uint32)
+		regs <- registration{l, a, m.Token, obs}
+		rv := &Message{Type: Acknowledgement, Code: Content, MessageID: m.MessageID,
+			Token: m.Token, Payload: []byte("n1")}
+		if obs == 0 {
+			rv.SetOption(Observe, uint32(1))
+		}
+		if !m.IsConfirmable() {
+			return nil
+		}
+		return rv
+	}))
+	rp := NewReverseProxy("backend:5683", "")
+	rp.Dial = func(addr string) (*Conn, error) { return d("coap", addr) }
+
+	srv, cli := Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	go Serve(srv, rp)
+	c := NewConn(cli, srv.LocalAddr())
+
+	req := Message{Type: Confirmable, Code: GET, MessageID: 1, Token: []byte("obs")}
+	req.SetPathString("/temp")
+	req.SetOption(Observe, uint32(0))
+	rv, err := c.Send(req)
+	if err != nil || string(rv.Payload) != "n1" || rv.Option(Observe) == nil {
+		t.Fatalf("registration: %v, %v", rv, err)
+	}
+	reg := <-regs
+
+	n := Message{Type: Confirmable, Code: Content, MessageID: 99, Token: reg.token, Payload: []byte("n2")}
+	n.SetOption(Observe, uint32(2))
+	if err := Transmit(reg.l, reg.a, n); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Payload) != "n2" || string(got.Token) != "obs" || got.Type != NonConfirmable ||
+		got.Option(Observe) != uint32(2) {
+		t.Errorf("notification: %v", got)
+	}
+
+	req.MessageID = 2
+	req.SetOption(Observe, uint32(1))
+	if rv, err := c.Send(req); err != nil || rv.Code != Content {
+		t.Fatalf("deregistration: %v, %v", rv, err)
+	}
+	// The backend sees the cancellation on the observation's
+	// connection and the forwarded request, in either order.
+	cancelled := false
+	for i := 0; i < 2; i++ {
+		dereg := <-regs
+		if dereg.obs == 1 && string(dereg.token) == string(reg.token) {
+			cancelled = true
+		}
+	}
+	if !cancelled {
+		t.Errorf("backend observation not cancelled")
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if len(rp.observations) != 0 {
+		t.Errorf("%d observations left", len(rp.observations))
+	}
+}
+
+func TestReverseProxyBlockwise(t *testing.T) {
+	// The backend keeps the body uploaded on each of its connections,
+	// and serves it back block-wise.
+	var mu sync.Mutex
+	bodies := map[Transport][]byte{}
+	pt := &proxyTest{}
+	defer pt.close()
+	d := pt.dial(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		rv := &Message{Type: Acknowledgement, MessageID: m.MessageID, Token: m.Token}
+		mu.Lock()
+		defer mu.Unlock()
+		switch m.Code {
+		case PUT:
+			num, more, szx := DecodeBlock(m.Option(Block1).(uint32))
+			if len(bodies[l]) != int(num)*BlockSize(szx) {
+				rv.Code = RequestEntityIncomplete
+				return rv
+			}
+			bodies[l] = append(bodies[l], m.Payload...)
+			rv.Code = Changed
+			if more == 1 {
+				rv.Code = Continue
+			}
+			rv.SetOption(Block1, m.Option(Block1))
+		case GET:
+			num, _, szx := DecodeBlock(m.Option(Block2).(uint32))
+			body := bodies[l]
+			start := min(int(num)*BlockSize(szx), len(body))
+			end := min(start+BlockSize(szx), len(body))
+			more := uint32(0)
+			if end < len(body) {
+				more = 1
+			}
+			rv.Code = Content
+			rv.Payload = body[start:end]
+			rv.SetOption(Block2, EncodeBlock(num, more, szx))
+		}
+		return rv
+	}))
+	rp := NewReverseProxy("backend:5683", "")
+	rp.Dial = func(addr string) (*Conn, error) { return d("coap", addr) }
+
+	srv, cli := Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	go Serve(srv, rp)
+	c := NewConn(cli, srv.LocalAddr())
+
+	body := testBody(5*16 + 3)
+	for num := 0; num*16 < len(body); num++ {
+		end := min((num+1)*16, len(body))
+		more, want := uint32(1), Continue
+		if end == len(body) {
+			more, want = 0, Changed
+		}
+		req := Message{Type: Confirmable, Code: PUT, MessageID: uint16(num),
+			Token: []byte{byte(num)}, Payload: body[num*16 : end]}
+		req.SetPathString("fw")
+		req.SetOption(Block1, EncodeBlock(uint32(num), more, 0))
+		rv, err := c.Send(req)
+		if err != nil || rv.Code != want || rv.Option(Block1) != req.Option(Block1) {
+			t.Fatalf("block %d: got %v, %v", num, rv, err)
+		}
+	}
+
+	var got []byte
+	for num := uint32(0); ; num++ {
+		req := Message{Type: Confirmable, Code: GET, MessageID: uint16(100 + num), Token: []byte{byte(100 + num)}}
+		req.SetPathString("fw")
+		req.SetOption(Block2, EncodeBlock(num, 0, 0))
+		rv, err := c.Send(req)
+		if err != nil || rv.Code != Content {
+			t.Fatalf("block %d: got %v, %v", num, rv, err)
+		}
+		got = append(got, rv.Payload...)
+		if _, more, _ := DecodeBlock(rv.Option(Block2).(uint32)); more == 0 {
+			break
+		}
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("got %x, want %x", got, body)
+	}
+	if len(pt.addrs) != 1 {
+		t.Errorf("%d backend connections for one client", len(pt.addrs))
+	}
+
+	// Other clients get connections of their own.
+	m := &Message{Type: Confirmable, Code: GET, MessageID: 7, Token: []byte("o")}
+	m.SetPathString("fw")
+	m.SetOption(Block2, EncodeBlock(0, 0, 0))
+	if rv := rp.ServeCOAP(nil, PipeAddr("other"), m); rv.Code != Content || len(rv.Payload) != 0 {
+		t.Errorf("other client: got %v", rv)
+	}
+	if len(pt.addrs) != 2 {
+		t.Errorf("%d backend connections for two clients", len(pt.addrs))
+	}
+}
+
+func TestReverseProxyObserveReset(t *testing.T) {
+	testReverseProxyObserveReset(t, false)
+}
+
+func TestReverseProxyObserveResetMounted(t *testing.T) {
+	testReverseProxyObserveReset(t, true)
+}
+
+// testReverseProxyObserveReset checks that a relayed observation ends
+// when the client rejects a notification, with the proxy served
+// directly or mounted in nested ServeMuxes, which must pass it the
+// client's acknowledgements and resets.
+func testReverseProxyObserveReset(t *testing.T, mount bool) {
+	type registration struct {
+		l     Transport
+		a     net.Addr
+		token []byte
+		obs   uint32
+	}
+	regs := make(chan registration, 4)
+	pt := &proxyTest{}
+	defer pt.close()
+	d := pt.dial(FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		obs, _ := m.Option(Observe).(uint32)
+		regs <- registration{l, a, m.Token, obs}
+		if !m.IsConfirmable() {
+			return nil
+		}
+		rv := &Message{Type: Acknowledgement, Code: Content, MessageID: m.MessageID, Token: m.Token}
+		rv.SetOption(Observe, uint32(1))
+		return rv
+	}))
+	rp := NewReverseProxy("backend:5683", "")
+	rp.Dial = func(addr string) (*Conn, error) { return d("coap", addr) }
+	rp.ConfirmInterval = time.Nanosecond
+
+	srv, cli := Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	path := "/temp"
+	if mount {
+		outer, inner := NewServeMux(), NewServeMux()
+		inner.Mount("/sensors", rp)
+		outer.Mount("/api", inner)
+		go Serve(srv, outer)
+		path = "/api/sensors/temp"
+	} else {
+		go Serve(srv, rp)
+	}
+	c := NewConn(cli, srv.LocalAddr())
+
+	req := Message{Type: Confirmable, Code: GET, MessageID: 1, Token: []byte("obs")}
+	req.SetPathString(path)
+	req.SetOption(Observe, uint32(0))
+	if rv, err := c.Send(req); err != nil || rv.Option(Observe) == nil {
+		t.Fatalf("registration: %v, %v", rv, err)
+	}
+	reg := <-regs
+	pt.mu.Lock()
+	if p := pt.seen[0].PathString(); p != "temp" {
+		t.Errorf("backend got path %q", p)
+	}
+	pt.mu.Unlock()
+
+	notify := func(seq uint32) *Message {
+		n := Message{Type: NonConfirmable, Code: Content, MessageID: uint16(seq), Token: reg.token}
+		n.SetOption(Observe, seq)
+		if err := Transmit(reg.l, reg.a, n); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Receive()
+		if err != nil || got.Type != Confirmable || got.Option(Observe) != seq {
+			t.Fatalf("notification %d: %v, %v", seq, got, err)
+		}
+		return got
+	}
+	// An acknowledged notification keeps the observation.
+	got := notify(2)
+	Transmit(cli, srv.LocalAddr(), Message{Type: Acknowledgement, MessageID: got.MessageID})
+	got = notify(3)
+
+	// A rejected one ends it.
+	Transmit(cli, srv.LocalAddr(), Message{Type: Reset, MessageID: got.MessageID})
+	select {
+	case dereg := <-regs:
+		if dereg.obs != 1 || !bytes.Equal(dereg.token, reg.token) {
+			t.Errorf("backend got %+v", dereg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("backend observation not cancelled")
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if len(rp.observations) != 0 {
+		t.Errorf("%d observations left", len(rp.observations))
+	}
+}
@@ -0,0 +1,211 @@
+package senml
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/zltl/go-coap/internal/cbor"
+)
+
+// CBOR labels (RFC 8428 section 6).
+const (
+	labelBaseVersion = -1
+	labelBaseName    = -2
+	labelBaseTime    = -3
+	labelBaseUnit    = -4
+	labelBaseValue   = -5
+	labelBaseSum     = -6
+	labelName        = 0
+	labelUnit        = 1
+	labelValue       = 2
+	labelStringValue = 3
+	labelBoolValue   = 4
+	labelSum         = 5
+	labelTime        = 6
+	labelUpdateTime  = 7
+	labelDataValue   = 8
+)
+
+var errCBORType = errors.New("senml: field has the wrong type")
+
+// EncodeCBOR encodes pack in the CBOR representation
+// (application/senml+cbor).  Integral numbers are encoded as integers
+// and others in the shortest exact floating-point form.
+func EncodeCBOR(pack []Record) ([]byte, error) {
+	b := cbor.AppendArray(nil, len(pack))
+	for _, r := range pack {
+		var fields []byte
+		n := 0
+		text := func(label int64, s string) {
+			if s != "" {
+				fields = cbor.AppendText(cbor.AppendInt(fields, label), s)
+				n++
+			}
+		}
+		number := func(label int64, f float64, present bool) {
+			if present {
+				fields = appendNumber(cbor.AppendInt(fields, label), f)
+				n++
+			}
+		}
+		text(labelBaseName, r.BaseName)
+		number(labelBaseTime, r.BaseTime, r.BaseTime != 0)
+		text(labelBaseUnit, r.BaseUnit)
+		number(labelBaseValue, r.BaseValue, r.BaseValue != 0)
+		number(labelBaseSum, r.BaseSum, r.BaseSum != 0)
+		number(labelBaseVersion, float64(r.BaseVersion), r.BaseVersion != 0)
+		text(labelName, r.Name)
+		text(labelUnit, r.Unit)
+		if r.Value != nil {
+			number(labelValue, *r.Value, true)
+		}
+		if r.StringValue != nil {
+			fields = cbor.AppendText(cbor.AppendInt(fields, labelStringValue), *r.StringValue)
+			n++
+		}
+		if r.BoolValue != nil {
+			fields = cbor.AppendBool(cbor.AppendInt(fields, labelBoolValue), *r.BoolValue)
+			n++
+		}
+		if r.DataValue != nil {
+			fields = cbor.AppendBytes(cbor.AppendInt(fields, labelDataValue), r.DataValue)
+			n++
+		}
+		if r.Sum != nil {
+			number(labelSum, *r.Sum, true)
+		}
+		number(labelTime, r.Time, r.Time != 0)
+		number(labelUpdateTime, r.UpdateTime, r.UpdateTime != 0)
+
+		b = append(cbor.AppendMap(b, n), fields...)
+	}
+	return b, nil
+}
+
+func appendNumber(b []byte, f float64) []byte {
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return cbor.AppendInt(b, int64(f))
+	}
+	return cbor.AppendFloat(b, f)
+}
+
+// DecodeCBOR decodes the CBOR representation of a pack.
+func DecodeCBOR(data []byte) ([]Record, error) {
+	v, rest, err := cbor.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("senml: trailing data after pack")
+	}
+	items, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("senml: pack is not an array")
+	}
+	pack := make([]Record, len(items))
+	for i, item := range items {
+		m, ok := item.(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New("senml: record is not a map")
+		}
+		if err := decodeCBORRecord(&pack[i], m); err != nil {
+			return nil, err
+		}
+	}
+	return pack, nil
+}
+
+func decodeCBORRecord(r *Record, m map[interface{}]interface{}) error {
+	for k, v := range m {
+		var label int64
+		switch k := k.(type) {
+		case uint64:
+			label = int64(k)
+		case int64:
+			label = k
+		case string:
+			if strings.HasSuffix(k, "_") {
+				return fmt.Errorf("%w %q", ErrMustUnderstand, k)
+			}
+			continue
+		default:
+			continue
+		}
+
+		var err error
+		switch label {
+		case labelBaseName:
+			r.BaseName, err = textValue(v)
+		case labelBaseTime:
+			r.BaseTime, err = numberValue(v)
+		case labelBaseUnit:
+			r.BaseUnit, err = textValue(v)
+		case labelBaseValue:
+			r.BaseValue, err = numberValue(v)
+		case labelBaseSum:
+			r.BaseSum, err = numberValue(v)
+		case labelBaseVersion:
+			var f float64
+			f, err = numberValue(v)
+			r.BaseVersion = int(f)
+		case labelName:
+			r.Name, err = textValue(v)
+		case labelUnit:
+			r.Unit, err = textValue(v)
+		case labelValue:
+			var f float64
+			f, err = numberValue(v)
+			r.Value = Float(f)
+		case labelStringValue:
+			var s string
+			s, err = textValue(v)
+			r.StringValue = String(s)
+		case labelBoolValue:
+			b, ok := v.(bool)
+			if !ok {
+				err = errCBORType
+			}
+			r.BoolValue = Bool(b)
+		case labelDataValue:
+			b, ok := v.([]byte)
+			if !ok {
+				err = errCBORType
+			}
+			r.DataValue = append([]byte{}, b...)
+		case labelSum:
+			var f float64
+			f, err = numberValue(v)
+			r.Sum = Float(f)
+		case labelTime:
+			r.Time, err = numberValue(v)
+		case labelUpdateTime:
+			r.UpdateTime, err = numberValue(v)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: label %d", err, label)
+		}
+	}
+	return nil
+}
+
+func textValue(v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", errCBORType
+	}
+	return s, nil
+}
+
+func numberValue(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case uint64:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, errCBORType
+}
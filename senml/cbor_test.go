@@ -0,0 +1,83 @@
+package senml
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/zltl/go-coap/internal/cbor"
+)
+
+func TestCBOR(t *testing.T) {
+	// RFC 8428 section 6, the CBOR form of the example in 5.1.2.
+	want := "82a4" + "21" + "781c" + hex.EncodeToString([]byte("urn:dev:ow:10e2073a01080063:")) +
+		"00" + "67" + hex.EncodeToString([]byte("voltage")) +
+		"01" + "61" + "56" + "02" + "fb405e066666666666" +
+		"a3" + "00" + "67" + hex.EncodeToString([]byte("current")) +
+		"01" + "61" + "41" + "02" + "fb3ff3333333333333"
+	b, err := EncodeCBOR(examplePack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(b) != want {
+		t.Errorf("EncodeCBOR = %x, want %s", b, want)
+	}
+	pack, err := DecodeCBOR(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pack, examplePack) {
+		t.Errorf("DecodeCBOR = %+v, want %+v", pack, examplePack)
+	}
+}
+
+func TestCBORValues(t *testing.T) {
+	pack := []Record{
+		{BaseTime: 1.5e9, BaseVersion: 10, Name: "s", StringValue: String("on")},
+		{Name: "b", BoolValue: Bool(true), Time: -1.5},
+		{Name: "d", DataValue: []byte{1, 2}},
+		{Name: "z", Value: Float(-3), Sum: Float(0.5)},
+	}
+	b, err := EncodeCBOR(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeCBOR(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, pack) {
+		t.Errorf("DecodeCBOR = %+v, want %+v", got, pack)
+	}
+}
+
+func TestDecodeCBORErrors(t *testing.T) {
+	record := func(k interface{}, v []byte) []byte {
+		b := cbor.AppendMap(cbor.AppendArray(nil, 1), 2)
+		b = cbor.AppendText(cbor.AppendInt(b, labelName), "a")
+		switch k := k.(type) {
+		case int:
+			b = cbor.AppendInt(b, int64(k))
+		case string:
+			b = cbor.AppendText(b, k)
+		}
+		return append(b, v...)
+	}
+	if _, err := DecodeCBOR(record("foo", cbor.AppendUint(nil, 1))); err != nil {
+		t.Errorf("unknown field: %v", err)
+	}
+	if _, err := DecodeCBOR(record(100, cbor.AppendUint(nil, 1))); err != nil {
+		t.Errorf("unknown label: %v", err)
+	}
+	_, err := DecodeCBOR(record("foo_", cbor.AppendUint(nil, 1)))
+	if !errors.Is(err, ErrMustUnderstand) {
+		t.Errorf("must-understand field: %v", err)
+	}
+	if _, err := DecodeCBOR(record(labelValue, cbor.AppendText(nil, "1"))); err == nil {
+		t.Error("text v accepted")
+	}
+	if _, err := DecodeCBOR(cbor.AppendMap(nil, 0)); err == nil {
+		t.Error("map pack accepted")
+	}
+}
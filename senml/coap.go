@@ -0,0 +1,90 @@
+package senml
+
+import (
+	"errors"
+	"net"
+
+	"github.com/zltl/go-coap"
+)
+
+// ErrContentFormat is returned for content formats other than SenML
+// JSON and CBOR.
+var ErrContentFormat = errors.New("senml: unsupported content format")
+
+// Marshal encodes pack in content format mt, which must be
+// coap.AppSenMLJSON or coap.AppSenMLCBOR.
+func Marshal(pack []Record, mt coap.MediaType) ([]byte, error) {
+	switch mt {
+	case coap.AppSenMLJSON:
+		return EncodeJSON(pack)
+	case coap.AppSenMLCBOR:
+		return EncodeCBOR(pack)
+	}
+	return nil, ErrContentFormat
+}
+
+// Unmarshal decodes a pack in content format mt.
+func Unmarshal(data []byte, mt coap.MediaType) ([]Record, error) {
+	switch mt {
+	case coap.AppSenMLJSON:
+		return DecodeJSON(data)
+	case coap.AppSenMLCBOR:
+		return DecodeCBOR(data)
+	}
+	return nil, ErrContentFormat
+}
+
+// SetPayload encodes pack as the payload of m and sets its
+// Content-Format option to mt.
+func SetPayload(m *coap.Message, pack []Record, mt coap.MediaType) error {
+	b, err := Marshal(pack, mt)
+	if err != nil {
+		return err
+	}
+	m.Payload = b
+	m.SetOption(coap.ContentFormat, mt)
+	return nil
+}
+
+// Payload decodes the payload of m according to its Content-Format.
+func Payload(m *coap.Message) ([]Record, error) {
+	mt, ok := m.Option(coap.ContentFormat).(coap.MediaType)
+	if !ok {
+		return nil, ErrContentFormat
+	}
+	return Unmarshal(m.Payload, mt)
+}
+
+// Handler returns a handler replying with the pack f returns, encoded
+// in JSON or CBOR as chosen by the request's Accept option.  Requests
+// accepting other formats are answered with 4.06 Not Acceptable, and
+// errors from f with 5.00 Internal Server Error.  Requests must not
+// carry a payload; the handler is meant for GET.
+func Handler(f func(l coap.Transport, a net.Addr, m *coap.Message) ([]Record, error)) coap.Handler {
+	n := coap.NewNegotiator()
+	for _, mt := range []coap.MediaType{coap.AppSenMLJSON, coap.AppSenMLCBOR} {
+		mt := mt
+		n.ProduceFunc(mt, func(l coap.Transport, a net.Addr, m *coap.Message) *coap.Message {
+			rv := &coap.Message{
+				Type:      coap.NonConfirmable,
+				Code:      coap.Content,
+				MessageID: m.MessageID,
+				Token:     m.Token,
+			}
+			if m.IsConfirmable() {
+				rv.Type = coap.Acknowledgement
+			}
+			pack, err := f(l, a, m)
+			if err == nil {
+				err = SetPayload(rv, pack, mt)
+			}
+			if err != nil {
+				rv.Code = coap.InternalServerError
+				rv.Payload = nil
+				rv.RemoveOption(coap.ContentFormat)
+			}
+			return rv
+		})
+	}
+	return n
+}
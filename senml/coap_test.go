@@ -0,0 +1,85 @@
+package senml
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/zltl/go-coap"
+)
+
+func TestPayload(t *testing.T) {
+	for _, mt := range []coap.MediaType{coap.AppSenMLJSON, coap.AppSenMLCBOR} {
+		var m coap.Message
+		if err := SetPayload(&m, examplePack, mt); err != nil {
+			t.Fatal(err)
+		}
+		if m.Option(coap.ContentFormat) != mt {
+			t.Errorf("Content-Format = %v, want %v", m.Option(coap.ContentFormat), mt)
+		}
+		pack, err := Payload(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(pack, examplePack) {
+			t.Errorf("%v: Payload = %+v", mt, pack)
+		}
+	}
+
+	var m coap.Message
+	if err := SetPayload(&m, examplePack, coap.AppJSON); !errors.Is(err, ErrContentFormat) {
+		t.Errorf("SetPayload(AppJSON) = %v", err)
+	}
+	if _, err := Payload(&m); !errors.Is(err, ErrContentFormat) {
+		t.Errorf("Payload without Content-Format = %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	fail := false
+	h := Handler(func(l coap.Transport, a net.Addr, m *coap.Message) ([]Record, error) {
+		if fail {
+			return nil, errors.New("sensor offline")
+		}
+		return examplePack, nil
+	})
+	get := func(accept ...coap.MediaType) *coap.Message {
+		m := &coap.Message{Type: coap.Confirmable, Code: coap.GET, MessageID: 7, Token: []byte("t")}
+		for _, a := range accept {
+			m.SetOption(coap.Accept, a)
+		}
+		return h.ServeCOAP(nil, nil, m)
+	}
+
+	tests := []struct {
+		accept []coap.MediaType
+		code   coap.COAPCode
+		ct     interface{}
+	}{
+		{nil, coap.Content, coap.AppSenMLJSON},
+		{[]coap.MediaType{coap.AppSenMLJSON}, coap.Content, coap.AppSenMLJSON},
+		{[]coap.MediaType{coap.AppSenMLCBOR}, coap.Content, coap.AppSenMLCBOR},
+		{[]coap.MediaType{coap.AppJSON}, coap.NotAcceptable, nil},
+	}
+	for _, test := range tests {
+		res := get(test.accept...)
+		if res.Code != test.code || res.Option(coap.ContentFormat) != test.ct {
+			t.Errorf("Accept %v: got %v %v, want %v %v", test.accept,
+				res.Code, res.Option(coap.ContentFormat), test.code, test.ct)
+		}
+		if res.Type != coap.Acknowledgement || res.MessageID != 7 || string(res.Token) != "t" {
+			t.Errorf("Accept %v: bad response header %+v", test.accept, res)
+		}
+		if res.Code == coap.Content {
+			if pack, err := Payload(res); err != nil || !reflect.DeepEqual(pack, examplePack) {
+				t.Errorf("Accept %v: payload %+v, %v", test.accept, pack, err)
+			}
+		}
+	}
+
+	fail = true
+	if res := get(); res.Code != coap.InternalServerError || len(res.Payload) != 0 {
+		t.Errorf("error: got %v %q", res.Code, res.Payload)
+	}
+}
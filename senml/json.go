@@ -0,0 +1,102 @@
+package senml
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type jsonRecord struct {
+	BaseName    string   `json:"bn,omitempty"`
+	BaseTime    float64  `json:"bt,omitempty"`
+	BaseUnit    string   `json:"bu,omitempty"`
+	BaseValue   float64  `json:"bv,omitempty"`
+	BaseSum     float64  `json:"bs,omitempty"`
+	BaseVersion int      `json:"bver,omitempty"`
+	Name        string   `json:"n,omitempty"`
+	Unit        string   `json:"u,omitempty"`
+	Value       *float64 `json:"v,omitempty"`
+	StringValue *string  `json:"vs,omitempty"`
+	BoolValue   *bool    `json:"vb,omitempty"`
+	DataValue   *string  `json:"vd,omitempty"`
+	Sum         *float64 `json:"s,omitempty"`
+	Time        float64  `json:"t,omitempty"`
+	UpdateTime  float64  `json:"ut,omitempty"`
+}
+
+// EncodeJSON encodes pack in the JSON representation
+// (application/senml+json).
+func EncodeJSON(pack []Record) ([]byte, error) {
+	rs := make([]jsonRecord, len(pack))
+	for i, r := range pack {
+		rs[i] = jsonRecord{
+			BaseName:    r.BaseName,
+			BaseTime:    r.BaseTime,
+			BaseUnit:    r.BaseUnit,
+			BaseValue:   r.BaseValue,
+			BaseSum:     r.BaseSum,
+			BaseVersion: r.BaseVersion,
+			Name:        r.Name,
+			Unit:        r.Unit,
+			Value:       r.Value,
+			StringValue: r.StringValue,
+			BoolValue:   r.BoolValue,
+			Sum:         r.Sum,
+			Time:        r.Time,
+			UpdateTime:  r.UpdateTime,
+		}
+		if r.DataValue != nil {
+			vd := base64.RawURLEncoding.EncodeToString(r.DataValue)
+			rs[i].DataValue = &vd
+		}
+	}
+	return json.Marshal(rs)
+}
+
+// DecodeJSON decodes the JSON representation of a pack.
+func DecodeJSON(data []byte) ([]Record, error) {
+	var fields []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		for k := range f {
+			if strings.HasSuffix(k, "_") {
+				return nil, fmt.Errorf("%w %q", ErrMustUnderstand, k)
+			}
+		}
+	}
+
+	var rs []jsonRecord
+	if err := json.Unmarshal(data, &rs); err != nil {
+		return nil, err
+	}
+	pack := make([]Record, len(rs))
+	for i, r := range rs {
+		pack[i] = Record{
+			BaseName:    r.BaseName,
+			BaseTime:    r.BaseTime,
+			BaseUnit:    r.BaseUnit,
+			BaseValue:   r.BaseValue,
+			BaseSum:     r.BaseSum,
+			BaseVersion: r.BaseVersion,
+			Name:        r.Name,
+			Unit:        r.Unit,
+			Value:       r.Value,
+			StringValue: r.StringValue,
+			BoolValue:   r.BoolValue,
+			Sum:         r.Sum,
+			Time:        r.Time,
+			UpdateTime:  r.UpdateTime,
+		}
+		if r.DataValue != nil {
+			vd, err := base64.RawURLEncoding.DecodeString(*r.DataValue)
+			if err != nil {
+				return nil, fmt.Errorf("senml: invalid data value: %w", err)
+			}
+			pack[i].DataValue = vd
+		}
+	}
+	return pack, nil
+}
@@ -0,0 +1,69 @@
+package senml
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// RFC 8428 section 5.1.2.
+const exampleJSON = `[{"bn":"urn:dev:ow:10e2073a01080063:","n":"voltage","u":"V","v":120.1},{"n":"current","u":"A","v":1.2}]`
+
+var examplePack = []Record{
+	{BaseName: "urn:dev:ow:10e2073a01080063:", Name: "voltage", Unit: "V", Value: Float(120.1)},
+	{Name: "current", Unit: "A", Value: Float(1.2)},
+}
+
+func TestJSON(t *testing.T) {
+	b, err := EncodeJSON(examplePack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != exampleJSON {
+		t.Errorf("EncodeJSON = %s, want %s", b, exampleJSON)
+	}
+	pack, err := DecodeJSON([]byte(exampleJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pack, examplePack) {
+		t.Errorf("DecodeJSON = %+v, want %+v", pack, examplePack)
+	}
+}
+
+func TestJSONValues(t *testing.T) {
+	pack := []Record{
+		{Name: "s", StringValue: String("on")},
+		{Name: "b", BoolValue: Bool(false)},
+		{Name: "d", DataValue: []byte{0xfb, 0xff}},
+		{Name: "z", Value: Float(0), Sum: Float(3)},
+	}
+	b, err := EncodeJSON(pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"n":"s","vs":"on"},{"n":"b","vb":false},{"n":"d","vd":"-_8"},{"n":"z","v":0,"s":3}]`
+	if string(b) != want {
+		t.Errorf("EncodeJSON = %s, want %s", b, want)
+	}
+	got, err := DecodeJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, pack) {
+		t.Errorf("DecodeJSON = %+v, want %+v", got, pack)
+	}
+}
+
+func TestDecodeJSONExtensions(t *testing.T) {
+	if _, err := DecodeJSON([]byte(`[{"n":"a","v":1,"foo":2}]`)); err != nil {
+		t.Errorf("unknown field: %v", err)
+	}
+	_, err := DecodeJSON([]byte(`[{"n":"a","v":1,"foo_":2}]`))
+	if !errors.Is(err, ErrMustUnderstand) {
+		t.Errorf("must-understand field: %v", err)
+	}
+	if _, err := DecodeJSON([]byte(`[{"n":"a","v":"1"}]`)); err == nil {
+		t.Error("string v accepted")
+	}
+}
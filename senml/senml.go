@@ -0,0 +1,177 @@
+// Package senml implements Sensor Measurement Lists (RFC 8428) in
+// their JSON and CBOR representations.
+package senml
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Version is the SenML version implemented, the default of bver.
+const Version = 10
+
+// Record is a SenML record.  Base fields apply to this record and the
+// records after it in the same pack, until they are set again.
+// Absent numeric fields are zero, except the values, which are nil.
+type Record struct {
+	BaseName    string  // bn
+	BaseTime    float64 // bt
+	BaseUnit    string  // bu
+	BaseValue   float64 // bv
+	BaseSum     float64 // bs
+	BaseVersion int     // bver
+
+	Name        string   // n
+	Unit        string   // u
+	Value       *float64 // v
+	StringValue *string  // vs
+	BoolValue   *bool    // vb
+	DataValue   []byte   // vd
+	Sum         *float64 // s
+	Time        float64  // t
+	UpdateTime  float64  // ut
+}
+
+// Float returns a pointer to v, for Record.Value and Record.Sum.
+func Float(v float64) *float64 { return &v }
+
+// String returns a pointer to v.
+func String(v string) *string { return &v }
+
+// Bool returns a pointer to v.
+func Bool(v bool) *bool { return &v }
+
+// Errors.
+var (
+	ErrVersion        = errors.New("senml: unsupported or inconsistent version")
+	ErrName           = errors.New("senml: invalid name")
+	ErrValue          = errors.New("senml: record must have exactly one value or a sum")
+	ErrNotFinite      = errors.New("senml: value is not a finite number")
+	ErrMustUnderstand = errors.New("senml: unknown must-understand field")
+)
+
+// relativeTimeLimit separates relative times from absolute ones
+// (RFC 8428 section 4.5.3).
+const relativeTimeLimit = 1 << 28
+
+// Normalize returns the resolved form of pack (RFC 8428 section 4.6):
+// base fields are applied and removed, names are complete and times
+// are absolute, relative times being taken from now.  The pack is
+// validated at the same time.
+func Normalize(pack []Record, now time.Time) ([]Record, error) {
+	nowSec := float64(now.UnixNano()) / 1e9
+	rv := make([]Record, 0, len(pack))
+	var base Record
+	version := 0
+	for _, r := range pack {
+		if r.BaseName != "" {
+			base.BaseName = r.BaseName
+		}
+		if r.BaseTime != 0 {
+			base.BaseTime = r.BaseTime
+		}
+		if r.BaseUnit != "" {
+			base.BaseUnit = r.BaseUnit
+		}
+		if r.BaseValue != 0 {
+			base.BaseValue = r.BaseValue
+		}
+		if r.BaseSum != 0 {
+			base.BaseSum = r.BaseSum
+		}
+		if r.BaseVersion != 0 {
+			if version != 0 && r.BaseVersion != version {
+				return nil, ErrVersion
+			}
+			version = r.BaseVersion
+		}
+
+		n := Record{
+			Name:        base.BaseName + r.Name,
+			Unit:        r.Unit,
+			StringValue: r.StringValue,
+			BoolValue:   r.BoolValue,
+			DataValue:   r.DataValue,
+			Time:        base.BaseTime + r.Time,
+			UpdateTime:  r.UpdateTime,
+		}
+		if n.Unit == "" {
+			n.Unit = base.BaseUnit
+		}
+		if r.Value != nil {
+			n.Value = Float(base.BaseValue + *r.Value)
+		}
+		if r.Sum != nil {
+			n.Sum = Float(base.BaseSum + *r.Sum)
+		}
+		if n.Time < relativeTimeLimit {
+			n.Time += nowSec
+		}
+		if err := n.validate(); err != nil {
+			return nil, err
+		}
+		rv = append(rv, n)
+	}
+	if version > Version || version != 0 && version < 5 {
+		return nil, ErrVersion
+	}
+	if version != 0 && version != Version && len(rv) > 0 {
+		rv[0].BaseVersion = version
+	}
+	return rv, nil
+}
+
+// Validate checks pack against the rules of RFC 8428 by resolving it.
+func Validate(pack []Record) error {
+	_, err := Normalize(pack, time.Unix(0, 0))
+	return err
+}
+
+// validate checks a resolved record.
+func (r Record) validate() error {
+	if !validName(r.Name) {
+		return fmt.Errorf("%w %q", ErrName, r.Name)
+	}
+	values := 0
+	if r.Value != nil {
+		values++
+	}
+	if r.StringValue != nil {
+		values++
+	}
+	if r.BoolValue != nil {
+		values++
+	}
+	if r.DataValue != nil {
+		values++
+	}
+	if values > 1 || values == 0 && r.Sum == nil {
+		return ErrValue
+	}
+	for _, f := range []*float64{r.Value, r.Sum, &r.Time, &r.UpdateTime} {
+		if f != nil && (math.IsNaN(*f) || math.IsInf(*f, 0)) {
+			return ErrNotFinite
+		}
+	}
+	return nil
+}
+
+// validName reports whether a resolved name is well formed (RFC 8428
+// section 4.5.1).
+func validName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case i > 0 && (c == '-' || c == ':' || c == '.' || c == '/' || c == '_'):
+		default:
+			return false
+		}
+	}
+	return true
+}
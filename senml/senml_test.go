@@ -0,0 +1,69 @@
+package senml
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	// RFC 8428 section 5.1.4, with its resolved form from section 5.1.5.
+	pack := []Record{
+		{BaseName: "urn:dev:ow:10e2073a0108006:", BaseTime: 1.276020076001e+09,
+			BaseUnit: "A", BaseVersion: 5, Name: "voltage", Unit: "V", Value: Float(120.1)},
+		{Name: "current", Time: -5, Value: Float(1.2)},
+		{Name: "current", Time: -4, Value: Float(1.3)},
+	}
+	want := []Record{
+		{BaseVersion: 5, Name: "urn:dev:ow:10e2073a0108006:voltage", Unit: "V",
+			Value: Float(120.1), Time: 1.276020076001e+09},
+		{Name: "urn:dev:ow:10e2073a0108006:current", Unit: "A",
+			Value: Float(1.2), Time: 1.276020071001e+09},
+		{Name: "urn:dev:ow:10e2073a0108006:current", Unit: "A",
+			Value: Float(1.3), Time: 1.276020072001e+09},
+	}
+	got, err := Normalize(pack, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Normalize = %+v, want %+v", got, want)
+	}
+}
+
+func TestNormalizeRelativeTime(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	got, err := Normalize([]Record{{Name: "a", BaseValue: 2, Value: Float(1), Time: -10}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].Time != 1599999990 || *got[0].Value != 3 {
+		t.Errorf("got %+v", got[0])
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		pack []Record
+		err  error
+	}{
+		{[]Record{{Name: "a", Value: Float(1)}}, nil},
+		{[]Record{{Name: "a", Sum: Float(1)}}, nil},
+		{[]Record{{Name: "a", Value: Float(1), Sum: Float(2)}}, nil},
+		{[]Record{{Name: "a"}}, ErrValue},
+		{[]Record{{Name: "a", Value: Float(1), BoolValue: Bool(true)}}, ErrValue},
+		{[]Record{{Value: Float(1)}}, ErrName},
+		{[]Record{{Name: "-a", Value: Float(1)}}, ErrName},
+		{[]Record{{Name: "a b", Value: Float(1)}}, ErrName},
+		{[]Record{{BaseName: "dev/", Name: "a", StringValue: String("x")}}, nil},
+		{[]Record{{Name: "a", BaseVersion: 11, Value: Float(1)}}, ErrVersion},
+		{[]Record{{Name: "a", BaseVersion: 10, Value: Float(1)},
+			{Name: "b", BaseVersion: 6, Value: Float(1)}}, ErrVersion},
+	}
+	for i, test := range tests {
+		if err := Validate(test.pack); !errors.Is(err, test.err) {
+			t.Errorf("%d: Validate = %v, want %v", i, err, test.err)
+		}
+	}
+}
@@ -2,6 +2,8 @@
 package coap
 
 import (
+	"errors"
+	"io"
 	"log"
 	"net"
 	"time"
@@ -9,24 +11,26 @@ import (
 
 const maxPktLen = 1500
 
+var errNoPeer = errors.New("no destination address")
+
 // Handler is a type that handles CoAP messages.
 type Handler interface {
 	// Handle the message and optionally return a response message.
-	ServeCOAP(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message
+	ServeCOAP(l Transport, a net.Addr, m *Message) *Message
 }
 
-type funcHandler func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message
+type funcHandler func(l Transport, a net.Addr, m *Message) *Message
 
-func (f funcHandler) ServeCOAP(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+func (f funcHandler) ServeCOAP(l Transport, a net.Addr, m *Message) *Message {
 	return f(l, a, m)
 }
 
 // FuncHandler builds a handler from a function.
-func FuncHandler(f func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message) Handler {
+func FuncHandler(f func(l Transport, a net.Addr, m *Message) *Message) Handler {
 	return funcHandler(f)
 }
 
-func handlePacket(l *net.UDPConn, data []byte, u *net.UDPAddr,
+func handlePacket(l Transport, data []byte, u net.Addr,
 	rh Handler) {
 
 	msg, err := ParseMessage(data)
@@ -35,21 +39,51 @@ func handlePacket(l *net.UDPConn, data []byte, u *net.UDPAddr,
 		return
 	}
 
-	rv := rh.ServeCOAP(l, u, &msg)
+	rv := suppress(&msg, rh.ServeCOAP(l, u, &msg))
 	if rv != nil {
 		Transmit(l, u, *rv)
 	}
 }
 
-// Transmit a message.
-func Transmit(l *net.UDPConn, a *net.UDPAddr, m Message) error {
+// No-Response option values, which combine to suppress several
+// response classes (RFC 7967 section 2.1).  Zero suppresses nothing.
+const (
+	NoResponse2xx = 2
+	NoResponse4xx = 8
+	NoResponse5xx = 16
+)
+
+// suppress applies the No-Response option of req to its response rv.
+// A suppressed response to a confirmable request is replaced with an
+// empty acknowledgement.
+func suppress(req, rv *Message) *Message {
+	v, ok := req.Option(NoResponse).(uint32)
+	if !ok || rv == nil || rv.Code < Created {
+		return rv
+	}
+	if v&(1<<(rv.Code>>5-1)) == 0 {
+		return rv
+	}
+	if req.IsConfirmable() {
+		return &Message{Type: Acknowledgement, Code: Empty, MessageID: req.MessageID}
+	}
+	return nil
+}
+
+// Transmit a message.  If a is nil, the message is written to the
+// peer l is connected to.
+func Transmit(l Transport, a net.Addr, m Message) error {
 	d, err := m.MarshalBinary()
 	if err != nil {
 		return err
 	}
 
 	if a == nil {
-		_, err = l.Write(d)
+		w, ok := l.(io.Writer)
+		if !ok {
+			return errNoPeer
+		}
+		_, err = w.Write(d)
 	} else {
 		_, err = l.WriteTo(d, a)
 	}
@@ -57,24 +91,25 @@ func Transmit(l *net.UDPConn, a *net.UDPAddr, m Message) error {
 }
 
 // Receive a message.
-func Receive(l *net.UDPConn, buf []byte) (Message, error) {
+func Receive(l Transport, buf []byte) (Message, error) {
+	m, _, err := receiveFrom(l, buf)
+	return m, err
+}
+
+func receiveFrom(l Transport, buf []byte) (Message, net.Addr, error) {
 	l.SetReadDeadline(time.Now().Add(ResponseTimeout))
 
-	nr, _, err := l.ReadFromUDP(buf)
+	nr, addr, err := l.ReadFrom(buf)
 	if err != nil {
-		return Message{}, err
+		return Message{}, nil, err
 	}
-	return ParseMessage(buf[:nr])
+	m, err := ParseMessage(buf[:nr])
+	return m, addr, err
 }
 
 // ListenAndServe binds to the given address and serve requests forever.
 func ListenAndServe(n, addr string, rh Handler) error {
-	uaddr, err := net.ResolveUDPAddr(n, addr)
-	if err != nil {
-		return err
-	}
-
-	l, err := net.ListenUDP(n, uaddr)
+	l, err := Listen(n, addr)
 	if err != nil {
 		return err
 	}
@@ -82,12 +117,15 @@ func ListenAndServe(n, addr string, rh Handler) error {
 	return Serve(l, rh)
 }
 
-// Serve processes incoming UDP packets on the given listener, and processes
+// Serve processes incoming packets on the given listener, and processes
 // these requests forever (or until the listener is closed).
-func Serve(listener *net.UDPConn, rh Handler) error {
+func Serve(listener Transport, rh Handler) error {
+	if mc, ok := listener.(*multicastConn); ok {
+		rh = multicastHandler(rh, mc.leisure)
+	}
 	buf := make([]byte, maxPktLen)
 	for {
-		nr, addr, err := listener.ReadFromUDP(buf)
+		nr, addr, err := listener.ReadFrom(buf)
 		if err != nil {
 			if neterr, ok := err.(net.Error); ok && (neterr.Temporary() || neterr.Timeout()) {
 				time.Sleep(5 * time.Millisecond)
@@ -18,11 +18,12 @@ func startUDPLisenter(t *testing.T) (*net.UDPConn, string) {
 	return udpListener, coapServerAddr
 }
 
-func dialAndSend(t *testing.T, addr string, req Message) *Message {
-	c, err := Dial("udp", addr)
+func dialAndSend(t *testing.T, n, addr string, req Message) *Message {
+	c, err := Dial(n, addr)
 	if err != nil {
 		t.Fatalf("Error dialing: %v", err)
 	}
+	defer c.Close()
 	m, err := c.Send(req)
 	if err != nil {
 		t.Fatalf("Error sending request: %v", err)
@@ -49,7 +50,7 @@ func TestServeWithAckResponse(t *testing.T) {
 	res.SetOption(ContentFormat, TextPlain)
 	res.SetPath(req.Path())
 
-	handler := FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+	handler := FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
 		assertEqualMessages(t, req, *m)
 		return &res
 	})
@@ -58,7 +59,7 @@ func TestServeWithAckResponse(t *testing.T) {
 	defer udpListener.Close()
 	go Serve(udpListener, handler)
 
-	m := dialAndSend(t, coapServerAddr, req)
+	m := dialAndSend(t, "udp", coapServerAddr, req)
 	if m == nil {
 		t.Fatalf("Didn't receive CoAP response")
 	}
@@ -74,7 +75,7 @@ func TestServeWithoutAckResponse(t *testing.T) {
 	}
 	req.SetOption(ContentFormat, AppOctets)
 
-	handler := FuncHandler(func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+	handler := FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
 		assertEqualMessages(t, req, *m)
 		return nil
 	})
@@ -83,8 +84,60 @@ func TestServeWithoutAckResponse(t *testing.T) {
 	defer udpListener.Close()
 	go Serve(udpListener, handler)
 
-	m := dialAndSend(t, coapServerAddr, req)
+	m := dialAndSend(t, "udp", coapServerAddr, req)
 	if m != nil {
 		t.Fatalf("Received response packet, but expected none")
 	}
 }
+
+func TestNoResponse(t *testing.T) {
+	srv, cli := Pipe()
+	defer srv.Close()
+	defer cli.Close()
+	go Serve(srv, FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		code := Changed
+		if m.PathString() == "fail" {
+			code = InternalServerError
+		}
+		return &Message{Type: Acknowledgement, Code: code, MessageID: m.MessageID, Payload: []byte("x")}
+	}))
+	c := NewConn(cli, srv.LocalAddr())
+
+	tests := []struct {
+		path string
+		nr   interface{}
+		want COAPCode
+	}{
+		{"ok", nil, Changed},
+		{"ok", uint32(0), Changed},
+		{"ok", uint32(NoResponse2xx), Empty},
+		{"ok", uint32(NoResponse4xx | NoResponse5xx), Changed},
+		{"fail", uint32(NoResponse4xx | NoResponse5xx), Empty},
+		{"fail", uint32(NoResponse2xx), InternalServerError},
+	}
+	for i, test := range tests {
+		req := Message{Type: Confirmable, Code: POST, MessageID: uint16(i)}
+		req.SetPathString(test.path)
+		if test.nr != nil {
+			req.SetOption(NoResponse, test.nr)
+		}
+		rv, err := c.Send(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rv.Code != test.want || rv.MessageID != uint16(i) || rv.Code == Empty && len(rv.Payload) > 0 {
+			t.Errorf("%d: got %v, want %v", i, rv, test.want)
+		}
+	}
+}
+
+func TestNoResponseNonConfirmable(t *testing.T) {
+	req := &Message{Type: NonConfirmable, Code: POST}
+	req.SetOption(NoResponse, uint32(NoResponse2xx))
+	if rv := suppress(req, &Message{Type: NonConfirmable, Code: Changed}); rv != nil {
+		t.Errorf("got %v, want no response", rv)
+	}
+	if rv := suppress(req, &Message{Type: NonConfirmable, Code: BadRequest}); rv == nil {
+		t.Error("4.00 suppressed")
+	}
+}
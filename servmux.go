@@ -2,77 +2,460 @@ package coap
 
 import (
 	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 // ServeMux provides mappings from a common endpoint to handlers by
 // request path.
+//
+// Patterns are matched against Uri-Path segments.  A segment of the
+// form {name} matches any single segment, and a final segment of the
+// form {name...} matches the remaining segments, of which there must be
+// at least one.  A trailing slash is an unnamed {...}.  The captured
+// values are available to handlers through Message.PathValue.  When
+// several patterns match, the one whose first differing segment is
+// most specific wins: literals beat {name}, which beats {name...}.
+//
+// A pattern may end in a query such as "?rt=temperature&if", which
+// restricts it to requests whose Uri-Query options include rt with the
+// value temperature and if with any value.  Among patterns with the
+// same path, those with more query conditions are tried first.
+//
+// Patterns are kept in a trie of segments, so lookups take time
+// proportional to the depth of the path rather than the number of
+// patterns.
 type ServeMux struct {
-	m map[string]muxEntry
+	tree *muxTree
+	with []Middleware // wraps handlers registered through this value
+}
+
+// muxTree holds the state shared by a ServeMux and the views returned
+// by With.
+type muxTree struct {
+	root muxNode
+	mws  []Middleware
+	acks []AckHandler // registered handlers taking acknowledgements
+}
+
+// hasAck reports whether h is registered as an AckHandler already.
+func (t *muxTree) hasAck(h AckHandler) bool {
+	if !reflect.TypeOf(h).Comparable() {
+		return false
+	}
+	for _, o := range t.acks {
+		if o == h {
+			return true
+		}
+	}
+	return false
+}
+
+// An AckHandler is a Handler that sends confirmable messages of its
+// own, such as notifications, and takes the empty acknowledgements and
+// resets answering them.  These carry no Uri-Path to be routed by, so
+// ServeMux passes them to every AckHandler registered with it, mounted
+// ServeMuxes included, bypassing middleware.
+type AckHandler interface {
+	Handler
+	ServeAck(a net.Addr, m *Message)
 }
 
 type muxEntry struct {
-	h       Handler
+	h       Handler // for methods without a handler of their own
+	methods map[COAPCode]Handler
 	pattern string
+	segs    []segment
+	query   []queryCond
+	strip   bool      // remove the matched prefix from the path
+	sub     *ServeMux // mounted mux, for discovery
+	res     *Resource // attributes advertised in /.well-known/core
 }
 
-// NewServeMux creates a new ServeMux.
-func NewServeMux() *ServeMux { return &ServeMux{m: make(map[string]muxEntry)} }
+// queryCond requires a Uri-Query key, and if any is false, a value.
+type queryCond struct {
+	key, value string
+	any        bool
+}
 
-// Does path match pattern?
-func pathMatch(pattern, path string) bool {
-	if len(pattern) == 0 {
-		// should not happen
-		return false
+// parseQueryConds parses the query part of a pattern.
+func parseQueryConds(query string) []queryCond {
+	var rv []queryCond
+	for _, kv := range strings.Split(query, "&") {
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		rv = append(rv, queryCond{key: k, value: v, any: !ok})
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].key != rv[j].key {
+			return rv[i].key < rv[j].key
+		}
+		return rv[i].value < rv[j].value
+	})
+	return rv
+}
+
+// accepts reports whether the query conditions of e hold for q.
+func (e *muxEntry) accepts(q url.Values) bool {
+	for _, c := range e.query {
+		vs, ok := q[c.key]
+		if !ok {
+			return false
+		}
+		if !c.any && !contains(vs, c.value) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(vs []string, v string) bool {
+	for _, s := range vs {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// handler returns the handler for the given method, or nil.
+func (e *muxEntry) handler(method COAPCode) Handler {
+	if h, ok := e.methods[method]; ok {
+		return h
+	}
+	return e.h
+}
+
+type segmentKind uint8
+
+// Segment kinds, from most to least specific.
+const (
+	segLiteral segmentKind = iota
+	segParam
+	segWildcard
+)
+
+type segment struct {
+	kind segmentKind
+	s    string // literal value or parameter name
+}
+
+// parsePattern splits a pattern into segments.
+func parsePattern(pattern string) []segment {
+	parts := strings.Split(pattern, "/")
+	segs := make([]segment, len(parts))
+	for i, p := range parts {
+		switch {
+		case i > 0 && i == len(parts)-1 && p == "":
+			segs[i] = segment{kind: segWildcard}
+		case len(p) >= 2 && p[0] == '{' && p[len(p)-1] == '}':
+			name, kind := p[1:len(p)-1], segParam
+			if strings.HasSuffix(name, "...") {
+				name, kind = strings.TrimSuffix(name, "..."), segWildcard
+				if i != len(parts)-1 {
+					panic("coap: wildcard not at end of pattern " + pattern)
+				}
+			}
+			segs[i] = segment{kind: kind, s: name}
+		default:
+			segs[i] = segment{kind: segLiteral, s: p}
+		}
+	}
+	return segs
+}
+
+// muxNode is a node of the segment trie holding the routes of a
+// ServeMux.  Each level corresponds to one Uri-Path segment.
+type muxNode struct {
+	literal  map[string]*muxNode
+	param    *muxNode
+	wildcard muxEntries // patterns ending in {name...} here
+	entry    muxEntries // patterns ending here
+}
+
+// muxEntries holds the patterns sharing a path, ordered by decreasing
+// number of query conditions.
+type muxEntries []*muxEntry
+
+// find returns the first entry for which ok holds.
+func (es muxEntries) find(ok func(*muxEntry) bool) *muxEntry {
+	for _, e := range es {
+		if ok(e) {
+			return e
+		}
+	}
+	return nil
+}
+
+// add inserts e after the entries with at least as many query
+// conditions.
+func (es *muxEntries) add(e *muxEntry) {
+	i := sort.Search(len(*es), func(i int) bool {
+		return len((*es)[i].query) < len(e.query)
+	})
+	*es = append(*es, nil)
+	copy((*es)[i+1:], (*es)[i:])
+	(*es)[i] = e
+}
+
+// slot returns where the entries for segs are stored, creating nodes
+// as needed.
+func (n *muxNode) slot(segs []segment) *muxEntries {
+	for _, s := range segs {
+		switch s.kind {
+		case segLiteral:
+			if n.literal == nil {
+				n.literal = map[string]*muxNode{}
+			}
+			c := n.literal[s.s]
+			if c == nil {
+				c = &muxNode{}
+				n.literal[s.s] = c
+			}
+			n = c
+		case segParam:
+			if n.param == nil {
+				n.param = &muxNode{}
+			}
+			n = n.param
+		case segWildcard:
+			return &n.wildcard
+		}
+	}
+	return &n.entry
+}
+
+// entries returns the entries for segs, or nil if there are none.
+func (n *muxNode) entries(segs []segment) muxEntries {
+	for _, s := range segs {
+		switch s.kind {
+		case segLiteral:
+			n = n.literal[s.s]
+		case segParam:
+			n = n.param
+		case segWildcard:
+			return n.wildcard
+		}
+		if n == nil {
+			return nil
+		}
+	}
+	return n.entry
+}
+
+// lookup finds the most specific entry matching path[i:] and query q,
+// trying literals before parameters before wildcards at every segment.
+// It returns the entry and the number of segments before its wildcard.
+func (n *muxNode) lookup(path []string, i int, q url.Values) (*muxEntry, int) {
+	return n.match(path, i, func(e *muxEntry) bool { return e.accepts(q) })
+}
+
+// match is lookup for entries for which ok holds.
+func (n *muxNode) match(path []string, i int, ok func(*muxEntry) bool) (*muxEntry, int) {
+	if i == len(path) {
+		return n.entry.find(ok), i
+	}
+	if c := n.literal[path[i]]; c != nil {
+		if e, p := c.match(path, i+1, ok); e != nil {
+			return e, p
+		}
 	}
-	n := len(pattern)
-	if pattern[n-1] != '/' {
-		return pattern == path
+	if n.param != nil {
+		if e, p := n.param.match(path, i+1, ok); e != nil {
+			return e, p
+		}
 	}
-	return len(path) >= n && path[0:n] == pattern
+	return n.wildcard.find(ok), i
 }
 
-// Find a handler on a handler map given a path string
-// Most-specific (longest) pattern wins
-func (mux *ServeMux) match(path string) (h Handler, pattern string) {
-	var n = 0
-	for k, v := range mux.m {
-		if !pathMatch(k, path) {
+// walk calls f for every entry below n.
+func (n *muxNode) walk(f func(*muxEntry)) {
+	for _, e := range n.entry {
+		f(e)
+	}
+	for _, e := range n.wildcard {
+		f(e)
+	}
+	for _, c := range n.literal {
+		c.walk(f)
+	}
+	if n.param != nil {
+		n.param.walk(f)
+	}
+}
+
+// values returns the parameters e captures from path.
+func (e *muxEntry) values(path []string) map[string]string {
+	var vals map[string]string
+	for i, s := range e.segs {
+		if s.kind == segLiteral || s.s == "" {
 			continue
 		}
-		if h == nil || len(k) > n {
-			n = len(k)
-			h = v.h
-			pattern = v.pattern
+		if vals == nil {
+			vals = map[string]string{}
+		}
+		if s.kind == segWildcard {
+			vals[s.s] = strings.Join(path[i:], "/")
+		} else {
+			vals[s.s] = path[i]
 		}
 	}
-	return
+	return vals
 }
 
-func notFoundHandler(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+// NewServeMux creates a new ServeMux.
+func NewServeMux() *ServeMux { return &ServeMux{tree: &muxTree{}} }
+
+// errorReply acknowledges a confirmable request with an error code.
+func errorReply(m *Message, code COAPCode) *Message {
 	if m.IsConfirmable() {
 		return &Message{
-			Type: Acknowledgement,
-			Code: NotFound,
+			Type:      Acknowledgement,
+			Code:      code,
+			MessageID: m.MessageID,
+			Token:     m.Token,
 		}
 	}
 	return nil
 }
 
+// replyTo returns a response to m with code, piggybacked on the
+// acknowledgement of a CON request.  Unlike errorReply it also answers
+// NON requests.
+func replyTo(m *Message, code COAPCode) *Message {
+	rv := &Message{
+		Type:      NonConfirmable,
+		Code:      code,
+		MessageID: m.MessageID,
+		Token:     m.Token,
+	}
+	if m.IsConfirmable() {
+		rv.Type = Acknowledgement
+	}
+	return rv
+}
+
+func notFoundHandler(l Transport, a net.Addr, m *Message) *Message {
+	return errorReply(m, NotFound)
+}
+
+func methodNotAllowedHandler(l Transport, a net.Addr, m *Message) *Message {
+	return errorReply(m, MethodNotAllowed)
+}
+
 var _ = Handler(&ServeMux{})
 
 // ServeCOAP handles a single COAP message.  The message arrives from
-// the given listener having originated from the given UDPAddr.
-func (mux *ServeMux) ServeCOAP(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
-	h, _ := mux.match(m.PathString())
-	if h == nil {
-		h, _ = funcHandler(notFoundHandler), ""
+// the given listener having originated from the given address.
+// Requests for a registered path with a method that has no handler
+// are answered with 4.05 Method Not Allowed.  Empty acknowledgements and
+// resets are passed to ServeAck.
+func (mux *ServeMux) ServeCOAP(l Transport, a net.Addr, m *Message) *Message {
+	if m.Code == Empty && (m.Type == Acknowledgement || m.Type == Reset) {
+		mux.ServeAck(a, m)
+		return nil
 	}
-	// TODO:  Rewrite path?
-	return h.ServeCOAP(l, a, m)
+	return Chain(mux.tree.mws...)(mux.handler(m)).ServeCOAP(l, a, m)
 }
 
-// Handle configures a handler for the given path.
-func (mux *ServeMux) Handle(pattern string, handler Handler) {
+// ServeAck passes the empty acknowledgement or reset m to the
+// AckHandlers registered with mux.
+func (mux *ServeMux) ServeAck(a net.Addr, m *Message) {
+	for _, h := range mux.tree.acks {
+		h.ServeAck(a, m)
+	}
+}
+
+// handler returns the handler for m, recording the path parameters of
+// the matching pattern in m.
+func (mux *ServeMux) handler(m *Message) Handler {
+	path := m.Path()
+	if len(path) == 0 {
+		path = []string{""}
+	}
+	// A less specific pattern handling the method is preferred over
+	// answering 4.05 for a more specific one.
+	q := m.Query()
+	e, prefix := mux.tree.root.match(path, 0, func(e *muxEntry) bool {
+		return e.accepts(q) && e.handler(m.Code) != nil
+	})
+	if e == nil {
+		if e, _ := mux.tree.root.lookup(path, 0, q); e != nil {
+			return funcHandler(methodNotAllowedHandler)
+		}
+		if len(path) == 2 && path[0] == ".well-known" && path[1] == "core" {
+			return funcHandler(mux.serveWellKnownCore)
+		}
+		return funcHandler(notFoundHandler)
+	}
+	h := e.handler(m.Code)
+
+	for k, v := range e.values(path) {
+		m.SetPathValue(k, v)
+	}
+	if !e.strip {
+		return h
+	}
+	rest := path[prefix:]
+	return funcHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		rm := *m
+		rm.SetPath(rest)
+		return h.ServeCOAP(l, a, &rm)
+	})
+}
+
+// Use appends middleware applied to every request the mux serves,
+// including those answered with 4.04 Not Found or 4.05 Method Not
+// Allowed.  The first middleware is the outermost.  Use must not be
+// called while the mux is serving.
+func (mux *ServeMux) Use(mws ...Middleware) {
+	mux.tree.mws = append(mux.tree.mws, mws...)
+}
+
+// With returns a view of the mux that wraps the handlers registered
+// through it with mws, in addition to any middleware of mux.  Use this
+// to apply middleware to a group of routes.
+func (mux *ServeMux) With(mws ...Middleware) *ServeMux {
+	with := append(append([]Middleware{}, mux.with...), mws...)
+	return &ServeMux{tree: mux.tree, with: with}
+}
+
+// Handle configures a handler for the given path.  The handler
+// receives every method not registered with HandleMethod.  The
+// resource, if given, is advertised through /.well-known/core.
+func (mux *ServeMux) Handle(pattern string, handler Handler, res ...Resource) {
+	mux.handle(Empty, pattern, handler, false, res)
+}
+
+// HandleMethod configures a handler for the given method and path, as
+// Handle does.
+func (mux *ServeMux) HandleMethod(method COAPCode, pattern string, handler Handler, res ...Resource) {
+	if method == Empty || method >= Created {
+		panic("coap: invalid method " + method.String())
+	}
+	mux.handle(method, pattern, handler, false, res)
+}
+
+// Mount configures a handler, typically another ServeMux, for every
+// path below prefix.  The handler sees the path with the segments
+// matched by prefix removed; parameters captured by prefix remain
+// available through PathValue.
+func (mux *ServeMux) Mount(prefix string, handler Handler) {
+	path, query, ok := strings.Cut(prefix, "?")
+	pattern := strings.TrimSuffix(path, "/") + "/"
+	if ok {
+		pattern += "?" + query
+	}
+	mux.handle(Empty, pattern, handler, true, nil)
+}
+
+// handle registers handler for method, or for any method if method is
+// Empty, and the attributes of the resource, if any.
+func (mux *ServeMux) handle(method COAPCode, pattern string, handler Handler, strip bool, res []Resource) {
 	for pattern != "" && pattern[0] == '/' {
 		pattern = pattern[1:]
 	}
@@ -83,15 +466,65 @@ func (mux *ServeMux) Handle(pattern string, handler Handler) {
 	if handler == nil {
 		panic("coap: nil handler")
 	}
-	if _, ok := mux.m[pattern]; ok {
-		panic("coap: multiple registration for " + pattern)
+	if len(res) > 1 {
+		panic("coap: several resources for " + pattern)
 	}
 
-	mux.m[pattern] = muxEntry{h: handler, pattern: pattern}
+	path, query, _ := strings.Cut(pattern, "?")
+	segs := parsePattern(path)
+	conds := parseQueryConds(query)
+	sub, _ := handler.(*ServeMux)
+	if ah, ok := handler.(AckHandler); ok && !mux.tree.hasAck(ah) {
+		mux.tree.acks = append(mux.tree.acks, ah)
+	}
+	handler = Chain(mux.with...)(handler)
+	slot := mux.tree.root.slot(segs)
+	var e *muxEntry
+	for _, o := range *slot {
+		if reflect.DeepEqual(o.query, conds) {
+			e = o
+		}
+	}
+	if e == nil {
+		e = &muxEntry{
+			methods: map[COAPCode]Handler{},
+			pattern: pattern,
+			segs:    segs,
+			query:   conds,
+			strip:   strip,
+		}
+		if strip {
+			e.sub = sub
+		}
+		slot.add(e)
+	} else if e.pattern != pattern || e.strip != strip {
+		panic("coap: pattern " + pattern + " conflicts with " + e.pattern)
+	}
+	if len(res) == 1 {
+		e.res = &res[0]
+	}
+	if method == Empty {
+		if e.h != nil {
+			panic("coap: multiple registration for " + pattern)
+		}
+		e.h = handler
+	} else {
+		if _, ok := e.methods[method]; ok {
+			panic("coap: multiple registration for " +
+				method.String() + " " + pattern)
+		}
+		e.methods[method] = handler
+	}
 }
 
 // HandleFunc configures a handler for the given path.
 func (mux *ServeMux) HandleFunc(pattern string,
-	f func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message) {
-	mux.Handle(pattern, FuncHandler(f))
+	f func(l Transport, a net.Addr, m *Message) *Message, res ...Resource) {
+	mux.Handle(pattern, FuncHandler(f), res...)
+}
+
+// HandleMethodFunc configures a handler for the given method and path.
+func (mux *ServeMux) HandleMethodFunc(method COAPCode, pattern string,
+	f func(l Transport, a net.Addr, m *Message) *Message, res ...Resource) {
+	mux.HandleMethod(method, pattern, FuncHandler(f), res...)
 }
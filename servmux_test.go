@@ -1,7 +1,10 @@
 package coap
 
 import (
+	"fmt"
 	"net"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -10,11 +13,11 @@ func TestPathMatching(t *testing.T) {
 
 	msgs := map[string]int{}
 
-	m.HandleFunc("/a", func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+	m.HandleFunc("/a", func(l Transport, a net.Addr, m *Message) *Message {
 		msgs["a"]++
 		return nil
 	})
-	m.HandleFunc("/b", func(l *net.UDPConn, a *net.UDPAddr, m *Message) *Message {
+	m.HandleFunc("/b", func(l Transport, a net.Addr, m *Message) *Message {
 		msgs["b"]++
 		return nil
 	})
@@ -51,6 +54,13 @@ func TestPathMatch(t *testing.T) {
 		{"/a/b/c/", "/a/b/c/d", true},
 		{"/a/b/c", "/", false},
 		{"/a/", "/", false},
+		{"/a/", "/a", false},
+		{"/a/", "/a/", true},
+		{"/a/{x}/c", "/a/b/c", true},
+		{"/a/{x}/c", "/a/b/d", false},
+		{"/a/{x}", "/a/b/c", false},
+		{"/a/{x...}", "/a/b/c", true},
+		{"/a/{x...}", "/a", false},
 	}
 
 	for _, test := range tests {
@@ -60,3 +70,366 @@ func TestPathMatch(t *testing.T) {
 		}
 	}
 }
+
+// pathMatch reports whether a mux with only pattern routes path to it.
+func pathMatch(pattern, path string) bool {
+	if len(pattern) == 0 {
+		return false
+	}
+	var n muxNode
+	n.slot(parsePattern(pattern)).add(&muxEntry{})
+	e, _ := n.lookup(strings.Split(path, "/"), 0, nil)
+	return e != nil
+}
+
+func TestMethodRouting(t *testing.T) {
+	m := NewServeMux()
+	reply := func(code COAPCode) func(l Transport, a net.Addr, m *Message) *Message {
+		return func(l Transport, a net.Addr, m *Message) *Message {
+			return &Message{Type: Acknowledgement, Code: code}
+		}
+	}
+	m.HandleMethodFunc(GET, "/sensors/temp", reply(Content))
+	m.HandleMethodFunc(PUT, "/sensors/temp", reply(Changed))
+	m.HandleFunc("/any", reply(Valid))
+	m.HandleMethodFunc(DELETE, "/any", reply(Deleted))
+	m.HandleMethodFunc(GET, "/a/b", reply(Content))
+	m.HandleMethodFunc(PUT, "/a/{x}", reply(Changed))
+
+	tests := []struct {
+		method COAPCode
+		path   string
+		exp    COAPCode
+	}{
+		{GET, "/sensors/temp", Content},
+		{PUT, "/sensors/temp", Changed},
+		{POST, "/sensors/temp", MethodNotAllowed},
+		{DELETE, "/sensors/temp", MethodNotAllowed},
+		{GET, "/sensors/humidity", NotFound},
+		{POST, "/any", Valid},
+		{DELETE, "/any", Deleted},
+		{GET, "/a/b", Content},
+		{PUT, "/a/b", Changed},
+		{POST, "/a/b", MethodNotAllowed},
+		{PUT, "/a/c", Changed},
+	}
+	for _, test := range tests {
+		req := &Message{Type: Confirmable, Code: test.method,
+			MessageID: 42, Token: []byte{7}}
+		req.SetPathString(test.path)
+		rv := m.ServeCOAP(nil, nil, req)
+		if rv == nil || rv.Code != test.exp {
+			t.Errorf("%v %v: got %v, want %v", test.method, test.path, rv, test.exp)
+			continue
+		}
+		if test.exp == MethodNotAllowed &&
+			(rv.MessageID != 42 || string(rv.Token) != "\x07") {
+			t.Errorf("%v %v: reply does not match request: %v", test.method, test.path, rv)
+		}
+	}
+}
+
+func TestMethodRegistrationConflict(t *testing.T) {
+	m := NewServeMux()
+	h := FuncHandler(func(l Transport, a net.Addr, m *Message) *Message { return nil })
+	m.HandleMethod(GET, "x", h)
+	m.Handle("x", h)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("duplicate GET registration did not panic")
+		}
+	}()
+	m.HandleMethod(GET, "/x", h)
+}
+
+func TestPathParams(t *testing.T) {
+	m := NewServeMux()
+	var got []string
+	record := func(name string) func(l Transport, a net.Addr, m *Message) *Message {
+		return func(l Transport, a net.Addr, m *Message) *Message {
+			got = append(got, name+" id="+m.PathValue("id")+
+				" sensor="+m.PathValue("sensor")+" rest="+m.PathValue("rest"))
+			return nil
+		}
+	}
+	m.HandleFunc("devices/{id}/sensors/{sensor}", record("sensor"))
+	m.HandleFunc("devices/{id}/sensors/all", record("all"))
+	m.HandleFunc("devices/{id}/{rest...}", record("device"))
+	m.HandleFunc("devices/new", record("new"))
+
+	for _, path := range []string{
+		"devices/7/sensors/temp",
+		"devices/7/sensors/all",
+		"devices/7/config/net/ip",
+		"devices/new",
+		"devices/7",
+	} {
+		msg := &Message{Type: NonConfirmable, Code: GET}
+		msg.SetPathString(path)
+		m.ServeCOAP(nil, nil, msg)
+	}
+
+	exp := []string{
+		"sensor id=7 sensor=temp rest=",
+		"all id=7 sensor= rest=",
+		"device id=7 sensor= rest=config/net/ip",
+		"new id= sensor= rest=",
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %q, got %q", exp, got)
+	}
+}
+
+func TestPatternConflict(t *testing.T) {
+	m := NewServeMux()
+	h := FuncHandler(func(l Transport, a net.Addr, m *Message) *Message { return nil })
+	m.HandleMethod(GET, "a/{x}", h)
+	m.HandleMethod(PUT, "a/{x}", h)
+	defer func() {
+		if recover() == nil {
+			t.Errorf("conflicting pattern did not panic")
+		}
+	}()
+	m.HandleMethod(POST, "a/{y}", h)
+}
+
+func TestMount(t *testing.T) {
+	sub := NewServeMux()
+	sub.HandleMethodFunc(GET, "sensors/{sensor}",
+		func(l Transport, a net.Addr, m *Message) *Message {
+			return &Message{
+				Type:    Acknowledgement,
+				Code:    Content,
+				Payload: []byte(m.PathValue("id") + ":" + m.PathValue("sensor") + ":" + m.PathString()),
+			}
+		})
+	m := NewServeMux()
+	m.Mount("/devices/{id}", sub)
+
+	req := &Message{Type: Confirmable, Code: GET}
+	req.SetPathString("/devices/7/sensors/temp")
+	rv := m.ServeCOAP(nil, nil, req)
+	if rv == nil || string(rv.Payload) != "7:temp:sensors/temp" {
+		t.Errorf("Expected 7:temp:sensors/temp, got %v", rv)
+	}
+	if req.PathString() != "devices/7/sensors/temp" {
+		t.Errorf("Request path was rewritten to %q", req.PathString())
+	}
+
+	req.SetPathString("/devices/7/other")
+	if rv := m.ServeCOAP(nil, nil, req); rv == nil || rv.Code != NotFound {
+		t.Errorf("Expected NotFound from sub-mux, got %v", rv)
+	}
+}
+
+func TestQueryRouting(t *testing.T) {
+	m := NewServeMux()
+	reply := func(name string) func(l Transport, a net.Addr, m *Message) *Message {
+		return func(l Transport, a net.Addr, m *Message) *Message {
+			return &Message{Type: Acknowledgement, Code: Content, Payload: []byte(name)}
+		}
+	}
+	m.HandleFunc("sensors", reply("all"))
+	m.HandleFunc("sensors?rt=temperature", reply("temp"))
+	m.HandleFunc("sensors?rt=temperature&if", reply("temp-if"))
+	m.HandleFunc("{x}?only", reply("only"))
+
+	tests := []struct {
+		path  string
+		query []string
+		exp   string
+	}{
+		{"sensors", nil, "all"},
+		{"sensors", []string{"rt=humidity"}, "all"},
+		{"sensors", []string{"rt=temperature"}, "temp"},
+		{"sensors", []string{"if=sensor", "rt=temperature"}, "temp-if"},
+		{"sensors", []string{"only"}, "all"},
+		{"other", []string{"only=1"}, "only"},
+		{"other", nil, ""},
+	}
+	for _, test := range tests {
+		req := &Message{Type: Confirmable, Code: GET}
+		req.SetPathString(test.path)
+		req.SetOption(URIQuery, test.query)
+		rv := m.ServeCOAP(nil, nil, req)
+		if got := string(rv.Payload); got != test.exp {
+			t.Errorf("%s?%v: Expected %q, got %q (%v)", test.path, test.query, test.exp, got, rv.Code)
+		}
+	}
+}
+
+// baselineMux is the ServeMux lookup from before patterns were kept in
+// a trie, copied unchanged for BenchmarkServeMuxLookup.  It tests every
+// pattern against the path and supports only exact and trailing-slash
+// prefix patterns.
+type baselineMux struct {
+	m map[string]baselineEntry
+}
+
+type baselineEntry struct {
+	h       Handler
+	pattern string
+}
+
+// Does path match pattern?
+func baselinePathMatch(pattern, path string) bool {
+	if len(pattern) == 0 {
+		// should not happen
+		return false
+	}
+	n := len(pattern)
+	if pattern[n-1] != '/' {
+		return pattern == path
+	}
+	return len(path) >= n && path[0:n] == pattern
+}
+
+// Find a handler on a handler map given a path string
+// Most-specific (longest) pattern wins
+func (mux *baselineMux) match(path string) (h Handler, pattern string) {
+	var n = 0
+	for k, v := range mux.m {
+		if !baselinePathMatch(k, path) {
+			continue
+		}
+		if h == nil || len(k) > n {
+			n = len(k)
+			h = v.h
+			pattern = v.pattern
+		}
+	}
+	return
+}
+
+// lwm2mPatterns returns routes resembling an LwM2M client with many
+// object instances.
+func lwm2mPatterns() []string {
+	var rv []string
+	for obj := 0; obj < 100; obj++ {
+		for inst := 0; inst < 20; inst++ {
+			rv = append(rv, fmt.Sprintf("%d/%d/{res}", 3300+obj, inst))
+		}
+		rv = append(rv, fmt.Sprintf("%d/{inst...}", 3300+obj))
+	}
+	return rv
+}
+
+func TestTrieSpecificity(t *testing.T) {
+	m := NewServeMux()
+	h := FuncHandler(func(l Transport, a net.Addr, m *Message) *Message { return nil })
+	for _, p := range append(lwm2mPatterns(), "{obj}/0/5700", "3303/{inst}/5700", "a/", "a/{b}/c") {
+		m.Handle(p, h)
+	}
+	for path, exp := range map[string]string{
+		"3303/0/5700":  "3303/0/{res}",
+		"3303/7/5700":  "3303/7/{res}",
+		"3399/19/1":    "3399/19/{res}",
+		"3399/20/1":    "3399/{inst...}",
+		"3303/20/5700": "3303/{inst}/5700",
+		"3300/1/2/3":   "3300/{inst...}",
+		"9999/0/5700":  "{obj}/0/5700",
+		"9999/1/5700":  "",
+		"a/x/c":        "a/{b}/c",
+		"a/x/d":        "a/",
+		"a":            "",
+	} {
+		got, _ := m.tree.root.lookup(strings.Split(path, "/"), 0, nil)
+		if got == nil && exp != "" || got != nil && got.pattern != exp {
+			t.Errorf("%s: found %v, want %q", path, got, exp)
+		}
+	}
+}
+
+// lwm2mLiteralPatterns returns routes like those of lwm2mPatterns that
+// the baseline mux supports.
+func lwm2mLiteralPatterns() []string {
+	var rv []string
+	for obj := 0; obj < 100; obj++ {
+		for inst := 0; inst < 20; inst++ {
+			rv = append(rv, fmt.Sprintf("%d/%d/5700", 3300+obj, inst))
+		}
+		rv = append(rv, fmt.Sprintf("%d/", 3300+obj))
+	}
+	return rv
+}
+
+func TestTrieMatchesBaseline(t *testing.T) {
+	m := NewServeMux()
+	bm := &baselineMux{m: map[string]baselineEntry{}}
+	h := FuncHandler(func(l Transport, a net.Addr, m *Message) *Message { return nil })
+	for _, p := range lwm2mLiteralPatterns() {
+		m.Handle(p, h)
+		bm.m[p] = baselineEntry{h: h, pattern: p}
+	}
+	for _, path := range []string{
+		"3303/0/5700", "3303/7/5700", "3399/19/5700", "3399/20/5700",
+		"3300/1/2/3", "3300", "9999/0/5700",
+	} {
+		got, _ := m.tree.root.lookup(strings.Split(path, "/"), 0, nil)
+		_, exp := bm.match(path)
+		switch {
+		case got == nil && exp == "":
+		case got == nil || got.pattern != exp:
+			t.Errorf("%s: trie found %v, baseline found %q", path, got, exp)
+		}
+	}
+}
+
+// BenchmarkServeMuxLookup compares the trie with the baseline lookup
+// on routes both support.
+func BenchmarkServeMuxLookup(b *testing.B) {
+	patterns := lwm2mLiteralPatterns()
+	path := "3350/17/5700"
+
+	b.Run("trie", func(b *testing.B) {
+		m := NewServeMux()
+		h := FuncHandler(func(l Transport, a net.Addr, m *Message) *Message { return nil })
+		for _, p := range patterns {
+			m.Handle(p, h)
+		}
+		segs := strings.Split(path, "/")
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m.tree.root.lookup(segs, 0, nil)
+		}
+	})
+	b.Run("baseline", func(b *testing.B) {
+		bm := &baselineMux{m: map[string]baselineEntry{}}
+		h := FuncHandler(func(l Transport, a net.Addr, m *Message) *Message { return nil })
+		for _, p := range patterns {
+			bm.m[p] = baselineEntry{h: h, pattern: p}
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			bm.match(path)
+		}
+	})
+}
+
+// ackCounter is an AckHandler counting the messages passed to it.
+type ackCounter struct{ n int }
+
+func (h *ackCounter) ServeCOAP(l Transport, a net.Addr, m *Message) *Message { return nil }
+func (h *ackCounter) ServeAck(a net.Addr, m *Message)                        { h.n++ }
+
+func TestServeAck(t *testing.T) {
+	h := &ackCounter{}
+	sub := NewServeMux()
+	sub.HandleMethod(GET, "x", h)
+	sub.HandleMethod(PUT, "x", h)
+	mux := NewServeMux()
+	mux.Use(func(Handler) Handler {
+		t.Error("middleware saw an acknowledgement")
+		return nil
+	})
+	mux.Mount("sub", sub)
+
+	for _, typ := range []COAPType{Acknowledgement, Reset} {
+		if rv := mux.ServeCOAP(nil, testAddr("a"), &Message{Type: typ, MessageID: 5}); rv != nil {
+			t.Errorf("%v: answered with %v", typ, rv)
+		}
+	}
+	if h.n != 2 {
+		t.Errorf("handler got %d messages, want 2", h.n)
+	}
+}
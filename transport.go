@@ -0,0 +1,161 @@
+package coap
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Transport is a packet-oriented endpoint over which CoAP messages
+// are exchanged.  Each call to ReadFrom returns a single datagram and
+// the address of the endpoint that sent it, and each call to WriteTo
+// sends a single datagram to the given endpoint.
+//
+// *net.UDPConn and *net.UnixConn (unixgram) satisfy Transport, as do
+// the in-memory endpoints returned by Pipe.
+type Transport interface {
+	ReadFrom(b []byte) (n int, addr net.Addr, err error)
+	WriteTo(b []byte, addr net.Addr) (n int, err error)
+	LocalAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+var (
+	_ = Transport(&net.UDPConn{})
+	_ = Transport(&net.UnixConn{})
+	_ = Transport(&pipeConn{})
+)
+
+// Listen creates a Transport listening on the given local address.
+// Supported networks are "udp", "udp4", "udp6" and "unixgram".
+func Listen(n, addr string) (Transport, error) {
+	switch n {
+	case "unixgram":
+		uaddr, err := net.ResolveUnixAddr(n, addr)
+		if err != nil {
+			return nil, err
+		}
+		return net.ListenUnixgram(n, uaddr)
+	default:
+		uaddr, err := net.ResolveUDPAddr(n, addr)
+		if err != nil {
+			return nil, err
+		}
+		return net.ListenUDP(n, uaddr)
+	}
+}
+
+// resolveAddr resolves addr as an endpoint address on network n.
+func resolveAddr(n, addr string) (net.Addr, error) {
+	switch n {
+	case "unixgram":
+		return net.ResolveUnixAddr(n, addr)
+	default:
+		return net.ResolveUDPAddr(n, addr)
+	}
+}
+
+// pipeQueueLen is the number of datagrams a pipe endpoint buffers
+// before further datagrams are dropped.
+const pipeQueueLen = 64
+
+// PipeAddr is the address of an in-memory endpoint created by Pipe.
+type PipeAddr string
+
+// Network returns "pipe".
+func (a PipeAddr) Network() string { return "pipe" }
+
+func (a PipeAddr) String() string { return string(a) }
+
+type pipeConn struct {
+	local PipeAddr
+	peer  *pipeConn
+	rx    chan []byte
+
+	mu       sync.Mutex
+	deadline time.Time
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Pipe creates a pair of connected in-memory Transports.  Datagrams
+// written to one end are delivered to the other regardless of the
+// address passed to WriteTo.  Like UDP, delivery is not guaranteed:
+// datagrams are dropped when the receiver's queue is full or the
+// receiver has been closed.
+func Pipe() (Transport, Transport) {
+	a := &pipeConn{
+		local:  PipeAddr("pipe-a"),
+		rx:     make(chan []byte, pipeQueueLen),
+		closed: make(chan struct{}),
+	}
+	b := &pipeConn{
+		local:  PipeAddr("pipe-b"),
+		rx:     make(chan []byte, pipeQueueLen),
+		closed: make(chan struct{}),
+	}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (p *pipeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	p.mu.Lock()
+	deadline := p.deadline
+	p.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case d := <-p.rx:
+		return copy(b, d), p.peer.local, nil
+	case <-p.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (p *pipeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	d := make([]byte, len(b))
+	copy(d, b)
+
+	select {
+	case <-p.peer.closed:
+	case p.peer.rx <- d:
+	default:
+		// Receiver queue is full; drop the datagram.
+	}
+	return len(b), nil
+}
+
+func (p *pipeConn) LocalAddr() net.Addr { return p.local }
+
+func (p *pipeConn) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadline = t
+	return nil
+}
+
+func (p *pipeConn) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
@@ -0,0 +1,127 @@
+package coap
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPipeDelivery(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	if _, err := a.WriteTo([]byte("hello"), b.LocalAddr()); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+
+	buf := make([]byte, 16)
+	n, from, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Errorf("Expected %q, got %q", "hello", buf[:n])
+	}
+	if from.String() != a.LocalAddr().String() {
+		t.Errorf("Expected datagram from %v, got %v", a.LocalAddr(), from)
+	}
+}
+
+func TestPipeReadDeadline(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err := b.ReadFrom(make([]byte, 16))
+	if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+}
+
+func TestPipeClose(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+
+	errc := make(chan error)
+	go func() {
+		_, _, err := b.ReadFrom(make([]byte, 16))
+		errc <- err
+	}()
+	b.Close()
+	if err := <-errc; err != net.ErrClosed {
+		t.Errorf("Expected %v, got %v", net.ErrClosed, err)
+	}
+	if _, err := a.WriteTo([]byte("x"), nil); err != nil {
+		t.Errorf("Expected write to closed peer to be dropped, got %v", err)
+	}
+}
+
+func TestServeOverPipe(t *testing.T) {
+	srv, cli := Pipe()
+	defer srv.Close()
+	defer cli.Close()
+
+	go Serve(srv, FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		return &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Payload:   []byte("pong"),
+		}
+	}))
+
+	req := Message{
+		Type:      Confirmable,
+		Code:      GET,
+		MessageID: 4321,
+	}
+	req.SetPathString("/ping")
+
+	rv, err := NewConn(cli, srv.LocalAddr()).Send(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	if rv == nil || string(rv.Payload) != "pong" {
+		t.Fatalf("Expected pong, got %v", rv)
+	}
+}
+
+func TestServeOverUnixgram(t *testing.T) {
+	dir, err := os.MkdirTemp("", "coap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "coap.sock")
+
+	l, err := Listen("unixgram", path)
+	if err != nil {
+		t.Skipf("unixgram unavailable: %v", err)
+	}
+	defer l.Close()
+
+	go Serve(l, FuncHandler(func(l Transport, a net.Addr, m *Message) *Message {
+		return &Message{
+			Type:      Acknowledgement,
+			Code:      Content,
+			MessageID: m.MessageID,
+			Payload:   m.Payload,
+		}
+	}))
+
+	req := Message{
+		Type:      Confirmable,
+		Code:      POST,
+		MessageID: 1234,
+		Payload:   []byte("over unixgram"),
+	}
+
+	m := dialAndSend(t, "unixgram", path, req)
+	if m == nil || string(m.Payload) != "over unixgram" {
+		t.Fatalf("Expected echoed payload, got %v", m)
+	}
+}
@@ -0,0 +1,137 @@
+package coap
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zltl/go-coap/linkformat"
+)
+
+// Resource holds the attributes a ServeMux advertises for a resource
+// through /.well-known/core (RFC 6690).
+type Resource struct {
+	ResourceTypes  []string    // rt
+	Interfaces     []string    // if
+	ContentFormats []MediaType // ct
+	Size           uint32      // sz, if not zero
+	Observable     bool        // obs
+	Title          string      // title
+}
+
+// Describe sets the attributes advertised for the resource at path,
+// replacing those given when it was registered.  It panics if no
+// pattern was registered for path.
+func (mux *ServeMux) Describe(path string, r Resource) {
+	path, _, _ = strings.Cut(strings.TrimLeft(path, "/"), "?")
+	var e *muxEntry
+	for _, o := range mux.tree.root.entries(parsePattern(path)) {
+		if e == nil || len(o.query) == 0 {
+			e = o
+		}
+	}
+	if e == nil || e.strip {
+		panic("coap: no pattern registered for " + path)
+	}
+	e.res = &r
+}
+
+// link returns the link advertising r at path.
+func (r Resource) link(path string) linkformat.Link {
+	l := linkformat.Link{Target: "/" + path}
+	if len(r.ResourceTypes) > 0 {
+		l.Add("rt", strings.Join(r.ResourceTypes, " "))
+	}
+	if len(r.Interfaces) > 0 {
+		l.Add("if", strings.Join(r.Interfaces, " "))
+	}
+	if len(r.ContentFormats) > 0 {
+		cts := make([]string, len(r.ContentFormats))
+		for i, ct := range r.ContentFormats {
+			cts[i] = strconv.Itoa(int(ct))
+		}
+		l.Add("ct", strings.Join(cts, " "))
+	}
+	if r.Size > 0 {
+		l.Add("sz", strconv.FormatUint(uint64(r.Size), 10))
+	}
+	if r.Observable {
+		l.Add("obs", "")
+	}
+	if r.Title != "" {
+		l.Add("title", r.Title)
+	}
+	return l
+}
+
+// links returns the resources of the mux whose paths have no
+// parameters, including those of mounted muxes, below prefix.
+func (mux *ServeMux) links(prefix string) []linkformat.Link {
+	var rv []linkformat.Link
+	var paths []string
+	res := map[string]*Resource{}
+	mux.tree.root.walk(func(e *muxEntry) {
+		path, _, _ := strings.Cut(e.pattern, "?")
+		segs := e.segs
+		if e.strip {
+			segs = segs[:len(segs)-1]
+		}
+		for _, s := range segs {
+			if s.kind != segLiteral {
+				return
+			}
+		}
+		if e.strip {
+			if e.sub != nil {
+				rv = append(rv, e.sub.links(prefix+path)...)
+			}
+			return
+		}
+		// Patterns differing only in their query share a
+		// resource, described by any of them.
+		r, seen := res[path]
+		if !seen {
+			paths = append(paths, path)
+		}
+		if r == nil {
+			res[path] = e.res
+		}
+	})
+	for _, path := range paths {
+		var r Resource
+		if res[path] != nil {
+			r = *res[path]
+		}
+		rv = append(rv, r.link(prefix+path))
+	}
+	return rv
+}
+
+// serveWellKnownCore lists the resources of the mux in CoRE Link
+// Format, filtered by the request's query.
+func (mux *ServeMux) serveWellKnownCore(l Transport, a net.Addr, m *Message) *Message {
+	if m.Code != GET {
+		return errorReply(m, MethodNotAllowed)
+	}
+	links := mux.links("")
+	sort.Slice(links, func(i, j int) bool { return links[i].Target < links[j].Target })
+	for name, vals := range m.Query() {
+		for _, v := range vals {
+			links = linkformat.Filter(links, name, v)
+		}
+	}
+
+	rv := &Message{
+		Type:      NonConfirmable,
+		Code:      Content,
+		MessageID: m.MessageID,
+		Token:     m.Token,
+		Payload:   linkformat.Marshal(links),
+	}
+	if m.IsConfirmable() {
+		rv.Type = Acknowledgement
+	}
+	rv.SetOption(ContentFormat, AppLinkFormat)
+	return rv
+}
@@ -0,0 +1,89 @@
+package coap
+
+import (
+	"net"
+	"testing"
+)
+
+func TestWellKnownCore(t *testing.T) {
+	nop := func(l Transport, a net.Addr, m *Message) *Message { return nil }
+	mux := NewServeMux()
+	mux.HandleMethodFunc(GET, "sensors/temp", nop)
+	mux.Describe("/sensors/temp", Resource{
+		ResourceTypes:  []string{"temperature-c", "oic.r.temperature"},
+		Interfaces:     []string{"sensor"},
+		ContentFormats: []MediaType{TextPlain},
+		Observable:     true,
+		Title:          `Room "A"`,
+	})
+	mux.HandleFunc("sensors/light?raw", nop)
+	mux.HandleFunc("sensors/light", nop, Resource{
+		ResourceTypes:  []string{"light-lux"},
+		ContentFormats: []MediaType{TextPlain, AppJSON},
+		Size:           12,
+	})
+	mux.HandleFunc("devices/{id}", nop)
+	sub := NewServeMux()
+	sub.HandleMethodFunc(POST, "fw", nop, Resource{Interfaces: []string{"core.a"}})
+	mux.Mount("mgmt", sub)
+
+	tests := []struct {
+		query []string
+		exp   string
+	}{
+		{nil, `</mgmt/fw>;if="core.a",` +
+			`</sensors/light>;rt="light-lux";ct="0 50";sz=12,` +
+			`</sensors/temp>;rt="temperature-c oic.r.temperature";if="sensor";ct=0;obs;title="Room \"A\""`},
+		{[]string{"rt=light-lux"}, `</sensors/light>;rt="light-lux";ct="0 50";sz=12`},
+		{[]string{"rt=oic.*"}, `</sensors/temp>;rt="temperature-c oic.r.temperature";if="sensor";ct=0;obs;title="Room \"A\""`},
+		{[]string{"href=/mgmt*"}, `</mgmt/fw>;if="core.a"`},
+		{[]string{"ct=50"}, `</sensors/light>;rt="light-lux";ct="0 50";sz=12`},
+		{[]string{"rt=nothing"}, ``},
+	}
+	for _, test := range tests {
+		req := &Message{Type: Confirmable, Code: GET, MessageID: 3}
+		req.SetPathString("/.well-known/core")
+		req.SetOption(URIQuery, test.query)
+		rv := mux.ServeCOAP(nil, nil, req)
+		if rv == nil || rv.Code != Content || rv.Option(ContentFormat) != AppLinkFormat {
+			t.Fatalf("%v: Expected link-format content, got %v", test.query, rv)
+		}
+		if got := string(rv.Payload); got != test.exp {
+			t.Errorf("%v:\nExpected %s\ngot      %s", test.query, test.exp, got)
+		}
+	}
+
+	req := &Message{Type: Confirmable, Code: POST}
+	req.SetPathString("/.well-known/core")
+	if rv := mux.ServeCOAP(nil, nil, req); rv == nil || rv.Code != MethodNotAllowed {
+		t.Errorf("POST: Expected MethodNotAllowed, got %v", rv)
+	}
+}
+
+func TestWellKnownCoreOverride(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc(".well-known/core", func(l Transport, a net.Addr, m *Message) *Message {
+		return &Message{Type: Acknowledgement, Code: Content, Payload: []byte("custom")}
+	})
+	req := &Message{Type: Confirmable, Code: GET}
+	req.SetPathString("/.well-known/core")
+	if rv := mux.ServeCOAP(nil, nil, req); string(rv.Payload) != "custom" {
+		t.Errorf("Expected custom handler, got %v", rv)
+	}
+}
+
+func TestDescribeWithoutRoute(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("a/{id}", func(l Transport, a net.Addr, m *Message) *Message { return nil })
+	mux.Describe("a/{id}", Resource{Title: "A"})
+	for _, path := range []string{"a", "a/1", "b"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: described without a route", path)
+				}
+			}()
+			mux.Describe(path, Resource{Title: "stale"})
+		}()
+	}
+}